@@ -0,0 +1,32 @@
+use std::process::Command;
+
+// Runs a command and returns the first line it prints, or None if it could
+// not be run or failed.
+fn first_line(program: &str, args: &[&str]) -> Option<String> {
+    let output = Command::new(program).args(args).output().ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    let stdout = String::from_utf8(output.stdout).ok()?;
+    stdout.lines().next().map(|l| l.trim().to_string())
+}
+
+// Records the compiler version and the git commit for archdiff version. A
+// commit set in ARCHDIFF_COMMIT, like by a package build outside the git
+// checkout, is kept as is.
+fn main() {
+    let rustc = std::env::var("RUSTC").unwrap_or_else(|_| "rustc".to_string());
+    let rustc = first_line(&rustc, &["-V"]).unwrap_or_else(|| "unknown".to_string());
+    println!("cargo:rustc-env=ARCHDIFF_RUSTC={}", rustc);
+
+    println!("cargo:rerun-if-env-changed=ARCHDIFF_COMMIT");
+    let commit = std::env::var("ARCHDIFF_COMMIT")
+        .ok()
+        .or_else(|| first_line("git", &["rev-parse", "--short", "HEAD"]))
+        .unwrap_or_else(|| "unknown".to_string());
+    println!("cargo:rustc-env=ARCHDIFF_COMMIT={}", commit);
+    if let Some(dir) = first_line("git", &["rev-parse", "--git-dir"]) {
+        println!("cargo:rerun-if-changed={}/HEAD", dir);
+        println!("cargo:rerun-if-changed={}/refs", dir);
+    }
+}
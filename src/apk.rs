@@ -0,0 +1,449 @@
+use crate::localdb::open_archive;
+use crate::mtree::MtreeEntry;
+use crate::source::{BackupHash, Package, PackageSource, Reason};
+use anyhow::{Context, Result};
+use base64::engine::general_purpose::STANDARD;
+use base64::Engine;
+use std::collections::{HashMap, HashSet};
+use std::ffi::OsStr;
+use std::io::Read;
+use std::path::Path;
+use std::sync::Mutex;
+
+// Splits a file in the apk database format into its records, each a list of
+// single letter keys and their values, up to a blank line.
+fn records(contents: &str) -> Vec<Vec<(&str, &str)>> {
+    contents
+        .split("\n\n")
+        .map(|record| {
+            record
+                .lines()
+                .filter_map(|line| line.split_once(':'))
+                .collect::<Vec<_>>()
+        })
+        .filter(|record| !record.is_empty())
+        .collect()
+}
+
+// Strips the version constraint or repository tag from a dependency like
+// so:libc.musl-x86_64.so.1 or busybox>=1.36.
+fn dep(dep: &str) -> &str {
+    let end = dep.find(['<', '>', '=', '~', '@']).unwrap_or(dep.len());
+    &dep[..end]
+}
+
+// Decodes a checksum, which apk writes as Q1 followed by the base64 of its
+// sha1, to hex.
+fn checksum(value: &str) -> Option<String> {
+    let sha1 = STANDARD.decode(value.strip_prefix("Q1")?).ok()?;
+    Some(sha1.iter().map(|b| format!("{:02x}", b)).collect())
+}
+
+// Parses the owner and mode apk records for a dir or file as uid:gid:mode.
+fn acl(entry: &mut MtreeEntry, value: &str) {
+    let mut parts = value.split(':');
+    entry.uid = parts.next().and_then(|v| v.parse().ok());
+    entry.gid = parts.next().and_then(|v| v.parse().ok());
+    entry.mode = parts.next().and_then(|v| u32::from_str_radix(v, 8).ok());
+}
+
+// The protected paths apk starts with, before those in
+// etc/apk/protected_paths.d.
+const PROTECTED_PATHS: &str = "+etc\n@etc/init.d\n!etc/apk\n";
+
+// Reads the paths apk protects from being overwritten, as the path and
+// whether files under it are config files, from the lines of the
+// etc/apk/protected_paths.d/*.list files. Lines start with + for paths whose
+// changed files are protected, ! for paths whose files always are, - for
+// paths whose files are not, and @ for paths where only symlinks are.
+fn protected_paths(root: &str) -> Result<Vec<(String, bool)>> {
+    let dir = Path::new(root).join("etc/apk/protected_paths.d");
+    let mut lists = vec![];
+    match std::fs::read_dir(&dir) {
+        Ok(entries) => {
+            for de in entries {
+                let path = de
+                    .with_context(|| format!("failed to read directory {}", dir.display()))?
+                    .path();
+                if path.extension() == Some(OsStr::new("list")) {
+                    lists.push(path);
+                }
+            }
+        }
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => (),
+        Err(err) => {
+            return Err(err).with_context(|| format!("failed to read directory {}", dir.display()))
+        }
+    }
+    lists.sort();
+    let mut contents = PROTECTED_PATHS.to_string();
+    for list in &lists {
+        contents.push_str(&read(list)?);
+        contents.push('\n');
+    }
+    Ok(contents
+        .lines()
+        .filter_map(|line| {
+            let mode = line.chars().next()?;
+            let path = line[mode.len_utf8()..].trim().trim_matches('/');
+            match mode {
+                '+' | '!' => Some((path.to_string(), true)),
+                '-' | '@' => Some((path.to_string(), false)),
+                _ => None,
+            }
+        })
+        .collect())
+}
+
+// Whether a file is protected, going by the most specific protected path it
+// is under, and by the last one listed of equally specific paths.
+fn is_protected(protected: &[(String, bool)], path: &str) -> bool {
+    let mut best: Option<(usize, bool)> = None;
+    for (dir, on) in protected {
+        let under =
+            path == dir || (path.starts_with(dir.as_str()) && path[dir.len()..].starts_with('/'));
+        if under && !matches!(best, Some((len, _)) if dir.len() < len) {
+            best = Some((dir.len(), *on));
+        }
+    }
+    matches!(best, Some((_, true)))
+}
+
+fn read(path: &Path) -> Result<String> {
+    std::fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))
+}
+
+// Reads the dirs and files of a package from its record, where each file
+// follows its dir and the owner, mode and checksum follow what they are for.
+fn entries(record: &[(&str, &str)]) -> Vec<(String, MtreeEntry)> {
+    let mut entries = vec![];
+    let mut dir = "";
+    for (key, value) in record {
+        match *key {
+            "F" => {
+                dir = value;
+                entries.push((
+                    value.to_string(),
+                    MtreeEntry {
+                        kind: "dir".to_string(),
+                        ..MtreeEntry::default()
+                    },
+                ));
+            }
+            "R" => {
+                let path = if dir.is_empty() {
+                    value.to_string()
+                } else {
+                    format!("{}/{}", dir, value)
+                };
+                entries.push((
+                    path,
+                    MtreeEntry {
+                        kind: "file".to_string(),
+                        ..MtreeEntry::default()
+                    },
+                ));
+            }
+            "M" | "a" => {
+                if let Some((_, entry)) = entries.last_mut() {
+                    acl(entry, value);
+                }
+            }
+            "Z" => {
+                if let Some((_, entry)) = entries.last_mut() {
+                    entry.sha1 = checksum(value);
+                }
+            }
+            _ => (),
+        }
+    }
+    entries
+}
+
+/// Apk reads the packages installed on Alpine from lib/apk/db/installed
+/// under the root. Files in the paths apk protects from being overwritten are
+/// the backup files, and packages missing from etc/apk/world were installed
+/// as dependencies.
+pub struct Apk {
+    root: String,
+    // The dirs and files of each installed package, kept from reading the
+    // database for verify_data.
+    entries: Mutex<HashMap<String, Vec<(String, MtreeEntry)>>>,
+}
+
+impl Apk {
+    pub fn new(root: &str) -> Self {
+        Self {
+            root: root.to_string(),
+            entries: Mutex::default(),
+        }
+    }
+}
+
+impl PackageSource for Apk {
+    fn packages(&self) -> Result<Vec<Package>> {
+        let installed = read(&Path::new(&self.root).join("lib/apk/db/installed"))?;
+        let mut all_entries = HashMap::new();
+        let path = Path::new(&self.root).join("etc/apk/world");
+        let world = match std::fs::read_to_string(&path) {
+            Ok(world) => world,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => String::new(),
+            Err(err) => {
+                return Err(err).with_context(|| format!("failed to read {}", path.display()))
+            }
+        };
+        let explicit: HashSet<&str> = world.split_whitespace().map(dep).collect();
+        let protected = protected_paths(&self.root)?;
+        let mut pkgs = vec![];
+        for record in records(&installed) {
+            let field = |key: &str| {
+                record
+                    .iter()
+                    .find(|(k, _)| *k == key)
+                    .map(|(_, v)| *v)
+                    .unwrap_or_default()
+            };
+            let list = |key: &str| -> Vec<String> {
+                field(key)
+                    .split_whitespace()
+                    .filter(|d| !d.starts_with('!'))
+                    .map(|d| dep(d).to_string())
+                    .collect()
+            };
+            let name = field("P").to_string();
+            let mut files = vec![];
+            let mut backup = vec![];
+            let entries = entries(&record);
+            for (path, entry) in &entries {
+                if entry.kind == "dir" {
+                    files.push(format!("{}/", path));
+                    continue;
+                }
+                if is_protected(&protected, path) {
+                    let hash = match &entry.sha1 {
+                        Some(sha1) => BackupHash::Recorded(sha1.clone()),
+                        None => BackupHash::Unknown,
+                    };
+                    backup.push((path.clone(), hash));
+                }
+                files.push(path.clone());
+            }
+            all_entries.insert(name.clone(), entries);
+            pkgs.push(Package {
+                reason: if explicit.contains(name.as_str()) {
+                    Reason::Explicit
+                } else {
+                    Reason::Depend
+                },
+                version: field("V").to_string(),
+                depends: list("D"),
+                provides: list("p"),
+                files,
+                backup,
+                name,
+                ..Package::default()
+            });
+        }
+        pkgs.sort_by(|a, b| a.name.cmp(&b.name));
+        *self.entries.lock().unwrap() = all_entries;
+        Ok(pkgs)
+    }
+
+    // The repos are read from the indexes apk keeps in its cache, which are
+    // gzipped tar archives holding an APKINDEX file in the same format as the
+    // installed database.
+    fn available(&self) -> Result<HashSet<String>> {
+        let cache = Path::new(&self.root).join("var/cache/apk");
+        let mut names = HashSet::new();
+        for de in std::fs::read_dir(&cache)
+            .with_context(|| format!("failed to read directory {}", cache.display()))?
+        {
+            let path = de?.path();
+            let file = path.file_name().unwrap_or_default().to_string_lossy();
+            if !(file.starts_with("APKINDEX.") && file.ends_with(".tar.gz")) {
+                continue;
+            }
+            let index = apkindex(&path)?;
+            names.extend(
+                records(&index)
+                    .iter()
+                    .flatten()
+                    .filter(|(k, _)| *k == "P")
+                    .map(|(_, v)| v.to_string()),
+            );
+        }
+        Ok(names)
+    }
+
+    fn verify_data(&self, pkg: &Package) -> Result<Vec<(String, MtreeEntry)>> {
+        Ok(self
+            .entries
+            .lock()
+            .unwrap()
+            .get(&pkg.name)
+            .cloned()
+            .unwrap_or_default())
+    }
+}
+
+// Reads the APKINDEX file from an index. Signed indexes have the signature
+// in a gzip stream of its own before the index, and the tar archive in the
+// first stream has no end marker, so the streams are read as one archive.
+fn apkindex(path: &Path) -> Result<String> {
+    let mut archive = tar::Archive::new(open_archive(path)?);
+    let entries = archive
+        .entries()
+        .with_context(|| format!("failed to read {}", path.display()))?;
+    for entry in entries {
+        let mut entry = entry.with_context(|| format!("failed to read {}", path.display()))?;
+        if entry.path_bytes().as_ref() == b"APKINDEX" {
+            let mut contents = String::new();
+            entry
+                .read_to_string(&mut contents)
+                .with_context(|| format!("failed to read {}", path.display()))?;
+            return Ok(contents);
+        }
+    }
+    Ok(String::new())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{apkindex, checksum, dep, is_protected, protected_paths, Apk};
+    use crate::source::{BackupHash, PackageSource, Reason};
+    use crate::TempDir;
+    use std::path::Path;
+
+    fn write(root: &Path, path: &str, contents: &str) {
+        let path = root.join(path);
+        std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+        std::fs::write(path, contents).unwrap();
+    }
+
+    #[test]
+    fn checksums() {
+        assert_eq!(
+            checksum("Q12jmj7l5rSw0yVb/vlWAYkK/YBwk=").as_deref(),
+            Some("da39a3ee5e6b4b0d3255bfef95601890afd80709")
+        );
+        assert_eq!(checksum("2jmj7l5rSw0yVb/vlWAYkK/YBwk="), None);
+        assert_eq!(checksum("Q1!!"), None);
+    }
+
+    #[test]
+    fn protected() {
+        let tmp = TempDir::new().unwrap();
+        write(
+            &tmp.0,
+            "etc/apk/protected_paths.d/local.list",
+            "+usr/share/foo\n-etc/foo/cache\n",
+        );
+        let paths = protected_paths(&tmp.0.to_string_lossy()).unwrap();
+        assert!(is_protected(&paths, "etc/foo.conf"));
+        assert!(is_protected(&paths, "usr/share/foo/foo.conf"));
+        assert!(!is_protected(&paths, "etc/init.d/foo"));
+        assert!(is_protected(&paths, "etc/apk/world"));
+        assert!(!is_protected(&paths, "etc/foo/cache/x"));
+        assert!(!is_protected(&paths, "etcetera/foo"));
+        assert!(!is_protected(&paths, "usr/share/foobar"));
+    }
+
+    #[test]
+    fn signed_index() {
+        // the signature archive has no end marker, and each archive is a
+        // gzip stream of its own
+        let tar = |name: &str, data: &[u8], end: bool| {
+            let mut builder = tar::Builder::new(vec![]);
+            let mut header = tar::Header::new_gnu();
+            header.set_size(data.len() as u64);
+            header.set_mode(0o644);
+            builder.append_data(&mut header, name, data).unwrap();
+            let mut bytes = builder.into_inner().unwrap();
+            if !end {
+                bytes.truncate(bytes.len() - 1024);
+            }
+            let mut gz = flate2::write::GzEncoder::new(vec![], flate2::Compression::default());
+            std::io::Write::write_all(&mut gz, &bytes).unwrap();
+            gz.finish().unwrap()
+        };
+        let mut index = tar(".SIGN.RSA.key.rsa.pub", b"signature", false);
+        index.extend(tar("APKINDEX", b"P:foo\nV:1.0-r0\n", true));
+        let tmp = TempDir::new().unwrap();
+        let path = tmp.0.join("APKINDEX.tar.gz");
+        std::fs::write(&path, index).unwrap();
+        assert_eq!(apkindex(&path).unwrap(), "P:foo\nV:1.0-r0\n");
+    }
+
+    #[test]
+    fn deps() {
+        assert_eq!(dep("so:libc.musl-x86_64.so.1"), "so:libc.musl-x86_64.so.1");
+        assert_eq!(dep("busybox>=1.36"), "busybox");
+        assert_eq!(dep("foo@edge"), "foo");
+        assert_eq!(dep("bar~2"), "bar");
+    }
+
+    #[test]
+    fn packages() {
+        let tmp = TempDir::new().unwrap();
+        write(
+            &tmp.0,
+            "lib/apk/db/installed",
+            "\
+P:foo
+V:1.0-r0
+D:so:libc.musl-x86_64.so.1 bar>=2 !conflict
+p:cmd:foo=1.0-r0
+F:etc
+R:foo.conf
+a:0:0:640
+Z:Q12jmj7l5rSw0yVb/vlWAYkK/YBwk=
+F:usr/bin
+M:0:0:755
+R:foo
+Z:Q12jmj7l5rSw0yVb/vlWAYkK/YBwk=
+
+P:bar
+V:2.1-r1
+F:usr/lib
+R:libbar.so.2
+",
+        );
+        write(&tmp.0, "etc/apk/world", "foo>=1\n");
+
+        let apk = Apk::new(&tmp.0.to_string_lossy());
+        let pkgs = apk.packages().unwrap();
+        assert_eq!(pkgs.len(), 2);
+        let (bar, foo) = (&pkgs[0], &pkgs[1]);
+
+        assert_eq!(foo.name, "foo");
+        assert_eq!(foo.version, "1.0-r0");
+        assert_eq!(foo.reason, Reason::Explicit);
+        assert_eq!(foo.depends, vec!["so:libc.musl-x86_64.so.1", "bar"]);
+        assert_eq!(foo.provides, vec!["cmd:foo"]);
+        assert_eq!(
+            foo.files,
+            vec!["etc/", "etc/foo.conf", "usr/bin/", "usr/bin/foo"]
+        );
+        assert_eq!(
+            foo.backup,
+            vec![(
+                "etc/foo.conf".to_string(),
+                BackupHash::Recorded("da39a3ee5e6b4b0d3255bfef95601890afd80709".to_string())
+            )]
+        );
+        assert_eq!(bar.reason, Reason::Depend);
+        assert!(bar.backup.is_empty());
+
+        // dirs are keyed without a trailing slash, like mtree paths
+        let entries = apk.verify_data(foo).unwrap();
+        let paths: Vec<&str> = entries.iter().map(|(p, _)| p.as_str()).collect();
+        assert_eq!(paths, vec!["etc", "etc/foo.conf", "usr/bin", "usr/bin/foo"]);
+        assert_eq!(entries[0].1.kind, "dir");
+        assert_eq!(entries[1].1.mode, Some(0o640));
+        assert_eq!(entries[2].1.mode, Some(0o755));
+        assert_eq!(
+            entries[3].1.sha1.as_deref(),
+            Some("da39a3ee5e6b4b0d3255bfef95601890afd80709")
+        );
+    }
+}
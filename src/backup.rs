@@ -0,0 +1,156 @@
+use crate::manifest::FileMeta;
+use anyhow::{anyhow, Context, Result};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+// The file in a backup listing the paths that did not exist before, which
+// undo removes.
+const CREATED_FILE: &str = "created";
+
+// The dir in a backup holding the previous versions of files.
+const FILES_DIR: &str = "files";
+
+/// Backup saves the files an apply changes into a timestamped dir, so the
+/// apply can be undone. The dir is only created once something is saved.
+pub struct Backup {
+    root: String,
+    dir: PathBuf,
+}
+
+impl Backup {
+    /// Prepares a backup of files, relative to root, in a new dir under base.
+    pub fn new(base: &str, root: &str) -> Self {
+        let secs = SystemTime::now()
+            .duration_since(SystemTime::UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or_default();
+        let mut dir = Path::new(base).join(secs.to_string());
+        let mut i = 1;
+        while dir.exists() {
+            dir = Path::new(base).join(format!("{}.{}", secs, i));
+            i += 1;
+        }
+        Self {
+            root: root.to_string(),
+            dir,
+        }
+    }
+
+    /// Saves the current version of a file, relative to the root, before it
+    /// is changed, or records that it does not exist yet.
+    pub fn save(&self, path: &str) -> Result<()> {
+        let src = format!("{}{}", self.root, path);
+        let md = match std::fs::symlink_metadata(&src) {
+            Ok(md) => md,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => {
+                std::fs::create_dir_all(&self.dir).with_context(|| {
+                    format!("failed to create directory {}", self.dir.display())
+                })?;
+                let created = self.dir.join(CREATED_FILE);
+                return std::fs::OpenOptions::new()
+                    .append(true)
+                    .create(true)
+                    .open(&created)
+                    .and_then(|mut f| writeln!(f, "{}", path))
+                    .with_context(|| format!("failed to write {}", created.display()));
+            }
+            Err(err) => return Err(err).with_context(|| format!("failed to stat {}", src)),
+        };
+        let dst = self.dir.join(FILES_DIR).join(path);
+        if let Some(dir) = dst.parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        copy(&src, &dst, &md)
+    }
+}
+
+// Copies a file or symlink along with its mode and owner.
+fn copy(src: &str, dst: &Path, md: &std::fs::Metadata) -> Result<()> {
+    if md.file_type().is_symlink() {
+        let target =
+            std::fs::read_link(src).with_context(|| format!("failed to read link {}", src))?;
+        return std::os::unix::fs::symlink(&target, dst)
+            .with_context(|| format!("failed to create symlink {}", dst.display()));
+    }
+    std::fs::copy(src, dst)
+        .with_context(|| format!("failed to copy {} to {}", src, dst.display()))?;
+    FileMeta::new(md).apply(dst)
+}
+
+/// Finds the most recent backup under base.
+pub fn latest(base: &str) -> Result<Option<PathBuf>> {
+    let entries = match std::fs::read_dir(base) {
+        Ok(entries) => entries,
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+        Err(err) => return Err(err).with_context(|| format!("failed to read {}", base)),
+    };
+    // names are seconds with an optional .N suffix, so compare them as such
+    let key = |p: &PathBuf| -> (u64, u64) {
+        let name = p.file_name().unwrap_or_default().to_string_lossy();
+        let mut parts = name.splitn(2, '.');
+        let secs = parts.next().and_then(|s| s.parse().ok()).unwrap_or(0);
+        let n = parts.next().and_then(|s| s.parse().ok()).unwrap_or(0);
+        (secs, n)
+    };
+    Ok(entries
+        .filter_map(|de| de.ok())
+        .map(|de| de.path())
+        .filter(|p| p.is_dir())
+        .max_by_key(key))
+}
+
+/// Puts back the files saved in a backup under root, removes the files that
+/// did not exist before, and then deletes the backup. Returns the paths that
+/// were restored or removed.
+pub fn undo(root: &str, backup: &Path) -> Result<Vec<String>> {
+    let mut paths = vec![];
+    let files = backup.join(FILES_DIR);
+    for de in walkdir::WalkDir::new(&files).min_depth(1) {
+        let de = de?;
+        if de.file_type().is_dir() {
+            continue;
+        }
+        let rel = de
+            .path()
+            .strip_prefix(&files)
+            .map_err(|_| anyhow!("{} is not in {}", de.path().display(), files.display()))?
+            .to_string_lossy()
+            .into_owned();
+        let dst = format!("{}{}", root, rel);
+        if let Some(dir) = Path::new(&dst).parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        // a symlink would be followed by the copy, so it is replaced instead
+        if std::fs::symlink_metadata(&dst).is_ok() {
+            std::fs::remove_file(&dst).with_context(|| format!("failed to remove {}", dst))?;
+        }
+        let src = de.path().to_string_lossy();
+        copy(&src, Path::new(&dst), &de.path().symlink_metadata()?)?;
+        paths.push(dst);
+    }
+    let created = backup.join(CREATED_FILE);
+    match std::fs::read_to_string(&created) {
+        Ok(contents) => {
+            for rel in contents.lines() {
+                let dst = format!("{}{}", root, rel);
+                match std::fs::remove_file(&dst) {
+                    Ok(()) => paths.push(dst),
+                    Err(err) if err.kind() == std::io::ErrorKind::NotFound => (),
+                    Err(err) => {
+                        return Err(err).with_context(|| format!("failed to remove {}", dst))
+                    }
+                }
+            }
+        }
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => (),
+        Err(err) => {
+            return Err(err).with_context(|| format!("failed to read {}", created.display()))
+        }
+    }
+    std::fs::remove_dir_all(backup)
+        .with_context(|| format!("failed to remove {}", backup.display()))?;
+    Ok(paths)
+}
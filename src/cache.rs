@@ -0,0 +1,286 @@
+use crate::hash::HashAlgo;
+use crate::progress::Progress;
+use crate::source::BackupHash;
+use anyhow::{Context, Result};
+use log::error;
+use std::collections::HashMap;
+use std::io::{BufRead, BufReader, BufWriter, Write};
+use std::os::unix::fs::MetadataExt;
+use std::sync::{Arc, Mutex};
+
+#[derive(PartialEq)]
+pub(crate) struct Stamp {
+    ino: u64,
+    size: u64,
+    mtime: i64,
+    mtime_nsec: i64,
+}
+
+impl Stamp {
+    pub(crate) fn new(md: &std::fs::Metadata) -> Self {
+        Self {
+            ino: md.ino(),
+            size: md.size(),
+            mtime: md.mtime(),
+            mtime_nsec: md.mtime_nsec(),
+        }
+    }
+}
+
+/// HashCache remembers file hashes across runs, keyed by algorithm and path
+/// and invalidated when the inode, size or mtime change.
+pub struct HashCache {
+    path: Option<String>,
+    old: HashMap<(HashAlgo, String), (Stamp, String)>,
+    new: Mutex<HashMap<(HashAlgo, String), (Stamp, String)>>,
+    progress: Option<Arc<Progress>>,
+    max_size: Option<u64>,
+}
+
+impl HashCache {
+    pub fn disabled() -> Self {
+        Self {
+            path: None,
+            old: HashMap::new(),
+            new: Mutex::new(HashMap::new()),
+            progress: None,
+            max_size: None,
+        }
+    }
+
+    pub fn load(path: &str) -> Result<Self> {
+        let mut old = HashMap::new();
+        match std::fs::File::open(path) {
+            Ok(f) => {
+                for line in BufReader::new(f).lines() {
+                    let line = line.with_context(|| format!("failed to read {}", path))?;
+                    let parts: Vec<&str> = line.splitn(7, '\t').collect();
+                    if parts.len() != 7 {
+                        continue;
+                    }
+                    let algo = match parts[0].parse() {
+                        Ok(algo) => algo,
+                        Err(_) => continue,
+                    };
+                    let stamp = Stamp {
+                        ino: parts[1].parse().unwrap_or_default(),
+                        size: parts[2].parse().unwrap_or_default(),
+                        mtime: parts[3].parse().unwrap_or_default(),
+                        mtime_nsec: parts[4].parse().unwrap_or_default(),
+                    };
+                    old.insert((algo, parts[6].to_string()), (stamp, parts[5].to_string()));
+                }
+            }
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => (),
+            Err(err) => return Err(err).with_context(|| format!("failed to open {}", path)),
+        }
+        Ok(Self {
+            path: Some(path.to_string()),
+            old,
+            new: Mutex::new(HashMap::new()),
+            progress: None,
+            max_size: None,
+        })
+    }
+
+    /// Counts the bytes hashed on cache misses in progress.
+    pub fn with_progress(mut self, progress: Arc<Progress>) -> Self {
+        self.progress = Some(progress);
+        self
+    }
+
+    /// Sets the size above which files are too large to hash.
+    pub fn with_max_size(mut self, max_size: Option<u64>) -> Self {
+        self.max_size = max_size;
+        self
+    }
+
+    /// Checks if a file of this size is too large to hash, in which case
+    /// callers fall back to comparing sizes.
+    pub fn too_large(&self, size: u64) -> bool {
+        matches!(self.max_size, Some(max) if size > max)
+    }
+
+    pub fn hash(&self, algo: HashAlgo, path: &str) -> Option<String> {
+        match self.try_hash(algo, path) {
+            Ok(hash) => Some(hash),
+            Err(err) => {
+                error!("{:#}", err);
+                None
+            }
+        }
+    }
+
+    /// Hashes a file like hash, returning errors instead of logging them.
+    pub fn try_hash(&self, algo: HashAlgo, path: &str) -> Result<String> {
+        let md = std::fs::metadata(path).with_context(|| format!("failed to stat {}", path))?;
+        let stamp = Stamp::new(&md);
+        let key = (algo, path.to_string());
+        let hash = match self.old.get(&key) {
+            Some((s, h)) if *s == stamp => h.clone(),
+            _ => {
+                let hash = algo.hash_file(path)?;
+                if let Some(progress) = &self.progress {
+                    progress.hashed(stamp.size);
+                }
+                hash
+            }
+        };
+        if self.path.is_some() && !path.contains('\n') {
+            self.new.lock().unwrap().insert(key, (stamp, hash.clone()));
+        }
+        Ok(hash)
+    }
+
+    /// Whether a backup file differs from what its package manager knows of
+    /// it, hashing the file in the algorithm of a recorded hash, or None if
+    /// there is nothing to tell by. Files the package manager could not read
+    /// fail with a permission error, like reading them here would.
+    pub fn backup_modified(&self, expected: &BackupHash, path: &str) -> Result<Option<bool>> {
+        match expected {
+            BackupHash::Recorded(hash) => match HashAlgo::of_digest(hash) {
+                Some(algo) => Ok(Some(self.try_hash(algo, path)? != *hash)),
+                None => Ok(None),
+            },
+            BackupHash::Unmodified => Ok(Some(false)),
+            BackupHash::Modified => Ok(Some(true)),
+            BackupHash::Unreadable => {
+                Err(std::io::Error::from(std::io::ErrorKind::PermissionDenied))
+                    .with_context(|| format!("failed to read {}", path))
+            }
+            BackupHash::Unknown => Ok(None),
+        }
+    }
+
+    /// Writes the cache. With prune, only the entries used in this run are
+    /// written, so removed files fall out of the cache. Without it, the
+    /// entries this run did not get to are kept too, which is what runs that
+    /// stopped early need.
+    pub fn save(&self, prune: bool) -> Result<()> {
+        let path = match &self.path {
+            None => return Ok(()),
+            Some(p) => p,
+        };
+        if let Some(dir) = std::path::Path::new(path).parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        let tmp = format!("{}.tmp", path);
+        let f = std::fs::File::create(&tmp).with_context(|| format!("failed to create {}", tmp))?;
+        let mut w = BufWriter::new(f);
+        let new = self.new.lock().unwrap();
+        let kept = self
+            .old
+            .iter()
+            .filter(|(key, _)| !prune && !new.contains_key(*key));
+        for ((algo, p), (s, h)) in new.iter().chain(kept) {
+            writeln!(
+                w,
+                "{}\t{}\t{}\t{}\t{}\t{}\t{}",
+                algo.name(),
+                s.ino,
+                s.size,
+                s.mtime,
+                s.mtime_nsec,
+                h,
+                p
+            )?;
+        }
+        w.flush()
+            .with_context(|| format!("failed to write {}", tmp))?;
+        std::fs::rename(&tmp, path).with_context(|| format!("failed to rename {}", tmp))?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::HashCache;
+    use crate::hash::HashAlgo;
+    use crate::source::BackupHash;
+    use crate::TempDir;
+
+    const EMPTY_MD5: &str = "d41d8cd98f00b204e9800998ecf8427e";
+
+    #[test]
+    fn round_trip() {
+        let tmp = TempDir::new().unwrap();
+        let path = tmp.0.join("cache/hashes").to_string_lossy().to_string();
+        let a = tmp.0.join("a").to_string_lossy().to_string();
+        let b = tmp.0.join("b").to_string_lossy().to_string();
+        std::fs::write(&a, "").unwrap();
+        std::fs::write(&b, "abc").unwrap();
+
+        let cache = HashCache::load(&path).unwrap();
+        assert!(cache.old.is_empty());
+        assert_eq!(cache.try_hash(HashAlgo::Md5, &a).unwrap(), EMPTY_MD5);
+        cache.try_hash(HashAlgo::Sha256, &b).unwrap();
+        cache.save(true).unwrap();
+
+        let cache = HashCache::load(&path).unwrap();
+        assert_eq!(cache.old.len(), 2);
+        let (_, hash) = &cache.old[&(HashAlgo::Md5, a.clone())];
+        assert_eq!(hash, EMPTY_MD5);
+
+        // without prune the entries this run did not use are kept
+        cache.try_hash(HashAlgo::Md5, &a).unwrap();
+        cache.save(false).unwrap();
+        let cache = HashCache::load(&path).unwrap();
+        assert_eq!(cache.old.len(), 2);
+
+        // with prune only the entries this run used are
+        cache.try_hash(HashAlgo::Md5, &a).unwrap();
+        cache.save(true).unwrap();
+        let cache = HashCache::load(&path).unwrap();
+        assert_eq!(cache.old.len(), 1);
+        assert!(cache.old.contains_key(&(HashAlgo::Md5, a)));
+    }
+
+    #[test]
+    fn stale_entries() {
+        let tmp = TempDir::new().unwrap();
+        let path = tmp.0.join("hashes").to_string_lossy().to_string();
+        let a = tmp.0.join("a").to_string_lossy().to_string();
+        std::fs::write(&a, "").unwrap();
+        let cache = HashCache::load(&path).unwrap();
+        cache.try_hash(HashAlgo::Md5, &a).unwrap();
+        cache.save(true).unwrap();
+
+        // a changed size invalidates the cached hash
+        std::fs::write(&a, "abc").unwrap();
+        let cache = HashCache::load(&path).unwrap();
+        assert_eq!(
+            cache.try_hash(HashAlgo::Md5, &a).unwrap(),
+            "900150983cd24fb0d6963f7d28e17f72"
+        );
+    }
+
+    #[test]
+    fn backup_modified() {
+        let tmp = TempDir::new().unwrap();
+        let a = tmp.0.join("a").to_string_lossy().to_string();
+        std::fs::write(&a, "").unwrap();
+        let cache = HashCache::disabled();
+        let recorded = |hash: &str| BackupHash::Recorded(hash.to_string());
+        let modified = |hash: &BackupHash, path: &str| cache.backup_modified(hash, path).unwrap();
+        assert_eq!(modified(&recorded(EMPTY_MD5), &a), Some(false));
+        assert_eq!(
+            modified(&recorded("da39a3ee5e6b4b0d3255bfef95601890afd80709"), &a),
+            Some(false)
+        );
+        assert_eq!(
+            modified(&recorded("900150983cd24fb0d6963f7d28e17f72"), &a),
+            Some(true)
+        );
+        // what the package manager reported is taken without reading the file
+        let missing = "/nonexistent";
+        assert_eq!(modified(&recorded("unknown"), missing), None);
+        assert_eq!(modified(&BackupHash::Unmodified, missing), Some(false));
+        assert_eq!(modified(&BackupHash::Modified, missing), Some(true));
+        assert_eq!(modified(&BackupHash::Unknown, missing), None);
+        let err = cache
+            .backup_modified(&BackupHash::Unreadable, missing)
+            .unwrap_err();
+        assert!(crate::is_permission_denied(&err));
+    }
+}
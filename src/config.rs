@@ -0,0 +1,241 @@
+use crate::Options;
+use anyhow::{anyhow, Context, Result};
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+/// The archdiff dir under $XDG_CONFIG_HOME, or ~/.config without it.
+pub fn user_dir() -> Option<PathBuf> {
+    std::env::var_os("XDG_CONFIG_HOME")
+        .map(PathBuf::from)
+        .or_else(|| std::env::var_os("HOME").map(|home| Path::new(&home).join(".config")))
+        .map(|dir| dir.join("archdiff"))
+}
+
+/// Config holds settings read from a config file. Unset values fall back to
+/// earlier config files and then to the defaults.
+#[derive(Default, Deserialize)]
+#[serde(default, deny_unknown_fields, rename_all = "kebab-case")]
+pub struct Config {
+    pub root: Option<String>,
+    pub dbpath: Option<String>,
+    pub one_file_system: Option<bool>,
+    pub virtual_fs: Option<bool>,
+    pub max_depth: Option<usize>,
+    pub max_hash_size: Option<String>,
+    pub repo: Option<String>,
+    pub repo_git: Option<bool>,
+    pub hostname: Option<String>,
+    pub ignore: Option<String>,
+    pub user_ignore: Option<String>,
+    pub pacman_conf: Option<String>,
+    pub jobs: Option<usize>,
+    pub cache: Option<String>,
+    pub no_cache: Option<bool>,
+    pub lock: Option<String>,
+    pub pacman_lock: Option<String>,
+    pub hash: Option<String>,
+    pub age_identity: Option<String>,
+    pub age_recipients: Option<String>,
+    pub mtree: Option<bool>,
+    pub metadata: Option<bool>,
+    pub xattrs: Option<bool>,
+    pub progress: Option<bool>,
+    pub orphans: Option<bool>,
+    pub foreign: Option<bool>,
+    pub tolerant: Option<bool>,
+    pub pacman_skip: Option<String>,
+    pub backend: Option<String>,
+    pub group: Option<bool>,
+    pub group_by: Option<String>,
+    pub expand: Option<bool>,
+    pub long: Option<bool>,
+    pub format: Option<String>,
+    pub template: Option<String>,
+    pub color: Option<String>,
+    pub socket: Option<String>,
+    pub state: Option<String>,
+    /// Shell commands run when the diff changes in watch and daemon mode,
+    /// keyed by event.
+    pub hooks: Option<BTreeMap<String, String>>,
+}
+
+impl Config {
+    /// Loads a TOML config file. A missing file results in an empty config.
+    pub fn load<P: AsRef<Path>>(path: P) -> Result<Self> {
+        let path = path.as_ref();
+        let contents = match std::fs::read_to_string(path) {
+            Ok(contents) => contents,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(Self::default()),
+            Err(err) => {
+                return Err(err).with_context(|| format!("failed to read {}", path.display()))
+            }
+        };
+        toml::from_str(&contents).with_context(|| format!("failed to parse {}", path.display()))
+    }
+
+    /// The system and user config files, in the order they should be merged.
+    pub fn default_paths() -> Vec<PathBuf> {
+        let mut paths = vec![PathBuf::from("/etc/archdiff/config.toml")];
+        if let Some(dir) = user_dir() {
+            paths.push(dir.join("config.toml"));
+        }
+        paths
+    }
+
+    /// Merges other into self, with values set in other taking precedence.
+    pub fn merge(self, other: Config) -> Config {
+        Config {
+            root: other.root.or(self.root),
+            dbpath: other.dbpath.or(self.dbpath),
+            one_file_system: other.one_file_system.or(self.one_file_system),
+            virtual_fs: other.virtual_fs.or(self.virtual_fs),
+            max_depth: other.max_depth.or(self.max_depth),
+            max_hash_size: other.max_hash_size.or(self.max_hash_size),
+            repo: other.repo.or(self.repo),
+            repo_git: other.repo_git.or(self.repo_git),
+            hostname: other.hostname.or(self.hostname),
+            ignore: other.ignore.or(self.ignore),
+            user_ignore: other.user_ignore.or(self.user_ignore),
+            pacman_conf: other.pacman_conf.or(self.pacman_conf),
+            jobs: other.jobs.or(self.jobs),
+            cache: other.cache.or(self.cache),
+            no_cache: other.no_cache.or(self.no_cache),
+            lock: other.lock.or(self.lock),
+            pacman_lock: other.pacman_lock.or(self.pacman_lock),
+            hash: other.hash.or(self.hash),
+            age_identity: other.age_identity.or(self.age_identity),
+            age_recipients: other.age_recipients.or(self.age_recipients),
+            mtree: other.mtree.or(self.mtree),
+            metadata: other.metadata.or(self.metadata),
+            xattrs: other.xattrs.or(self.xattrs),
+            progress: other.progress.or(self.progress),
+            orphans: other.orphans.or(self.orphans),
+            foreign: other.foreign.or(self.foreign),
+            tolerant: other.tolerant.or(self.tolerant),
+            pacman_skip: other.pacman_skip.or(self.pacman_skip),
+            backend: other.backend.or(self.backend),
+            group: other.group.or(self.group),
+            group_by: other.group_by.or(self.group_by),
+            expand: other.expand.or(self.expand),
+            long: other.long.or(self.long),
+            format: other.format.or(self.format),
+            template: other.template.or(self.template),
+            color: other.color.or(self.color),
+            socket: other.socket.or(self.socket),
+            state: other.state.or(self.state),
+            hooks: match (self.hooks, other.hooks) {
+                (Some(mut hooks), Some(other)) => {
+                    hooks.extend(other);
+                    Some(hooks)
+                }
+                (hooks, other) => other.or(hooks),
+            },
+        }
+    }
+
+    /// Overrides the options with the values set in the config.
+    pub fn apply(&self, opts: &mut Options) -> Result<()> {
+        if let Some(root) = &self.root {
+            opts.root = root.clone();
+        }
+        if let Some(dbpath) = &self.dbpath {
+            opts.dbpath = dbpath.clone();
+        }
+        if let Some(one_file_system) = self.one_file_system {
+            opts.one_file_system = one_file_system;
+        }
+        if let Some(virtual_fs) = self.virtual_fs {
+            opts.virtual_fs = virtual_fs;
+        }
+        if let Some(max_depth) = self.max_depth {
+            opts.max_depth = Some(max_depth);
+        }
+        if let Some(size) = &self.max_hash_size {
+            opts.max_hash_size = Some(parse_size(size)?);
+        }
+        if let Some(repo) = &self.repo {
+            opts.repo = repo.split(':').map(str::to_string).collect();
+        }
+        if let Some(repo_git) = self.repo_git {
+            opts.repo_git = repo_git;
+        }
+        if let Some(hostname) = &self.hostname {
+            opts.hostname = Some(hostname.clone());
+        }
+        if let Some(ignore) = &self.ignore {
+            opts.ignore = ignore.clone();
+        }
+        if let Some(ignore) = &self.user_ignore {
+            opts.user_ignore = Some(ignore.clone()).filter(|i| !i.is_empty());
+        }
+        if let Some(cache) = &self.cache {
+            opts.cache = Some(cache.clone());
+        }
+        if self.no_cache == Some(true) {
+            opts.cache = None;
+        }
+        if let Some(lock) = &self.lock {
+            opts.lock = Some(lock.clone()).filter(|l| !l.is_empty());
+        }
+        if let Some(mode) = &self.pacman_lock {
+            opts.pacman_lock = mode.parse()?;
+        }
+        if let Some(identity) = &self.age_identity {
+            opts.age_identity = identity.clone();
+        }
+        if let Some(recipients) = &self.age_recipients {
+            opts.age_recipients = recipients.clone();
+        }
+        if let Some(hash) = &self.hash {
+            opts.hash = hash.parse()?;
+        }
+        if let Some(mtree) = self.mtree {
+            opts.mtree = mtree;
+        }
+        if let Some(metadata) = self.metadata {
+            opts.metadata = metadata;
+        }
+        if let Some(xattrs) = self.xattrs {
+            opts.xattrs = xattrs;
+        }
+        if let Some(progress) = self.progress {
+            opts.progress = progress;
+        }
+        if let Some(orphans) = self.orphans {
+            opts.orphans = orphans;
+        }
+        if let Some(foreign) = self.foreign {
+            opts.foreign = foreign;
+        }
+        if let Some(tolerant) = self.tolerant {
+            opts.tolerant = tolerant;
+        }
+        if let Some(mode) = &self.pacman_skip {
+            opts.skip_mode = mode.parse()?;
+        }
+        if let Some(backend) = &self.backend {
+            opts.backend = backend.parse()?;
+        }
+        Ok(())
+    }
+}
+
+// Parses a size in bytes with an optional K, M, G or T suffix for powers of
+// 1024.
+fn parse_size(s: &str) -> Result<u64> {
+    let (digits, shift) = match s.chars().last().map(|c| c.to_ascii_uppercase()) {
+        Some('K') => (&s[..s.len() - 1], 10),
+        Some('M') => (&s[..s.len() - 1], 20),
+        Some('G') => (&s[..s.len() - 1], 30),
+        Some('T') => (&s[..s.len() - 1], 40),
+        _ => (s, 0),
+    };
+    let n: u64 = digits
+        .trim()
+        .parse()
+        .map_err(|_| anyhow!("invalid size {}", s))?;
+    n.checked_shl(shift)
+        .filter(|v| v >> shift == n)
+        .ok_or_else(|| anyhow!("size {} is too large", s))
+}
@@ -0,0 +1,63 @@
+use crate::{Category, Entry};
+use anyhow::{anyhow, Context, Result};
+use std::io::{BufRead, BufReader, BufWriter, Write};
+use std::os::unix::net::{UnixListener, UnixStream};
+use std::path::Path;
+use std::sync::{Arc, RwLock};
+
+/// Serves the entries to every client connecting to the unix socket at path,
+/// from a background thread. The entries can be updated while serving.
+pub fn serve<P: AsRef<Path>>(path: P, entries: Arc<RwLock<Vec<Entry>>>) -> Result<()> {
+    let path = path.as_ref();
+    if std::fs::symlink_metadata(path).is_ok() {
+        std::fs::remove_file(path)
+            .with_context(|| format!("failed to remove {}", path.display()))?;
+    }
+    let listener = UnixListener::bind(path)
+        .with_context(|| format!("failed to listen on {}", path.display()))?;
+    std::thread::spawn(move || {
+        for stream in listener.incoming() {
+            let sent = stream
+                .map_err(anyhow::Error::from)
+                .and_then(|stream| send(stream, &entries));
+            crate::filter_map_error(sent.context("failed to answer query"));
+        }
+    });
+    Ok(())
+}
+
+// Entries are sent as the category code, a space and the path, terminated by
+// a NUL since paths may contain newlines.
+fn send(stream: UnixStream, entries: &RwLock<Vec<Entry>>) -> Result<()> {
+    let mut out = BufWriter::new(stream);
+    let entries = entries
+        .read()
+        .map_err(|_| anyhow!("entries lock poisoned"))?;
+    for e in entries.iter() {
+        write!(out, "{} {}\0", e.category.code(), e.path)?;
+    }
+    out.flush()?;
+    Ok(())
+}
+
+/// Fetches the current entries from the daemon listening at path.
+pub fn query<P: AsRef<Path>>(path: P) -> Result<Vec<Entry>> {
+    let path = path.as_ref();
+    let stream = UnixStream::connect(path)
+        .with_context(|| format!("failed to connect to {}", path.display()))?;
+    let mut entries = vec![];
+    for record in BufReader::new(stream).split(0) {
+        let record = String::from_utf8(record?)?;
+        let mut chars = record.chars();
+        let category = chars
+            .next()
+            .and_then(Category::from_code)
+            .ok_or_else(|| anyhow!("invalid entry {:?} from daemon", record))?;
+        let path = chars.as_str();
+        entries.push(Entry {
+            category,
+            path: path.strip_prefix(' ').unwrap_or(path).to_string(),
+        });
+    }
+    Ok(entries)
+}
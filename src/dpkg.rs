@@ -0,0 +1,490 @@
+use crate::mtree::MtreeEntry;
+use crate::source::{BackupHash, Package, PackageSource, Reason};
+use anyhow::{Context, Result};
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+/// Dpkg reads the packages installed on Debian and derived systems from
+/// /var/lib/dpkg under the root. Conffiles are the backup files, and apt's
+/// record of automatically installed packages gives the install reason.
+/// Packages installed for several architectures are named name:arch the way
+/// dpkg prints them, and paths under the /bin, /lib and /sbin symlinks of a
+/// merged /usr are read as the paths under /usr they lead to.
+pub struct Dpkg {
+    root: String,
+    // The name and architecture of each installed package, which their
+    // files in the info dir are named after.
+    arches: Mutex<HashMap<String, (String, String)>>,
+}
+
+// The top level dirs a merged /usr replaces with symlinks into /usr.
+const MERGED: &[&str] = &["bin", "sbin", "lib", "lib32", "lib64", "libx32"];
+
+// Splits a file in the deb822 format into its paragraphs, mapping each field
+// to its value, where continuation lines start with a space.
+fn paragraphs(contents: &str) -> Vec<HashMap<&str, Vec<&str>>> {
+    let mut paragraphs = vec![];
+    let mut fields: HashMap<&str, Vec<&str>> = HashMap::new();
+    let mut key = "";
+    for line in contents.lines() {
+        if line.trim().is_empty() {
+            if !fields.is_empty() {
+                paragraphs.push(std::mem::take(&mut fields));
+            }
+        } else if line.starts_with(' ') || line.starts_with('\t') {
+            fields.entry(key).or_default().push(line.trim());
+        } else if let Some((k, v)) = line.split_once(':') {
+            key = k;
+            let v = v.trim();
+            let values = fields.entry(key).or_default();
+            if !v.is_empty() {
+                values.push(v);
+            }
+        }
+    }
+    if !fields.is_empty() {
+        paragraphs.push(fields);
+    }
+    paragraphs
+}
+
+// Parses a relationship field like "libc6 (>= 2.34), foo | bar:any" into the
+// package names it mentions.
+fn relations(fields: &HashMap<&str, Vec<&str>>, key: &str) -> Vec<String> {
+    fields
+        .get(key)
+        .into_iter()
+        .flatten()
+        .flat_map(|v| v.split([',', '|']))
+        .filter_map(|dep| dep.split_whitespace().next())
+        .map(|dep| dep.split(':').next().unwrap_or(dep).to_string())
+        .collect()
+}
+
+// Rewrites a path under a top level dir that is a symlink into /usr to the
+// path under /usr, which is where the walk finds it.
+fn usr_path(merged: &HashMap<String, String>, path: &str) -> String {
+    match path.split_once('/') {
+        Some((top, rest)) => match merged.get(top) {
+            Some(target) => format!("{}/{}", target, rest),
+            None => path.to_string(),
+        },
+        None => path.to_string(),
+    }
+}
+
+fn read(path: &Path) -> Result<String> {
+    std::fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))
+}
+
+impl Dpkg {
+    pub fn new(root: &str) -> Self {
+        Self {
+            root: root.to_string(),
+            arches: Mutex::default(),
+        }
+    }
+
+    fn dir(&self) -> PathBuf {
+        Path::new(&self.root).join("var/lib/dpkg")
+    }
+
+    // Finds a file in the info dir of a package, which is named after the
+    // architecture too for packages that can be installed for several.
+    fn info(&self, name: &str, arch: &str, ext: &str) -> PathBuf {
+        let info = self.dir().join("info");
+        let plain = info.join(format!("{}.{}", name, ext));
+        if plain.exists() {
+            plain
+        } else {
+            info.join(format!("{}:{}.{}", name, arch, ext))
+        }
+    }
+
+    // Maps the top level dirs that are symlinks into /usr, like bin to
+    // usr/bin on a merged /usr, to the dir they lead to.
+    fn merged_usr(&self) -> HashMap<String, String> {
+        MERGED
+            .iter()
+            .filter_map(|dir| {
+                let target = std::fs::read_link(Path::new(&self.root).join(dir)).ok()?;
+                let target = target
+                    .to_str()?
+                    .trim_start_matches('/')
+                    .trim_end_matches('/');
+                if target.starts_with("usr/") && !target.contains("..") {
+                    Some((dir.to_string(), target.to_string()))
+                } else {
+                    None
+                }
+            })
+            .collect()
+    }
+
+    // The packages apt installed as dependencies.
+    fn auto_installed(&self) -> Result<HashSet<String>> {
+        let path = Path::new(&self.root).join("var/lib/apt/extended_states");
+        let contents = match std::fs::read_to_string(&path) {
+            Ok(contents) => contents,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(HashSet::new()),
+            Err(err) => {
+                return Err(err).with_context(|| format!("failed to read {}", path.display()))
+            }
+        };
+        Ok(paragraphs(&contents)
+            .iter()
+            .filter(|p| matches!(p.get("Auto-Installed"), Some(v) if v.first() == Some(&"1")))
+            .filter_map(|p| p.get("Package")?.first().map(|n| n.to_string()))
+            .collect())
+    }
+}
+
+impl PackageSource for Dpkg {
+    fn packages(&self) -> Result<Vec<Package>> {
+        let status = read(&self.dir().join("status"))?;
+        let auto = self.auto_installed()?;
+        let merged = self.merged_usr();
+        let paragraphs: Vec<_> = paragraphs(&status)
+            .into_iter()
+            // removed packages can stay in the status file with their conffiles
+            .filter(|p| {
+                let status = p.get("Status").and_then(|v| v.first()).copied();
+                status.unwrap_or_default().ends_with(" installed")
+            })
+            .collect();
+        let mut counts: HashMap<&str, usize> = HashMap::new();
+        for fields in &paragraphs {
+            if let Some(name) = fields.get("Package").and_then(|v| v.first()) {
+                *counts.entry(name).or_default() += 1;
+            }
+        }
+        let mut arches = HashMap::new();
+        let mut pkgs = vec![];
+        for fields in &paragraphs {
+            let first = |key: &str| {
+                fields
+                    .get(key)
+                    .and_then(|v| v.first())
+                    .copied()
+                    .unwrap_or_default()
+            };
+            let name = first("Package");
+            let arch = first("Architecture");
+            let list = self.info(name, arch, "list");
+            // dpkg lists dirs like files, so every parent of a path is a dir,
+            // and so is any path that is a dir on disk, like an empty one
+            let mut paths: Vec<String> = read(&list)?
+                .lines()
+                .filter(|l| *l != "/.")
+                .map(|l| usr_path(&merged, l.trim_start_matches('/')))
+                .collect();
+            let mut seen = HashSet::new();
+            paths.retain(|p| seen.insert(p.clone()));
+            let mut dirs = HashSet::new();
+            for path in &paths {
+                if let Some((dir, _)) = path.rsplit_once('/') {
+                    dirs.insert(dir.to_string());
+                }
+            }
+            let root = Path::new(&self.root);
+            let files = paths
+                .into_iter()
+                .map(|p| {
+                    let is_dir = dirs.contains(&p)
+                        || std::fs::symlink_metadata(root.join(&p))
+                            .map(|md| md.is_dir())
+                            .unwrap_or(false);
+                    if is_dir {
+                        format!("{}/", p)
+                    } else {
+                        p
+                    }
+                })
+                .collect();
+            // conffiles the package no longer ships are marked obsolete and
+            // left to be reported like other leftovers, and those not yet
+            // configured have no hash yet
+            let backup = fields
+                .get("Conffiles")
+                .into_iter()
+                .flatten()
+                .filter_map(|line| {
+                    let mut parts = line.split_whitespace();
+                    let path = usr_path(&merged, parts.next()?.trim_start_matches('/'));
+                    let hash = match parts.next()? {
+                        "newconffile" => BackupHash::Unknown,
+                        hash => BackupHash::Recorded(hash.to_string()),
+                    };
+                    if parts.any(|flag| flag == "obsolete") {
+                        return None;
+                    }
+                    Some((path, hash))
+                })
+                .collect();
+            let mut optdepends = relations(fields, "Recommends");
+            optdepends.extend(relations(fields, "Suggests"));
+            let mut provides = relations(fields, "Provides");
+            let full_name = if counts[name] > 1 {
+                // dependencies name the package without the architecture
+                provides.push(name.to_string());
+                format!("{}:{}", name, arch)
+            } else {
+                name.to_string()
+            };
+            arches.insert(full_name.clone(), (name.to_string(), arch.to_string()));
+            pkgs.push(Package {
+                reason: if auto.contains(name) {
+                    Reason::Depend
+                } else {
+                    Reason::Explicit
+                },
+                name: full_name,
+                version: first("Version").to_string(),
+                groups: vec![],
+                depends: relations(fields, "Depends")
+                    .into_iter()
+                    .chain(relations(fields, "Pre-Depends"))
+                    .collect(),
+                optdepends,
+                provides,
+                files,
+                backup,
+            });
+        }
+        *self.arches.lock().unwrap() = arches;
+        pkgs.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(pkgs)
+    }
+
+    fn available(&self) -> Result<HashSet<String>> {
+        let lists = Path::new(&self.root).join("var/lib/apt/lists");
+        let mut names = HashSet::new();
+        for de in std::fs::read_dir(&lists)
+            .with_context(|| format!("failed to read directory {}", lists.display()))?
+        {
+            let path = de?.path();
+            // compressed lists are left out
+            if !path.to_string_lossy().ends_with("_Packages") {
+                continue;
+            }
+            names.extend(
+                read(&path)?
+                    .lines()
+                    .filter_map(|l| l.strip_prefix("Package:"))
+                    .map(|n| n.trim().to_string()),
+            );
+        }
+        Ok(names)
+    }
+
+    // dpkg only records md5 hashes of the files that are not conffiles.
+    fn verify_data(&self, pkg: &Package) -> Result<Vec<(String, MtreeEntry)>> {
+        let (name, arch) = self
+            .arches
+            .lock()
+            .unwrap()
+            .get(&pkg.name)
+            .cloned()
+            .unwrap_or_else(|| (pkg.name.clone(), String::new()));
+        let path = self.info(&name, &arch, "md5sums");
+        let merged = self.merged_usr();
+        let contents = match std::fs::read_to_string(&path) {
+            Ok(contents) => contents,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(vec![]),
+            Err(err) => {
+                return Err(err).with_context(|| format!("failed to read {}", path.display()))
+            }
+        };
+        Ok(contents
+            .lines()
+            .filter_map(|line| {
+                let (md5, path) = line.split_once("  ")?;
+                let entry = MtreeEntry {
+                    kind: "file".to_string(),
+                    md5: Some(md5.to_string()),
+                    ..MtreeEntry::default()
+                };
+                Some((usr_path(&merged, path), entry))
+            })
+            .collect())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::Dpkg;
+    use crate::source::{BackupHash, PackageSource, Reason};
+    use crate::TempDir;
+    use std::path::Path;
+
+    fn write(root: &Path, path: &str, contents: &str) {
+        let path = root.join(path);
+        std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+        std::fs::write(path, contents).unwrap();
+    }
+
+    #[test]
+    fn packages() {
+        let tmp = TempDir::new().unwrap();
+        write(
+            &tmp.0,
+            "var/lib/dpkg/status",
+            "\
+Package: foo
+Status: install ok installed
+Architecture: amd64
+Version: 1.0-1
+Depends: libc6 (>= 2.34), bar | baz:any
+Pre-Depends: dpkg
+Recommends: qux
+Conffiles:
+ /etc/foo.conf 0123456789abcdef0123456789abcdef
+ /etc/foo/extra.conf fedcba9876543210fedcba9876543210
+
+Package: gone
+Status: deinstall ok config-files
+Architecture: all
+Version: 0.1
+
+Package: bar
+Status: install ok installed
+Architecture: all
+Version: 2.0
+Provides: baz
+",
+        );
+        write(
+            &tmp.0,
+            "var/lib/dpkg/info/foo:amd64.list",
+            "/.\n/etc\n/etc/foo.conf\n/etc/foo\n/etc/foo/extra.conf\n",
+        );
+        write(
+            &tmp.0,
+            "var/lib/dpkg/info/bar.list",
+            "/.\n/usr\n/usr/bin\n/usr/bin/bar\n",
+        );
+        write(
+            &tmp.0,
+            "var/lib/dpkg/info/bar.md5sums",
+            "d41d8cd98f00b204e9800998ecf8427e  usr/bin/bar\n",
+        );
+        write(
+            &tmp.0,
+            "var/lib/apt/extended_states",
+            "Package: bar\nArchitecture: amd64\nAuto-Installed: 1\n",
+        );
+
+        let dpkg = Dpkg::new(&tmp.0.to_string_lossy());
+        let pkgs = dpkg.packages().unwrap();
+        assert_eq!(pkgs.len(), 2);
+        let (bar, foo) = (&pkgs[0], &pkgs[1]);
+
+        assert_eq!(foo.name, "foo");
+        assert_eq!(foo.version, "1.0-1");
+        assert_eq!(foo.reason, Reason::Explicit);
+        assert_eq!(foo.depends, vec!["libc6", "bar", "baz", "dpkg"]);
+        assert_eq!(foo.optdepends, vec!["qux"]);
+        assert_eq!(
+            foo.files,
+            vec!["etc/", "etc/foo.conf", "etc/foo/", "etc/foo/extra.conf"]
+        );
+        assert_eq!(
+            foo.backup,
+            vec![
+                (
+                    "etc/foo.conf".to_string(),
+                    BackupHash::Recorded("0123456789abcdef0123456789abcdef".to_string())
+                ),
+                (
+                    "etc/foo/extra.conf".to_string(),
+                    BackupHash::Recorded("fedcba9876543210fedcba9876543210".to_string())
+                ),
+            ]
+        );
+
+        assert_eq!(bar.reason, Reason::Depend);
+        assert_eq!(bar.provides, vec!["baz"]);
+        assert_eq!(bar.files, vec!["usr/", "usr/bin/", "usr/bin/bar"]);
+        let entries = dpkg.verify_data(bar).unwrap();
+        assert_eq!(entries.len(), 1);
+        assert_eq!(entries[0].0, "usr/bin/bar");
+        assert_eq!(
+            entries[0].1.md5.as_deref(),
+            Some("d41d8cd98f00b204e9800998ecf8427e")
+        );
+        // packages without md5sums have nothing to verify
+        assert!(dpkg.verify_data(foo).unwrap().is_empty());
+    }
+
+    #[test]
+    fn merged_usr_and_multiarch() {
+        let tmp = TempDir::new().unwrap();
+        std::fs::create_dir_all(tmp.0.join("usr/bin")).unwrap();
+        std::fs::create_dir_all(tmp.0.join("usr/share/empty")).unwrap();
+        std::os::unix::fs::symlink("usr/bin", tmp.0.join("bin")).unwrap();
+        write(
+            &tmp.0,
+            "var/lib/dpkg/status",
+            "\
+Package: libc6
+Status: install ok installed
+Architecture: amd64
+Multi-Arch: same
+Version: 2.36-9
+
+Package: libc6
+Status: install ok installed
+Architecture: i386
+Multi-Arch: same
+Version: 2.36-9
+
+Package: coreutils
+Status: install ok installed
+Architecture: amd64
+Version: 9.1-1
+Depends: libc6 (>= 2.34)
+Conffiles:
+ /etc/old.conf 0123456789abcdef0123456789abcdef obsolete
+ /etc/new.conf newconffile
+",
+        );
+        write(&tmp.0, "var/lib/dpkg/info/libc6:amd64.list", "/.\n/lib64\n");
+        write(&tmp.0, "var/lib/dpkg/info/libc6:i386.list", "/.\n/lib\n");
+        write(
+            &tmp.0,
+            "var/lib/dpkg/info/coreutils.list",
+            "/.\n/bin\n/bin/ls\n/usr\n/usr/share\n/usr/share/empty\n",
+        );
+        write(
+            &tmp.0,
+            "var/lib/dpkg/info/coreutils.md5sums",
+            "d41d8cd98f00b204e9800998ecf8427e  bin/ls\n",
+        );
+
+        let dpkg = Dpkg::new(&tmp.0.to_string_lossy());
+        let pkgs = dpkg.packages().unwrap();
+        let names: Vec<&str> = pkgs.iter().map(|p| p.name.as_str()).collect();
+        assert_eq!(names, vec!["coreutils", "libc6:amd64", "libc6:i386"]);
+        assert_eq!(pkgs[1].provides, vec!["libc6"]);
+
+        let coreutils = &pkgs[0];
+        // bin/ls is where the walk finds it, and the empty dir is a dir
+        assert_eq!(
+            coreutils.files,
+            vec![
+                "bin",
+                "usr/bin/ls",
+                "usr/",
+                "usr/share/",
+                "usr/share/empty/"
+            ]
+        );
+        assert_eq!(
+            coreutils.backup,
+            vec![("etc/new.conf".to_string(), BackupHash::Unknown)]
+        );
+        let entries = dpkg.verify_data(coreutils).unwrap();
+        assert_eq!(entries[0].0, "usr/bin/ls");
+    }
+}
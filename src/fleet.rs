@@ -0,0 +1,273 @@
+use crate::http::{Request, Response};
+use crate::snapshot::Snapshot;
+use crate::Category;
+use anyhow::{anyhow, Context, Result};
+use serde::Serialize;
+use std::collections::{BTreeMap, HashMap};
+use std::path::{Path, PathBuf};
+
+/// HostSummary is the drift of one host, as of its last snapshot.
+#[derive(Clone, Debug, Serialize)]
+pub struct HostSummary {
+    pub host: String,
+    pub root: String,
+    /// Seconds since the epoch when the snapshot was taken.
+    pub time: u64,
+    pub total: usize,
+    pub categories: BTreeMap<Category, usize>,
+}
+
+/// PathSummary is a path that differs on some hosts of the fleet.
+#[derive(Clone, Debug, Serialize)]
+pub struct PathSummary {
+    pub path: String,
+    pub hosts: Vec<String>,
+}
+
+/// FleetSummary is the drift of every host combined.
+#[derive(Clone, Debug, Serialize)]
+pub struct FleetSummary {
+    pub hosts: usize,
+    pub total: usize,
+    pub categories: BTreeMap<Category, usize>,
+    /// The differing paths, those on the most hosts first.
+    pub paths: Vec<PathSummary>,
+}
+
+impl HostSummary {
+    fn new(host: &str, snapshot: &Snapshot) -> Self {
+        let mut categories = BTreeMap::new();
+        for e in &snapshot.entries {
+            *categories.entry(e.category).or_default() += 1;
+        }
+        Self {
+            host: host.to_string(),
+            root: snapshot.root.clone(),
+            time: snapshot.time,
+            total: snapshot.entries.len(),
+            categories,
+        }
+    }
+}
+
+/// Fleet stores the last snapshot pushed by each host in a dir, as
+/// HOST.json.
+pub struct Fleet {
+    dir: PathBuf,
+    tokens: Tokens,
+}
+
+/// Tokens are the secrets agents need to push snapshots. The file they are
+/// read from has one per line, either HOST TOKEN for a single host or a lone
+/// TOKEN shared by the hosts with none of their own. Empty lines and those
+/// starting with # are skipped.
+#[derive(Clone, Debug, Default)]
+pub struct Tokens {
+    shared: Vec<String>,
+    hosts: HashMap<String, String>,
+}
+
+impl Tokens {
+    pub fn load<P: AsRef<Path>>(path: P) -> Result<Self> {
+        let path = path.as_ref();
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("failed to read {}", path.display()))?;
+        let tokens = Self::parse(&contents);
+        if tokens.shared.is_empty() && tokens.hosts.is_empty() {
+            return Err(anyhow!("no tokens in {}", path.display()));
+        }
+        Ok(tokens)
+    }
+
+    pub fn parse(contents: &str) -> Self {
+        let mut tokens = Self::default();
+        for line in contents.lines().map(str::trim) {
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+            match line.split_once(char::is_whitespace) {
+                Some((host, token)) => {
+                    tokens
+                        .hosts
+                        .insert(host.to_string(), token.trim().to_string());
+                }
+                None => tokens.shared.push(line.to_string()),
+            }
+        }
+        tokens
+    }
+
+    /// Whether a host may push with a token. A host with a token of its own
+    /// cannot use the shared ones, so its token can be revoked alone.
+    pub fn allows(&self, host: &str, token: Option<&str>) -> bool {
+        let token = match token {
+            Some(token) => token,
+            None => return false,
+        };
+        match self.hosts.get(host) {
+            Some(expected) => same(expected, token),
+            None => self.shared.iter().any(|expected| same(expected, token)),
+        }
+    }
+}
+
+// Compares tokens in time independent of where they differ, so they cannot
+// be guessed a byte at a time.
+fn same(a: &str, b: &str) -> bool {
+    a.len() == b.len()
+        && a.bytes()
+            .zip(b.bytes())
+            .fold(0, |acc, (x, y)| acc | (x ^ y))
+            == 0
+}
+
+// Host names end up in file names, so only those that cannot escape the dir
+// are accepted.
+fn valid_host(host: &str) -> bool {
+    !host.is_empty()
+        && !host.starts_with('.')
+        && host
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '.' || c == '_')
+}
+
+impl Fleet {
+    pub fn new<P: AsRef<Path>>(dir: P, tokens: Tokens) -> Result<Self> {
+        let dir = dir.as_ref();
+        std::fs::create_dir_all(dir)
+            .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        Ok(Self {
+            dir: dir.to_path_buf(),
+            tokens,
+        })
+    }
+
+    fn path(&self, host: &str) -> Result<PathBuf> {
+        if !valid_host(host) {
+            return Err(anyhow!("invalid host name {:?}", host));
+        }
+        Ok(self.dir.join(format!("{}.json", host)))
+    }
+
+    /// Replaces the snapshot of a host, going through a temporary file so
+    /// readers never see half of it.
+    pub fn store(&self, host: &str, snapshot: &Snapshot) -> Result<()> {
+        let path = self.path(host)?;
+        let tmp = path.with_extension("json.tmp");
+        snapshot.save(&tmp)?;
+        std::fs::rename(&tmp, &path).with_context(|| format!("failed to rename {}", tmp.display()))
+    }
+
+    pub fn load(&self, host: &str) -> Result<Snapshot> {
+        Snapshot::load(self.path(host)?)
+    }
+
+    /// Loads the snapshot of every host, sorted by host.
+    pub fn snapshots(&self) -> Result<Vec<(String, Snapshot)>> {
+        let mut snapshots = vec![];
+        for de in std::fs::read_dir(&self.dir)
+            .with_context(|| format!("failed to read directory {}", self.dir.display()))?
+        {
+            let path = de?.path();
+            if path.extension().and_then(|e| e.to_str()) != Some("json") {
+                continue;
+            }
+            let host = path
+                .file_stem()
+                .unwrap_or_default()
+                .to_string_lossy()
+                .into_owned();
+            if let Some(snapshot) = crate::filter_map_error(Snapshot::load(&path)) {
+                snapshots.push((host, snapshot));
+            }
+        }
+        snapshots.sort_by(|a, b| a.0.cmp(&b.0));
+        Ok(snapshots)
+    }
+
+    pub fn hosts(&self) -> Result<Vec<HostSummary>> {
+        Ok(self
+            .snapshots()?
+            .iter()
+            .map(|(host, snapshot)| HostSummary::new(host, snapshot))
+            .collect())
+    }
+
+    pub fn summary(&self) -> Result<FleetSummary> {
+        let snapshots = self.snapshots()?;
+        let mut categories = BTreeMap::new();
+        let mut paths: HashMap<&str, Vec<String>> = HashMap::new();
+        let mut total = 0;
+        for (host, snapshot) in &snapshots {
+            total += snapshot.entries.len();
+            for e in &snapshot.entries {
+                *categories.entry(e.category).or_default() += 1;
+                paths.entry(&e.path).or_default().push(host.clone());
+            }
+        }
+        let mut paths: Vec<PathSummary> = paths
+            .into_iter()
+            .map(|(path, hosts)| PathSummary {
+                path: path.to_string(),
+                hosts,
+            })
+            .collect();
+        paths.sort_by(|a, b| b.hosts.len().cmp(&a.hosts.len()).then(a.path.cmp(&b.path)));
+        Ok(FleetSummary {
+            hosts: snapshots.len(),
+            total,
+            categories,
+            paths,
+        })
+    }
+
+    /// Answers the requests of agents and dashboards:
+    ///
+    /// - POST /hosts/HOST stores the snapshot of a host, given its token.
+    /// - GET /hosts lists the drift of each host.
+    /// - GET /hosts/HOST returns the snapshot of a host.
+    /// - GET /summary returns the drift of the whole fleet.
+    pub fn handle(&self, req: &Request) -> Response {
+        let result = match (req.method.as_str(), req.path.as_str()) {
+            ("GET", "/hosts") => self.hosts().map(|hosts| Response::json(&hosts)),
+            ("GET", "/summary") => self.summary().map(|summary| Response::json(&summary)),
+            ("GET", path) if path.starts_with("/hosts/") => {
+                let host = &path["/hosts/".len()..];
+                match self.load(host) {
+                    Ok(snapshot) => Ok(Response::json(&snapshot)),
+                    Err(_) => Ok(Response::error(404, &format!("no snapshot of {}", host))),
+                }
+            }
+            ("POST", path) if path.starts_with("/hosts/") => {
+                let host = &path["/hosts/".len()..];
+                if !self.tokens.allows(host, req.token.as_deref()) {
+                    return Response::error(401, &format!("no valid token for {}", host));
+                }
+                serde_json::from_slice::<Snapshot>(&req.body)
+                    .context("invalid snapshot")
+                    .and_then(|snapshot| self.store(host, &snapshot))
+                    .map(|_| Response::text(200, "stored\n".to_string()))
+                    .or_else(|err| Ok(Response::error(400, &format!("{:#}", err))))
+            }
+            (_, "/hosts") | (_, "/summary") => Ok(Response::error(405, "method not allowed")),
+            _ => Ok(Response::error(404, "not found")),
+        };
+        result.unwrap_or_else(|err| Response::error(500, &format!("{:#}", err)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::Tokens;
+
+    #[test]
+    fn tokens() {
+        let tokens = Tokens::parse("# fleet\nshared\n\nweb1 secret1\n");
+        assert!(tokens.allows("web2", Some("shared")));
+        assert!(tokens.allows("web1", Some("secret1")));
+        assert!(!tokens.allows("web1", Some("shared")));
+        assert!(!tokens.allows("web2", Some("secret1")));
+        assert!(!tokens.allows("web2", Some("share")));
+        assert!(!tokens.allows("web2", None));
+    }
+}
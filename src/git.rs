@@ -0,0 +1,55 @@
+use anyhow::{anyhow, Context, Result};
+use std::path::Path;
+use std::process::Command;
+
+// Runs git in dir, returning its standard output.
+fn git(dir: &str, args: &[&str]) -> Result<String> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(dir)
+        .args(args)
+        .output()
+        .context("failed to run git")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "git {} failed in {}: {}",
+            args.join(" "),
+            dir,
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+/// Checks if dir is inside a git work tree.
+pub fn is_work_tree(dir: &str) -> bool {
+    matches!(git(dir, &["rev-parse", "--is-inside-work-tree"]), Ok(out) if out.trim() == "true")
+}
+
+/// Checks if the git work tree containing dir has uncommitted changes.
+pub fn is_dirty(dir: &str) -> Result<bool> {
+    Ok(!git(dir, &["status", "--porcelain"])?.trim().is_empty())
+}
+
+/// Lists the files tracked by git under dir, relative to dir.
+pub fn ls_files(dir: &str) -> Result<Vec<String>> {
+    let out = git(dir, &["ls-files", "-z"])?;
+    Ok(out
+        .split('\0')
+        .filter(|f| !f.is_empty())
+        .map(str::to_string)
+        .collect())
+}
+
+/// Stages a file in the git work tree containing dir.
+pub fn add(dir: &str, path: &Path) -> Result<()> {
+    let path = path.to_string_lossy();
+    git(dir, &["add", "--", &path])?;
+    Ok(())
+}
+
+/// Commits the staged changes in the git work tree containing dir.
+pub fn commit(dir: &str, message: &str) -> Result<()> {
+    git(dir, &["commit", "--quiet", "--message", message])?;
+    Ok(())
+}
@@ -0,0 +1,147 @@
+use anyhow::{anyhow, Context, Result};
+use md5::Md5;
+use sha1::Sha1;
+use sha2::{Digest, Sha256};
+use std::io::Read;
+use std::path::Path;
+use xxhash_rust::xxh3::Xxh3;
+
+/// HashAlgo selects how file contents are hashed for comparison.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Hash)]
+pub enum HashAlgo {
+    Md5,
+    Sha1,
+    Sha256,
+    Blake3,
+    Xxhash,
+}
+
+impl std::str::FromStr for HashAlgo {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "md5" => Ok(HashAlgo::Md5),
+            "sha1" => Ok(HashAlgo::Sha1),
+            "sha256" => Ok(HashAlgo::Sha256),
+            "blake3" => Ok(HashAlgo::Blake3),
+            "xxhash" => Ok(HashAlgo::Xxhash),
+            _ => Err(anyhow!("unknown hash algorithm {}", s)),
+        }
+    }
+}
+
+impl HashAlgo {
+    pub fn name(self) -> &'static str {
+        match self {
+            HashAlgo::Md5 => "md5",
+            HashAlgo::Sha1 => "sha1",
+            HashAlgo::Sha256 => "sha256",
+            HashAlgo::Blake3 => "blake3",
+            HashAlgo::Xxhash => "xxhash",
+        }
+    }
+
+    /// The algorithm of a hex digest recorded by a package manager, told
+    /// apart by its length.
+    pub fn of_digest(digest: &str) -> Option<Self> {
+        match digest.len() {
+            32 => Some(HashAlgo::Md5),
+            40 => Some(HashAlgo::Sha1),
+            64 => Some(HashAlgo::Sha256),
+            _ => None,
+        }
+    }
+
+    pub fn hash_file<P: AsRef<Path>>(self, path: P) -> Result<String> {
+        let path = path.as_ref();
+        match self {
+            HashAlgo::Md5 => {
+                let mut hasher = Md5::new();
+                read_chunks(path, |b| hasher.update(b))?;
+                Ok(format!("{:x}", hasher.finalize()))
+            }
+            HashAlgo::Sha1 => {
+                let mut hasher = Sha1::new();
+                read_chunks(path, |b| hasher.update(b))?;
+                Ok(format!("{:x}", hasher.finalize()))
+            }
+            HashAlgo::Sha256 => {
+                let mut hasher = Sha256::new();
+                read_chunks(path, |b| hasher.update(b))?;
+                Ok(format!("{:x}", hasher.finalize()))
+            }
+            HashAlgo::Blake3 => {
+                let mut hasher = blake3::Hasher::new();
+                read_chunks(path, |b| {
+                    hasher.update(b);
+                })?;
+                Ok(hasher.finalize().to_hex().to_string())
+            }
+            HashAlgo::Xxhash => {
+                let mut hasher = Xxh3::new();
+                read_chunks(path, |b| hasher.update(b))?;
+                Ok(format!("{:032x}", hasher.digest128()))
+            }
+        }
+    }
+}
+
+fn read_chunks<F: FnMut(&[u8])>(path: &Path, mut f: F) -> Result<()> {
+    let mut file =
+        std::fs::File::open(path).with_context(|| format!("failed to open {}", path.display()))?;
+    let mut buf = vec![0; 64 * 1024];
+    loop {
+        let n = file
+            .read(&mut buf)
+            .with_context(|| format!("failed to read {}", path.display()))?;
+        if n == 0 {
+            return Ok(());
+        }
+        f(&buf[..n]);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::HashAlgo;
+    use crate::TempDir;
+
+    #[test]
+    fn hash_file() {
+        let tmp = TempDir::new().unwrap();
+        let empty = tmp.0.join("empty");
+        let abc = tmp.0.join("abc");
+        std::fs::write(&empty, "").unwrap();
+        std::fs::write(&abc, "abc").unwrap();
+        let cases = [
+            (HashAlgo::Md5, &empty, "d41d8cd98f00b204e9800998ecf8427e"),
+            (HashAlgo::Md5, &abc, "900150983cd24fb0d6963f7d28e17f72"),
+            (
+                HashAlgo::Sha1,
+                &abc,
+                "a9993e364706816aba3e25717850c26c9cd0d89d",
+            ),
+            (
+                HashAlgo::Sha256,
+                &abc,
+                "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+            ),
+        ];
+        for (algo, path, expected) in cases.iter() {
+            assert_eq!(algo.hash_file(path).unwrap(), *expected, "{}", algo.name());
+        }
+        assert!(HashAlgo::Md5.hash_file(tmp.0.join("missing")).is_err());
+    }
+
+    #[test]
+    fn of_digest() {
+        assert_eq!(
+            HashAlgo::of_digest("d41d8cd98f00b204e9800998ecf8427e"),
+            Some(HashAlgo::Md5)
+        );
+        assert_eq!(HashAlgo::of_digest(&"0".repeat(40)), Some(HashAlgo::Sha1));
+        assert_eq!(HashAlgo::of_digest(&"0".repeat(64)), Some(HashAlgo::Sha256));
+        assert_eq!(HashAlgo::of_digest("unknown"), None);
+    }
+}
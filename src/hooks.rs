@@ -0,0 +1,104 @@
+use crate::{Category, Entry};
+use anyhow::{anyhow, Context, Result};
+use std::collections::{BTreeMap, BTreeSet};
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+// The hook run on any change, given every added and removed entry.
+const ON_CHANGE: &str = "on-change";
+
+/// Hooks are shell commands run when the diff changes, keyed by event:
+///
+/// - on-change runs when anything appears or goes away.
+/// - on-new-CATEGORY runs when differences of a category appear, like
+///   on-new-unpackaged or on-new-modified-backup.
+/// - on-gone-CATEGORY runs when differences of a category go away.
+///
+/// The affected entries are written to the command's stdin, one per line as
+/// the category code and the path, prefixed with + or - for on-change.
+pub struct Hooks {
+    commands: BTreeMap<String, String>,
+}
+
+// The name of a category in hook names, like modified-backup.
+fn name(category: Category) -> String {
+    serde_json::to_value(category)
+        .ok()
+        .and_then(|v| v.as_str().map(str::to_string))
+        .unwrap_or_default()
+}
+
+impl Hooks {
+    /// Checks the hook names, failing on those that are not a known event.
+    pub fn new(commands: BTreeMap<String, String>) -> Result<Self> {
+        let mut events = vec![ON_CHANGE.to_string()];
+        for c in Category::ALL.iter().copied() {
+            events.push(format!("on-new-{}", name(c)));
+            events.push(format!("on-gone-{}", name(c)));
+        }
+        if let Some(unknown) = commands.keys().find(|k| !events.contains(k)) {
+            return Err(anyhow!("unknown hook {}", unknown));
+        }
+        Ok(Self { commands })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.commands.is_empty()
+    }
+
+    /// Runs the hooks for the changes from old to new, one after the other.
+    /// A failing hook is logged and does not stop the others.
+    pub fn run(&self, root: &str, old: &BTreeSet<Entry>, new: &BTreeSet<Entry>) {
+        let added: Vec<&Entry> = new.difference(old).collect();
+        let removed: Vec<&Entry> = old.difference(new).collect();
+        let line = |e: &Entry| format!("{} {}{}\n", e.category.code(), root, e.path);
+        if !added.is_empty() || !removed.is_empty() {
+            let input: String = added
+                .iter()
+                .map(|e| format!("+ {}", line(e)))
+                .chain(removed.iter().map(|e| format!("- {}", line(e))))
+                .collect();
+            self.run_hook(ON_CHANGE, &input);
+        }
+        for (event, entries) in [("new", &added), ("gone", &removed)].iter() {
+            for c in Category::ALL.iter().copied() {
+                let input: String = entries
+                    .iter()
+                    .filter(|e| e.category == c)
+                    .map(|e| line(e))
+                    .collect();
+                if !input.is_empty() {
+                    self.run_hook(&format!("on-{}-{}", event, name(c)), &input);
+                }
+            }
+        }
+    }
+
+    fn run_hook(&self, event: &str, input: &str) {
+        if let Some(command) = self.commands.get(event) {
+            if let Err(err) = run(event, command, input) {
+                log::error!("{:#}", err);
+            }
+        }
+    }
+}
+
+// Runs a hook command with sh, passing the event in ARCHDIFF_HOOK.
+fn run(event: &str, command: &str, input: &str) -> Result<()> {
+    let mut child = Command::new("sh")
+        .arg("-c")
+        .arg(command)
+        .env("ARCHDIFF_HOOK", event)
+        .stdin(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("failed to run the {} hook", event))?;
+    if let Some(mut stdin) = child.stdin.take() {
+        // a hook that exits without reading its input is fine
+        let _ = stdin.write_all(input.as_bytes());
+    }
+    let status = child.wait()?;
+    if !status.success() {
+        return Err(anyhow!("the {} hook failed: {}", event, status));
+    }
+    Ok(())
+}
@@ -0,0 +1,269 @@
+use anyhow::{anyhow, Context, Result};
+use std::io::{BufRead, BufReader, Read, Write};
+use std::net::{TcpListener, TcpStream};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Duration;
+
+// Requests larger than this are refused, which is well above the size of a
+// snapshot of a heavily modified system.
+const MAX_BODY: usize = 256 << 20;
+
+/// Request is an HTTP request, with the path and query decoded.
+pub struct Request {
+    pub method: String,
+    pub path: String,
+    pub query: Vec<(String, String)>,
+    /// The bearer token of the Authorization header, if any.
+    pub token: Option<String>,
+    pub body: Vec<u8>,
+}
+
+impl Request {
+    /// Finds the first value of a query parameter.
+    pub fn param(&self, name: &str) -> Option<&str> {
+        self.query
+            .iter()
+            .find(|(k, _)| k == name)
+            .map(|(_, v)| v.as_str())
+    }
+}
+
+/// Response is an HTTP response.
+pub struct Response {
+    pub status: u16,
+    pub content_type: &'static str,
+    pub body: Vec<u8>,
+}
+
+impl Response {
+    pub fn json<T: serde::Serialize>(value: &T) -> Self {
+        match serde_json::to_vec_pretty(value) {
+            Ok(body) => Self {
+                status: 200,
+                content_type: "application/json",
+                body,
+            },
+            Err(err) => Self::error(500, &err.to_string()),
+        }
+    }
+
+    pub fn text(status: u16, body: String) -> Self {
+        Self {
+            status,
+            content_type: "text/plain; charset=utf-8",
+            body: body.into_bytes(),
+        }
+    }
+
+    pub fn error(status: u16, message: &str) -> Self {
+        Self::text(status, format!("{}\n", message))
+    }
+}
+
+fn reason(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        400 => "Bad Request",
+        401 => "Unauthorized",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        _ => "Internal Server Error",
+    }
+}
+
+/// Decodes the %XX escapes in a URL path or query component, and + in
+/// queries.
+pub fn decode(s: &str, query: bool) -> String {
+    let b = s.as_bytes();
+    let mut out = Vec::with_capacity(b.len());
+    let mut i = 0;
+    while i < b.len() {
+        let hex = |c: u8| (c as char).to_digit(16);
+        match b[i] {
+            b'%' if i + 2 < b.len() => match (hex(b[i + 1]), hex(b[i + 2])) {
+                (Some(hi), Some(lo)) => {
+                    out.push((hi * 16 + lo) as u8);
+                    i += 3;
+                    continue;
+                }
+                _ => out.push(b'%'),
+            },
+            b'+' if query => out.push(b' '),
+            c => out.push(c),
+        }
+        i += 1;
+    }
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+/// Encodes a URL path, leaving the slashes alone.
+pub fn encode(s: &str) -> String {
+    s.bytes()
+        .map(|c| match c {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'.' | b'_' | b'~' | b'/' => {
+                (c as char).to_string()
+            }
+            _ => format!("%{:02X}", c),
+        })
+        .collect()
+}
+
+fn read_request(stream: &TcpStream) -> Result<Request> {
+    let mut r = BufReader::new(stream);
+    let mut line = String::new();
+    r.read_line(&mut line)?;
+    let mut parts = line.split_whitespace();
+    let method = parts.next().unwrap_or_default().to_string();
+    let target = parts
+        .next()
+        .ok_or_else(|| anyhow!("invalid request line {:?}", line.trim()))?;
+    let mut len = 0;
+    let mut token = None;
+    loop {
+        let mut header = String::new();
+        if r.read_line(&mut header)? == 0 || header.trim().is_empty() {
+            break;
+        }
+        if let Some((name, value)) = header.split_once(':') {
+            if name.eq_ignore_ascii_case("content-length") {
+                len = value.trim().parse().context("invalid content length")?;
+            } else if name.eq_ignore_ascii_case("authorization") {
+                token = value.trim().strip_prefix("Bearer ").map(str::to_string);
+            }
+        }
+    }
+    if len > MAX_BODY {
+        return Err(anyhow!("request of {} bytes is too large", len));
+    }
+    let mut body = vec![0; len];
+    r.read_exact(&mut body)?;
+    let (path, query) = target.split_once('?').unwrap_or((target, ""));
+    Ok(Request {
+        method,
+        path: decode(path, false),
+        query: query
+            .split('&')
+            .filter(|p| !p.is_empty())
+            .map(|p| {
+                let (k, v) = p.split_once('=').unwrap_or((p, ""));
+                (decode(k, true), decode(v, true))
+            })
+            .collect(),
+        token,
+        body,
+    })
+}
+
+fn write_response(mut stream: &TcpStream, response: &Response) -> Result<()> {
+    write!(
+        stream,
+        "HTTP/1.1 {} {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+        response.status,
+        reason(response.status),
+        response.content_type,
+        response.body.len()
+    )?;
+    stream.write_all(&response.body)?;
+    stream.flush()?;
+    Ok(())
+}
+
+pub fn listen(addr: &str) -> Result<TcpListener> {
+    TcpListener::bind(addr).with_context(|| format!("failed to listen on {}", addr))
+}
+
+/// Serves HTTP on the listener, answering each request with handler on a
+/// thread of its own. Connections are closed after each response.
+pub fn serve<F>(listener: TcpListener, handler: F)
+where
+    F: Fn(&Request) -> Response + Sync,
+{
+    let stop = AtomicBool::new(false);
+    serve_until(listener, handler, &stop)
+}
+
+/// Like serve, but returns once stop is set, after answering the requests
+/// already accepted.
+pub fn serve_until<F>(listener: TcpListener, handler: F, stop: &AtomicBool)
+where
+    F: Fn(&Request) -> Response + Sync,
+{
+    // accepting without blocking lets stop be checked between connections
+    if let Err(err) = listener.set_nonblocking(true) {
+        log::error!("failed to make the listener non-blocking: {}", err);
+        return;
+    }
+    std::thread::scope(|s| {
+        while !stop.load(Ordering::Relaxed) {
+            let stream = match listener.accept() {
+                Ok((stream, _)) => stream,
+                Err(err) if err.kind() == std::io::ErrorKind::WouldBlock => {
+                    std::thread::sleep(Duration::from_millis(100));
+                    continue;
+                }
+                Err(err) => {
+                    log::error!("failed to accept a connection: {}", err);
+                    continue;
+                }
+            };
+            let handler = &handler;
+            s.spawn(move || {
+                let _ = stream.set_nonblocking(false);
+                let _ = stream.set_read_timeout(Some(Duration::from_secs(60)));
+                let response = match read_request(&stream) {
+                    Ok(request) => handler(&request),
+                    Err(err) => Response::error(400, &format!("{:#}", err)),
+                };
+                crate::filter_map_error(
+                    write_response(&stream, &response).context("failed to answer request"),
+                );
+            });
+        }
+    })
+}
+
+/// Posts a JSON body to an http:// URL, with a bearer token if one is given,
+/// failing unless the server answers with 200.
+pub fn post(url: &str, body: &[u8], token: Option<&str>) -> Result<()> {
+    let rest = url
+        .strip_prefix("http://")
+        .ok_or_else(|| anyhow!("only http:// URLs are supported, not {}", url))?;
+    let (host, path) = match rest.find('/') {
+        Some(i) => rest.split_at(i),
+        None => (rest, "/"),
+    };
+    let addr = if host.contains(':') {
+        host.to_string()
+    } else {
+        format!("{}:80", host)
+    };
+    let mut stream =
+        TcpStream::connect(&addr).with_context(|| format!("failed to connect to {}", addr))?;
+    stream.set_read_timeout(Some(Duration::from_secs(60)))?;
+    let auth = match token {
+        Some(token) => format!("Authorization: Bearer {}\r\n", token),
+        None => String::new(),
+    };
+    write!(
+        stream,
+        "POST {} HTTP/1.1\r\nHost: {}\r\n{}Content-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+        path,
+        host,
+        auth,
+        body.len()
+    )?;
+    stream.write_all(body)?;
+    let mut response = String::new();
+    BufReader::new(stream)
+        .read_to_string(&mut response)
+        .with_context(|| format!("failed to read the response from {}", addr))?;
+    let status = response.lines().next().unwrap_or_default();
+    if status.split_whitespace().nth(1) != Some("200") {
+        let body = response
+            .split_once("\r\n\r\n")
+            .map(|(_, b)| b)
+            .unwrap_or_default();
+        return Err(anyhow!("{} answered {}: {}", url, status, body.trim()));
+    }
+    Ok(())
+}
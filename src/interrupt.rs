@@ -0,0 +1,23 @@
+use std::sync::atomic::{AtomicBool, Ordering};
+
+static INTERRUPTED: AtomicBool = AtomicBool::new(false);
+
+extern "C" fn handle(_: libc::c_int) {
+    // a second Ctrl-C exits right away, in case stopping takes too long
+    if INTERRUPTED.swap(true, Ordering::SeqCst) {
+        // SAFETY: _exit is async signal safe
+        unsafe { libc::_exit(130) };
+    }
+}
+
+/// Catches SIGINT so the diff stops early and keeps what it found so far,
+/// instead of the process being killed.
+pub fn catch() {
+    // SAFETY: handle only touches an atomic and calls _exit
+    unsafe { libc::signal(libc::SIGINT, handle as libc::sighandler_t) };
+}
+
+/// Whether SIGINT was received since catch was called.
+pub fn interrupted() -> bool {
+    INTERRUPTED.load(Ordering::Relaxed)
+}
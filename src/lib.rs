@@ -0,0 +1,2516 @@
+use anyhow::{anyhow, Context, Result};
+use ignore::gitignore::{Gitignore, GitignoreBuilder};
+use log::{debug, error, trace, warn};
+use rayon::prelude::*;
+use serde::{Deserialize, Serialize};
+use std::cell::Cell;
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fmt::Display;
+use std::io::Write;
+use std::os::unix::fs::{MetadataExt, OpenOptionsExt};
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use walkdir::WalkDir;
+pub mod apk;
+pub mod backup;
+
+pub mod cache;
+pub mod config;
+pub mod daemon;
+pub mod dpkg;
+pub mod fleet;
+pub mod git;
+pub mod hash;
+pub mod hooks;
+pub mod http;
+pub mod interrupt;
+pub mod localdb;
+pub mod lock;
+pub mod manifest;
+mod matcher;
+pub mod metrics;
+pub mod mounts;
+pub mod mtree;
+pub mod packages;
+pub mod pacman;
+pub mod progress;
+pub mod query;
+pub mod roots;
+pub mod rpm;
+pub mod secret;
+pub mod snapshot;
+pub mod source;
+pub mod systemd;
+pub mod template;
+pub mod watch;
+pub mod xattrs;
+pub mod yaml;
+
+use cache::HashCache;
+pub use hash::HashAlgo;
+use lock::{Lock, PacmanLock};
+use manifest::{FileMeta, Manifest, MANIFEST_FILE};
+use matcher::{IgnoreStats, Matcher};
+use mtree::MtreeEntry;
+use packages::{PackageList, PACKAGES_FILE};
+use pacman::{Patterns, SkipMode};
+use progress::{Progress, Reporter};
+use snapshot::{Snapshot, SnapshotEntry};
+use source::{Backend, BackupHash, Package, PackageSource, Reason};
+
+/// Options configures where App looks for the system, packages and repo.
+pub struct Options {
+    pub root: String,
+    pub dbpath: String,
+    /// Limit the scan to these paths under the root, or scan everything if
+    /// empty.
+    pub prefixes: Vec<String>,
+    /// Do not descend into dirs on other filesystems than where the walk
+    /// starts.
+    pub one_file_system: bool,
+    /// Walk into virtual and ephemeral filesystems like /proc and /tmp,
+    /// which are skipped by default.
+    pub virtual_fs: bool,
+    /// Only walk this many levels of dirs below the root.
+    pub max_depth: Option<usize>,
+    /// Files larger than this are compared by size instead of hashed.
+    pub max_hash_size: Option<u64>,
+    /// The repo dirs, with files in later dirs overriding earlier ones.
+    pub repo: Vec<String>,
+    /// List the files of repo dirs in git work trees using git, which skips
+    /// untracked and ignored files.
+    pub repo_git: bool,
+    /// The host name used to find host specific files in the repo dirs, or
+    /// None to use the system host name.
+    pub hostname: Option<String>,
+    pub ignore: String,
+    /// The user's ignore dir, loaded after the system one if it exists, or
+    /// None to only use the system one.
+    pub user_ignore: Option<String>,
+    /// Ignore all files owned by these packages, like pkg: lines in the
+    /// ignore files.
+    pub exclude_packages: Vec<String>,
+    /// Extra ignore patterns, applied after the ignore dirs.
+    pub excludes: Vec<String>,
+    /// Extra files of ignore patterns, with - for stdin, applied after the
+    /// ignore dirs and before the excludes.
+    pub ignore_from: Vec<String>,
+    /// Limit the diff to the files owned by these packages, or check all
+    /// packages and unpackaged files if empty.
+    pub packages: Vec<String>,
+    /// The hash cache file, or None to disable caching.
+    pub cache: Option<String>,
+    /// The file locked while computing the diff and saving the state, so
+    /// runs do not race on the cache and state files, or None to not lock.
+    pub lock: Option<String>,
+    /// What to do when pacman is in the middle of a transaction.
+    pub pacman_lock: PacmanLock,
+    /// The age identity file used to decrypt encrypted repo files.
+    pub age_identity: String,
+    /// The age recipients file used to encrypt adopted files.
+    pub age_recipients: String,
+    /// The hash used to compare repo files.
+    pub hash: HashAlgo,
+    /// Check all packaged files against mtree data.
+    pub mtree: bool,
+    /// Report packaged files whose mode or owner differ from mtree data.
+    pub metadata: bool,
+    /// Compare xattrs of repo files and report packaged files with
+    /// capabilities.
+    pub xattrs: bool,
+    /// Print progress to stderr while computing the diff.
+    pub progress: bool,
+    /// List orphaned dependencies, which no installed package needs
+    /// anymore, along with the package differences.
+    pub orphans: bool,
+    /// List foreign packages, found in no sync database, along with the
+    /// package differences.
+    pub foreign: bool,
+    /// Summarize paths that could not be read for lack of permission instead
+    /// of logging an error for each.
+    pub tolerant: bool,
+    /// The NoExtract patterns from pacman.conf.
+    pub no_extract: Vec<String>,
+    /// The NoUpgrade patterns from pacman.conf.
+    pub no_upgrade: Vec<String>,
+    /// How to report files matching NoExtract and NoUpgrade.
+    pub skip_mode: SkipMode,
+    /// The pacman package cache dirs, used to find original file contents.
+    pub pkg_cache_dirs: Vec<String>,
+    /// The sync databases from pacman.conf, used to find foreign packages.
+    pub sync_dbs: Vec<String>,
+    /// How the package database is read.
+    pub backend: Backend,
+}
+
+impl Default for Options {
+    fn default() -> Self {
+        Self {
+            root: "/".to_string(),
+            dbpath: "/var/lib/pacman".to_string(),
+            prefixes: vec![],
+            one_file_system: false,
+            virtual_fs: false,
+            max_depth: None,
+            max_hash_size: None,
+            repo: vec!["/usr/share/archdiff".to_string()],
+            repo_git: false,
+            hostname: None,
+            ignore: "/etc/archdiff/ignore".to_string(),
+            user_ignore: config::user_dir()
+                .map(|dir| dir.join("ignore").to_string_lossy().into_owned()),
+            cache: Some("/var/cache/archdiff/hashes".to_string()),
+            lock: Some("/run/lock/archdiff.lock".to_string()),
+            pacman_lock: PacmanLock::Wait,
+            age_identity: "/etc/archdiff/age/identity".to_string(),
+            age_recipients: "/etc/archdiff/age/recipients".to_string(),
+            hash: HashAlgo::Md5,
+            mtree: false,
+            metadata: false,
+            xattrs: false,
+            progress: false,
+            orphans: false,
+            foreign: false,
+            // SAFETY: geteuid has no preconditions
+            tolerant: unsafe { libc::geteuid() } != 0,
+            exclude_packages: vec![],
+            excludes: vec![],
+            ignore_from: vec![],
+            packages: vec![],
+            no_extract: vec![],
+            no_upgrade: vec![],
+            skip_mode: SkipMode::Exclude,
+            pkg_cache_dirs: vec!["/var/cache/pacman/pkg/".to_string()],
+            sync_dbs: vec![],
+            backend: Backend::default(),
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum Category {
+    Unpackaged,
+    Pacnew,
+    Pacsave,
+    Deleted,
+    Modified,
+    ModifiedBackup,
+    ModifiedRepo,
+    Metadata,
+    Xattrs,
+    Capability,
+    NoExtract,
+    NoUpgrade,
+}
+
+impl Category {
+    /// All categories, in the order they sort.
+    pub const ALL: [Category; 12] = [
+        Category::Unpackaged,
+        Category::Pacnew,
+        Category::Pacsave,
+        Category::Deleted,
+        Category::Modified,
+        Category::ModifiedBackup,
+        Category::ModifiedRepo,
+        Category::Metadata,
+        Category::Xattrs,
+        Category::Capability,
+        Category::NoExtract,
+        Category::NoUpgrade,
+    ];
+
+    /// Finds the category with the given code.
+    pub fn from_code(code: char) -> Option<Category> {
+        Category::ALL.iter().copied().find(|c| c.code() == code)
+    }
+
+    pub fn code(self) -> char {
+        match self {
+            Category::Unpackaged => '?',
+            Category::Pacnew => 'N',
+            Category::Pacsave => 'S',
+            Category::Deleted => 'D',
+            Category::Modified => 'M',
+            Category::ModifiedBackup => 'B',
+            Category::ModifiedRepo => 'R',
+            Category::Metadata => 'P',
+            Category::Xattrs => 'A',
+            Category::Capability => 'C',
+            Category::NoExtract => 'X',
+            Category::NoUpgrade => 'U',
+        }
+    }
+
+    pub fn label(self) -> &'static str {
+        match self {
+            Category::Unpackaged => "unpackaged",
+            Category::Pacnew => "pacnew",
+            Category::Pacsave => "pacsave",
+            Category::Deleted => "deleted",
+            Category::Modified => "modified",
+            Category::ModifiedBackup => "modified backup",
+            Category::ModifiedRepo => "modified repo",
+            Category::Metadata => "modified metadata",
+            Category::Xattrs => "modified xattrs",
+            Category::Capability => "capabilities",
+            Category::NoExtract => "not extracted",
+            Category::NoUpgrade => "not upgraded",
+        }
+    }
+}
+
+/// Finds the category and base file of a .pacnew or .pacsave file, which
+/// pacman leaves next to backup files it did not overwrite or remove.
+pub fn pacfile_base(path: &str) -> Option<(Category, &str)> {
+    if let Some(base) = path.strip_suffix(".pacnew") {
+        Some((Category::Pacnew, base))
+    } else {
+        path.strip_suffix(".pacsave")
+            .map(|base| (Category::Pacsave, base))
+    }
+}
+
+/// PacFile describes the base file of a .pacnew or .pacsave file.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct PacFile {
+    /// The base file, relative to the root.
+    pub base: String,
+    /// The package owning the base file, if any.
+    pub package: Option<String>,
+    /// Whether the base file differs from the packaged copy, if known.
+    pub modified: Option<bool>,
+}
+
+/// Owner describes how archdiff tracks a path, as found by App::owner.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct Owner {
+    /// The package owning the path, or None if it is unpackaged.
+    pub package: Option<String>,
+    /// The path is a backup file of the package.
+    pub backup: bool,
+    /// A repo file shadows the path.
+    pub repo: bool,
+}
+
+/// IgnoreMatch is what the ignore rules decide about a path, along with the
+/// pattern deciding it as file:line: pattern.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum IgnoreMatch {
+    None,
+    Ignored(String),
+    /// Ignored by an earlier pattern, but re-included by a later ! pattern.
+    Reincluded(String),
+    /// Owned by a package ignored with a pkg: line or --exclude-package.
+    Package(String),
+}
+
+/// PatternKind is how a line of the ignore files is matched. Following
+/// gitignore, a pattern with a slash other than a trailing one is anchored
+/// at the root, and one without is matched against the name of a path at any
+/// depth.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum PatternKind {
+    /// An anchored pattern with wildcards or character classes.
+    Glob,
+    /// An anchored literal path, matching it and everything inside it.
+    Prefix,
+    /// A name, with or without wildcards, matching at any depth.
+    Name,
+    /// A pkg: line, matching the files owned by a package.
+    Package,
+}
+
+impl PatternKind {
+    // Classifies a gitignore pattern, ignoring the ! of a re-include.
+    fn of(pattern: &str) -> Self {
+        let pattern = pattern.strip_prefix('!').unwrap_or(pattern);
+        if !pattern.trim_end_matches('/').contains('/') {
+            PatternKind::Name
+        } else if pattern.contains(['*', '?', '[']) {
+            PatternKind::Glob
+        } else {
+            PatternKind::Prefix
+        }
+    }
+
+    pub fn label(self) -> &'static str {
+        match self {
+            PatternKind::Glob => "glob",
+            PatternKind::Prefix => "prefix",
+            PatternKind::Name => "name",
+            PatternKind::Package => "package",
+        }
+    }
+}
+
+/// IgnorePattern is a line of the ignore files.
+#[derive(Clone, Debug)]
+pub struct IgnorePattern {
+    pub file: PathBuf,
+    pub line: usize,
+    pub pattern: String,
+    pub kind: PatternKind,
+    /// Whether it only matches dirs, because it ends with a slash.
+    pub dir_only: bool,
+    /// How many paths it matched in the last scan, or None if no scan has
+    /// recorded it.
+    pub matched: Option<usize>,
+}
+
+/// Entry is a single difference found by App::diff.
+#[derive(Clone, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub struct Entry {
+    pub category: Category,
+    /// The path relative to the root.
+    pub path: String,
+}
+
+/// PackageCategory is the kind of difference between the installed packages
+/// and the package list in the repo.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum PackageCategory {
+    /// Explicitly installed, but not listed.
+    Unlisted,
+    /// Listed, but not installed.
+    Missing,
+    /// Installed, but not in any sync database, as with AUR packages.
+    Foreign,
+    /// Installed as a dependency, but nothing depends on it anymore.
+    Orphan,
+}
+
+impl PackageCategory {
+    pub fn label(self) -> &'static str {
+        match self {
+            PackageCategory::Unlisted => "unlisted",
+            PackageCategory::Missing => "missing",
+            PackageCategory::Foreign => "foreign",
+            PackageCategory::Orphan => "orphaned",
+        }
+    }
+}
+
+/// PackageEntry is a single package difference found by App::package_diff.
+#[derive(Clone, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub struct PackageEntry {
+    pub category: PackageCategory,
+    pub name: String,
+}
+
+/// Action is a change apply makes to a file on the root.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum Action {
+    /// The file is missing and will be copied from the repo.
+    Create,
+    /// The file differs from the repo and will be overwritten.
+    Overwrite,
+    /// The file will be replaced by a symlink to the target.
+    Link(PathBuf),
+    /// The contents match, but the mode or owner will be set to the recorded
+    /// metadata.
+    Chmod(FileMeta),
+}
+
+pub struct App {
+    source: Box<dyn PackageSource>,
+    // The installed packages, sorted by name.
+    installed: Vec<Package>,
+    // The names of the packages in the sync databases, if foreign packages
+    // are looked for.
+    sync: HashSet<String>,
+    ignore: Gitignore,
+    ignore_pkgs: HashSet<String>,
+    // The ignore patterns as read, kept since stdin can only be read once.
+    ignore_sources: Vec<(PathBuf, String)>,
+    no_extract: Patterns,
+    no_upgrade: Patterns,
+    cache: HashCache,
+    // The repo dirs followed by their host specific dirs.
+    repos: Vec<String>,
+    // The metadata recorded for repo files, merged from all repo dirs.
+    manifest: Manifest,
+    // The packages listed in the repo, merged from all repo dirs.
+    packages: PackageList,
+    // The mount points of virtual filesystems, which are not walked.
+    virtual_mounts: HashSet<PathBuf>,
+    progress: Arc<Progress>,
+    opts: Options,
+}
+
+// TempDir is a private directory made with mkdtemp, so other users cannot
+// plant files or symlinks in it. It is removed along with its contents when
+// dropped.
+pub(crate) struct TempDir(pub(crate) PathBuf);
+
+impl TempDir {
+    pub(crate) fn new() -> Result<Self> {
+        use std::os::unix::ffi::{OsStrExt, OsStringExt};
+        let template = std::env::temp_dir().join("archdiff-XXXXXX");
+        let mut buf =
+            std::ffi::CString::new(template.as_os_str().as_bytes())?.into_bytes_with_nul();
+        // SAFETY: buf is a NUL terminated template, which mkdtemp fills in
+        let dir = unsafe { libc::mkdtemp(buf.as_mut_ptr() as *mut libc::c_char) };
+        if dir.is_null() {
+            return Err(std::io::Error::last_os_error())
+                .with_context(|| format!("failed to create {}", template.display()));
+        }
+        buf.pop();
+        Ok(Self(PathBuf::from(std::ffi::OsString::from_vec(buf))))
+    }
+
+    // Writes a file readable only by the owner, failing if it already exists
+    // rather than following it.
+    fn write(&self, name: &str, contents: &[u8]) -> Result<PathBuf> {
+        let path = self.0.join(name);
+        let mut f = std::fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .mode(0o600)
+            .open(&path)
+            .with_context(|| format!("failed to create {}", path.display()))?;
+        f.write_all(contents)
+            .with_context(|| format!("failed to write {}", path.display()))?;
+        Ok(path)
+    }
+}
+
+impl Drop for TempDir {
+    fn drop(&mut self) {
+        let _ = std::fs::remove_dir_all(&self.0);
+    }
+}
+
+// Maps the category of files matching NoExtract and NoUpgrade according to
+// the skip mode, returning None if the entry should be excluded.
+fn skip_category(
+    no_extract: &Patterns,
+    no_upgrade: &Patterns,
+    mode: SkipMode,
+    category: Category,
+    path: &str,
+) -> Option<Category> {
+    let skipped = match category {
+        Category::Deleted if no_extract.is_match(path) => Category::NoExtract,
+        Category::Modified | Category::ModifiedBackup if no_upgrade.is_match(path) => {
+            Category::NoUpgrade
+        }
+        _ => return Some(category),
+    };
+    match mode {
+        SkipMode::Exclude => None,
+        SkipMode::Mark => Some(skipped),
+        SkipMode::Off => Some(category),
+    }
+}
+
+// The file in the ignore dir that ignore_path adds to. It sorts after the
+// usual numbered files, so its patterns win.
+const LOCAL_IGNORE_FILE: &str = "zz-local";
+
+// The dir in a repo holding the host specific overlays.
+const HOSTS_DIR: &str = "hosts";
+
+/// Looks up the host name of the machine.
+pub fn hostname() -> Result<String> {
+    let mut buf = [0u8; 256];
+    // SAFETY: buf is valid for writes of its length
+    if unsafe { libc::gethostname(buf.as_mut_ptr() as *mut libc::c_char, buf.len()) } != 0 {
+        return Err(anyhow!(
+            "failed to get host name: {}",
+            std::io::Error::last_os_error()
+        ));
+    }
+    let len = buf.iter().position(|&b| b == 0).unwrap_or(buf.len());
+    Ok(String::from_utf8_lossy(&buf[..len]).into_owned())
+}
+
+pub(crate) fn filter_map_error<Error: Display, O>(
+    result: std::result::Result<O, Error>,
+) -> Option<O> {
+    match result {
+        Ok(o) => Some(o),
+        Err(err) => {
+            error!("{}", err);
+            None
+        }
+    }
+}
+
+// Checks if an error was caused by missing permissions.
+pub(crate) fn is_permission_denied(err: &anyhow::Error) -> bool {
+    err.chain().any(|e| {
+        matches!(e.downcast_ref::<std::io::Error>(),
+            Some(e) if e.kind() == std::io::ErrorKind::PermissionDenied)
+    })
+}
+
+// Skipped collects the paths that could not be read for lack of permission,
+// which are summarized at the end of the diff when errors are tolerated.
+struct Skipped {
+    tolerant: bool,
+    paths: Mutex<Vec<String>>,
+}
+
+impl Skipped {
+    fn new(tolerant: bool) -> Self {
+        Self {
+            tolerant,
+            paths: Mutex::new(vec![]),
+        }
+    }
+
+    // Like filter_map_error, but records the path of permission errors.
+    fn check<O>(&self, path: &str, result: Result<O>) -> Option<O> {
+        match result {
+            Ok(o) => Some(o),
+            Err(err) if self.tolerant && is_permission_denied(&err) => {
+                self.paths.lock().unwrap().push(path.to_string());
+                None
+            }
+            Err(err) => {
+                error!("{:#}", err);
+                None
+            }
+        }
+    }
+
+    fn walk_error(&self, err: walkdir::Error) {
+        let denied = matches!(err.io_error(),
+            Some(e) if e.kind() == std::io::ErrorKind::PermissionDenied);
+        match err.path() {
+            Some(path) if self.tolerant && denied => {
+                self.paths.lock().unwrap().push(path.display().to_string())
+            }
+            _ => error!("{}", err),
+        }
+    }
+
+    fn summarize(self) {
+        let mut paths = self.paths.into_inner().unwrap();
+        if paths.is_empty() {
+            return;
+        }
+        paths.sort();
+        for path in &paths {
+            warn!("skipped {}", path);
+        }
+        error!(
+            "skipped {} paths without permission to read them, run with -v to list them",
+            paths.len()
+        );
+    }
+}
+
+// Normalizes the scan prefixes into paths relative to the root without
+// leading or trailing slashes, dropping those under another prefix. A prefix
+// covering the whole root clears them all.
+fn prefixes(prefixes: &[String]) -> Vec<String> {
+    let mut prefixes: Vec<String> = prefixes
+        .iter()
+        .map(|p| p.trim_matches('/').to_string())
+        .collect();
+    if prefixes.iter().any(|p| p.is_empty()) {
+        return vec![];
+    }
+    prefixes.sort();
+    prefixes.dedup();
+    let all = prefixes.clone();
+    prefixes.retain(|p| !all.iter().any(|q| q != p && under(q, p)));
+    prefixes
+}
+
+// The number of components in a path relative to the root.
+fn depth(path: &str) -> usize {
+    match path.trim_matches('/') {
+        "" => 0,
+        path => path.split('/').count(),
+    }
+}
+
+// Checks if path is prefix or inside it, where both are relative to the root.
+fn under(prefix: &str, path: &str) -> bool {
+    matches!(path.strip_prefix(prefix), Some(rest) if rest.is_empty() || rest.starts_with('/'))
+}
+
+// Escapes the characters gitignore patterns treat specially, so the pattern
+// only matches the path itself.
+fn escape_pattern(path: &str) -> String {
+    let mut escaped = String::with_capacity(path.len());
+    for c in path.chars() {
+        if matches!(c, '\\' | '*' | '?' | '[') {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    if escaped.ends_with(' ') {
+        escaped.insert(escaped.len() - 1, '\\');
+    }
+    escaped
+}
+
+// Compares two paths where either may be a symlink, in which case they only
+// match if both are symlinks to the same target. Returns None if neither is a
+// symlink.
+fn links_differ(a: &str, b: &str) -> Option<bool> {
+    let a = std::fs::read_link(a).ok();
+    let b = std::fs::read_link(b).ok();
+    if a.is_none() && b.is_none() {
+        return None;
+    }
+    Some(a != b)
+}
+
+// Compares a repo file against the file on the root, returning None if either
+// could not be read.
+fn repo_file_differs(
+    cache: &HashCache,
+    algo: HashAlgo,
+    identity: &str,
+    src: &str,
+    dst: &str,
+) -> Option<bool> {
+    if let Some(differ) = links_differ(src, dst) {
+        return Some(differ);
+    }
+    if src.ends_with(secret::SUFFIX) {
+        return filter_map_error(secret::differs(identity, src, dst));
+    }
+    let src_size = filter_map_error(std::fs::metadata(src))?.len();
+    let dst_size = filter_map_error(std::fs::metadata(dst))?.len();
+    if src_size != dst_size {
+        return Some(true);
+    }
+    if cache.too_large(src_size) {
+        debug!("comparing {} by size only, it is too large to hash", dst);
+        return Some(false);
+    }
+    Some(cache.hash(algo, src)? != cache.hash(algo, dst)?)
+}
+
+// TODO: command to sync /usr/share/archdiff automatically
+
+impl App {
+    #[allow(clippy::new_ret_no_self)]
+    pub fn new(mut opts: Options) -> Result<Self> {
+        if !opts.root.ends_with('/') {
+            opts.root.push('/');
+        }
+        for repo in &mut opts.repo {
+            if !repo.ends_with('/') {
+                repo.push('/');
+            }
+        }
+        opts.prefixes = prefixes(&opts.prefixes);
+        let progress = Arc::new(Progress::default());
+        let cache = match &opts.cache {
+            None => HashCache::disabled(),
+            Some(path) => HashCache::load(path)?,
+        }
+        .with_progress(progress.clone())
+        .with_max_size(opts.max_hash_size);
+        let ignore_sources = Self::ignore_sources(&opts)?;
+        let (ignore, mut ignore_pkgs) = Self::build_gitignore(&ignore_sources, &opts.root)?;
+        ignore_pkgs.extend(opts.exclude_packages.iter().cloned());
+        let hostname = match &opts.hostname {
+            Some(hostname) => hostname.clone(),
+            None => hostname()?,
+        };
+        // most repos have no overlay for this host, so it is only used when
+        // it exists rather than failing to walk it on every run
+        let repos = opts
+            .repo
+            .iter()
+            .flat_map(|repo| {
+                let host = format!("{}{}/{}/", repo, HOSTS_DIR, hostname);
+                let host = Some(host).filter(|h| Path::new(h).is_dir());
+                std::iter::once(repo.clone()).chain(host)
+            })
+            .collect::<Vec<_>>();
+        let mut manifest = Manifest::default();
+        let mut packages = PackageList::default();
+        for repo in &repos {
+            manifest.extend(Manifest::load(repo)?);
+            packages.extend(PackageList::load(repo)?);
+        }
+        let virtual_mounts = if opts.virtual_fs {
+            HashSet::new()
+        } else {
+            filter_map_error(mounts::virtual_mounts(&opts.root)).unwrap_or_default()
+        };
+        let (source, installed) = opts
+            .backend
+            .open(&opts.root, &opts.dbpath, &opts.sync_dbs)?;
+        let sync = if opts.foreign && (!opts.sync_dbs.is_empty() || !opts.backend.uses_sync_dbs()) {
+            source.available()?
+        } else {
+            HashSet::new()
+        };
+        for name in &opts.packages {
+            if !installed.iter().any(|pkg| &pkg.name == name) {
+                return Err(anyhow!("package {} is not installed", name));
+            }
+        }
+        Ok(Self {
+            source,
+            installed,
+            sync,
+            ignore,
+            ignore_pkgs,
+            ignore_sources,
+            no_extract: Patterns::new(&opts.no_extract)?,
+            no_upgrade: Patterns::new(&opts.no_upgrade)?,
+            cache,
+            repos,
+            manifest,
+            packages,
+            virtual_mounts,
+            progress,
+            opts,
+        })
+    }
+
+    /// The root dir, always ending in a slash.
+    pub fn root(&self) -> &str {
+        &self.opts.root
+    }
+
+    // Takes the lock file, if any, logging an error instead of failing when it
+    // cannot be taken.
+    fn lock(&self) -> Option<Lock> {
+        let path = self.opts.lock.as_ref()?;
+        filter_map_error(Lock::acquire(path).map_err(|err| format!("{:#}", err)))
+    }
+
+    // Whether a diff limited to the prefixes and packages covers the whole
+    // root and all packages, rather than some paths, a depth or some packages.
+    fn full_scan(&self, prefixes: &[String], packages: &[String]) -> bool {
+        prefixes.is_empty() && self.opts.max_depth.is_none() && packages.is_empty()
+    }
+
+    /// Checks if a path relative to the root is under one of the prefixes the
+    /// scan is limited to, and within the maximum depth.
+    pub fn in_scope(&self, path: &str) -> bool {
+        self.within(&self.opts.prefixes, path)
+    }
+
+    // Like in_scope, but for the given prefixes.
+    fn within(&self, prefixes: &[String], path: &str) -> bool {
+        if matches!(self.opts.max_depth, Some(max) if depth(path) > max) {
+            return false;
+        }
+        prefixes.is_empty() || prefixes.iter().any(|p| under(p, path))
+    }
+
+    /// Maps the paths of all installed package files, relative to the root, to
+    /// the name of the package owning them.
+    pub fn owners(&self) -> HashMap<String, String> {
+        let mut owners = HashMap::new();
+        for pkg in &self.installed {
+            for f in &pkg.files {
+                owners.insert(f.clone(), pkg.name.clone());
+            }
+        }
+        owners
+    }
+
+    // Finds an installed package by name.
+    fn package(&self, name: &str) -> Result<&Package> {
+        self.installed
+            .iter()
+            .find(|pkg| pkg.name == name)
+            .ok_or_else(|| anyhow!("package {} is not installed", name))
+    }
+
+    // Lists the files in an ignore dir in name order.
+    fn ignore_files(dir: &str) -> Result<Vec<PathBuf>> {
+        let mut files = std::fs::read_dir(dir)
+            .with_context(|| format!("failed to read directory {}", dir))?
+            .map(|de| de.map(|de| de.path()))
+            .collect::<std::io::Result<Vec<_>>>()
+            .with_context(|| format!("failed to read directory {}", dir))?;
+        files.sort();
+        Ok(files)
+    }
+
+    // Reads the ignore patterns along with where they came from: the files
+    // in the ignore dir in name order, then those in the user's ignore dir,
+    // then the --ignore-from files, with - for stdin, and last the --exclude
+    // patterns, so each can re-include paths ignored by the ones before.
+    fn ignore_sources(opts: &Options) -> Result<Vec<(PathBuf, String)>> {
+        let mut files = Self::ignore_files(&opts.ignore)?;
+        if let Some(dir) = opts
+            .user_ignore
+            .as_deref()
+            .filter(|d| Path::new(d).is_dir())
+        {
+            files.extend(Self::ignore_files(dir)?);
+        }
+        files.extend(opts.ignore_from.iter().map(PathBuf::from));
+        let mut sources = vec![];
+        for path in files {
+            let contents = if path == Path::new("-") {
+                let mut contents = String::new();
+                std::io::Read::read_to_string(&mut std::io::stdin(), &mut contents)
+                    .context("failed to read ignore patterns from stdin")?;
+                contents
+            } else {
+                std::fs::read_to_string(&path)
+                    .with_context(|| format!("failed to read {}", path.display()))?
+            };
+            sources.push((path, contents));
+        }
+        if !opts.excludes.is_empty() {
+            sources.push((PathBuf::from("--exclude"), opts.excludes.join("\n")));
+        }
+        Ok(sources)
+    }
+
+    // Ignore files use gitignore syntax and later patterns win, so a later
+    // file can re-include paths ignored by an earlier one. Lines of the form
+    // pkg:name instead ignore all files owned by a package. Patterns are
+    // anchored at the root being checked rather than at /, so the same
+    // ignore files work for a system mounted elsewhere.
+    fn build_gitignore(
+        sources: &[(PathBuf, String)],
+        root: &str,
+    ) -> Result<(Gitignore, HashSet<String>)> {
+        let mut gi_builder = GitignoreBuilder::new(root);
+        let mut pkgs = HashSet::new();
+        for (path, contents) in sources {
+            for line in contents.lines() {
+                match line.trim().strip_prefix("pkg:") {
+                    Some(pkg) => {
+                        pkgs.insert(pkg.trim().to_string());
+                    }
+                    None => {
+                        gi_builder.add_line(Some(path.clone()), line)?;
+                    }
+                }
+            }
+        }
+        Ok((gi_builder.build()?, pkgs))
+    }
+
+    // Lists the repo files as their path relative to the repo dirs along with
+    // the full path in the last repo dir containing them. Files in the host
+    // specific dir of a repo override the rest of the repo.
+    fn repo_files(&self) -> Vec<(String, String)> {
+        let mut files = BTreeMap::new();
+        for repo in &self.repos {
+            if self.opts.repo_git && git::is_work_tree(repo) {
+                let tracked = match git::ls_files(repo) {
+                    Ok(tracked) => tracked,
+                    Err(err) => {
+                        error!("{:#}", err);
+                        continue;
+                    }
+                };
+                for rel in tracked {
+                    let top = rel.split('/').next().unwrap_or_default();
+                    if top == HOSTS_DIR || top == MANIFEST_FILE || top == PACKAGES_FILE {
+                        continue;
+                    }
+                    let path = format!("{}{}", repo, rel);
+                    let rel = rel.strip_suffix(secret::SUFFIX).unwrap_or(&rel);
+                    files.insert(rel.to_string(), path);
+                }
+                continue;
+            }
+            let repo_len = repo.len();
+            let walk = WalkDir::new(repo).into_iter().filter_entry(|de| {
+                de.depth() != 1
+                    || (de.file_name() != HOSTS_DIR
+                        && de.file_name() != MANIFEST_FILE
+                        && de.file_name() != PACKAGES_FILE)
+            });
+            for de in walk.filter_map(filter_map_error) {
+                if de.file_type().is_dir() {
+                    continue;
+                }
+                let path = de.path().to_string_lossy();
+                let rel = &path[repo_len..];
+                let rel = rel.strip_suffix(secret::SUFFIX).unwrap_or(rel);
+                files.insert(rel.to_string(), path.to_string());
+            }
+        }
+        files.into_iter().collect()
+    }
+
+    /// Finds the full path of a repo file, relative to the repo dirs, in the
+    /// last repo dir containing it either as is or encrypted.
+    pub fn repo_path(&self, path: &str) -> Option<String> {
+        self.repos
+            .iter()
+            .rev()
+            .flat_map(|repo| {
+                vec![
+                    format!("{}{}", repo, path),
+                    format!("{}{}{}", repo, path, secret::SUFFIX),
+                ]
+            })
+            .find(|src| std::fs::symlink_metadata(src).is_ok())
+    }
+
+    /// Lists what apply would do to each repo file, relative to the repo
+    /// dirs, whose contents or recorded metadata differ from the root, sorted
+    /// by path.
+    pub fn plan(&self) -> Vec<(Action, String)> {
+        let root = &self.opts.root;
+        let algo = self.opts.hash;
+        let cache = &self.cache;
+        let identity = &self.opts.age_identity;
+        let manifest = &self.manifest;
+        let mut plan: Vec<(Action, String)> = self
+            .repo_files()
+            .into_par_iter()
+            .filter_map(|(p, src)| {
+                let dst = format!("{}{}", root, p);
+                let link = std::fs::read_link(&src).ok();
+                let md = match std::fs::symlink_metadata(&dst) {
+                    Ok(md) => md,
+                    Err(_) => return Some((link.map_or(Action::Create, Action::Link), p)),
+                };
+                if repo_file_differs(cache, algo, identity, &src, &dst)? {
+                    return Some((link.map_or(Action::Overwrite, Action::Link), p));
+                }
+                match manifest.get(&p) {
+                    Some(meta) if md.is_file() && FileMeta::new(&md) != meta => {
+                        Some((Action::Chmod(meta), p))
+                    }
+                    _ => None,
+                }
+            })
+            .collect();
+        plan.sort_by(|a, b| a.1.cmp(&b.1));
+        if let Err(err) = self.cache.save(false) {
+            error!("{:#}", err);
+        }
+        plan
+    }
+
+    /// Lists the files, relative to the root, that were in the repo when
+    /// record_repo_files last wrote state but no longer are, and still exist
+    /// under the root.
+    pub fn removed_repo_files(&self, state: &str) -> Result<Vec<String>> {
+        let last: Vec<String> = match std::fs::read(state) {
+            Ok(contents) => serde_json::from_slice(&contents)
+                .with_context(|| format!("failed to parse {}", state))?,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(vec![]),
+            Err(err) => return Err(err).with_context(|| format!("failed to read {}", state)),
+        };
+        let current: HashSet<String> = self.repo_files().into_iter().map(|(p, _)| p).collect();
+        Ok(last
+            .into_iter()
+            .filter(|p| !current.contains(p))
+            .filter(|p| std::fs::symlink_metadata(format!("{}{}", self.opts.root, p)).is_ok())
+            .collect())
+    }
+
+    /// Writes the files currently in the repo to state, so files removed from
+    /// the repo later on can be found.
+    pub fn record_repo_files(&self, state: &str) -> Result<()> {
+        let paths: Vec<String> = self.repo_files().into_iter().map(|(p, _)| p).collect();
+        if let Some(dir) = Path::new(state).parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        std::fs::write(state, serde_json::to_vec(&paths)?)
+            .with_context(|| format!("failed to write {}", state))
+    }
+
+    /// Removes a file, relative to the root.
+    pub fn remove_file(&self, path: &str) -> Result<()> {
+        let dst = format!("{}{}", self.opts.root, path);
+        std::fs::remove_file(&dst).with_context(|| format!("failed to remove {}", dst))
+    }
+
+    /// Sets the metadata recorded in the repo for a file, relative to the
+    /// repo dirs, on the root.
+    pub fn apply_metadata(&self, path: &str) -> Result<()> {
+        let meta = self
+            .manifest
+            .get(path)
+            .ok_or_else(|| anyhow!("{} has no recorded metadata", path))?;
+        meta.apply(Path::new(&format!("{}{}", self.opts.root, path)))
+    }
+
+    /// Copies a repo file, relative to the repo dirs, onto the root.
+    pub fn apply_file(&self, path: &str) -> Result<()> {
+        let src = self
+            .repo_path(path)
+            .ok_or_else(|| anyhow!("{} is not in the repo", path))?;
+        let dst = format!("{}{}", self.opts.root, path);
+        if let Some(dir) = Path::new(&dst).parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        let previous = std::fs::symlink_metadata(&dst)
+            .ok()
+            .filter(|md| md.is_file())
+            .map(|md| FileMeta::new(&md));
+        if let Ok(target) = std::fs::read_link(&src) {
+            if std::fs::symlink_metadata(&dst).is_ok() {
+                std::fs::remove_file(&dst).with_context(|| format!("failed to remove {}", dst))?;
+            }
+            std::os::unix::fs::symlink(&target, &dst)
+                .with_context(|| format!("failed to symlink {} to {}", dst, target.display()))?;
+            return Ok(());
+        }
+        if src.ends_with(secret::SUFFIX) {
+            // new files are only readable by the owner since they hold secrets
+            let contents = secret::decrypt(&self.opts.age_identity, &src)?;
+            std::fs::OpenOptions::new()
+                .write(true)
+                .create(true)
+                .truncate(true)
+                .mode(0o600)
+                .open(&dst)
+                .and_then(|mut f| f.write_all(&contents))
+                .with_context(|| format!("failed to write {}", dst))?;
+        } else {
+            std::fs::copy(&src, &dst)
+                .with_context(|| format!("failed to copy {} to {}", src, dst))?;
+            if self.opts.xattrs {
+                xattrs::copy_xattrs(&src, &dst)?;
+            }
+        }
+        // recorded metadata wins, otherwise keep that of the replaced file
+        if let Some(meta) = self.manifest.get(path).or(previous) {
+            meta.apply(Path::new(&dst))?;
+        }
+        Ok(())
+    }
+
+    /// Replaces a modified or deleted packaged file, relative to the root,
+    /// with the copy in the package, keeping the mode and owner of the file
+    /// it replaces, or those the package records for a deleted file. The
+    /// copy is written next to the file and renamed over it, so a symlink in
+    /// its place is replaced instead of followed.
+    pub fn restore(&self, entry: &Entry) -> Result<()> {
+        let contents = self.original(entry)?.ok_or_else(|| {
+            anyhow!(
+                "no original for {}, the package may not be in the package cache",
+                entry.path
+            )
+        })?;
+        let dst = format!("{}{}", self.opts.root, entry.path);
+        if let Some(dir) = Path::new(&dst).parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        let meta = match std::fs::symlink_metadata(&dst) {
+            Ok(md) if md.is_file() => FileMeta::new(&md),
+            _ => self.packaged_meta(&entry.path)?,
+        };
+        let tmp = format!("{}.archdiff-tmp", dst);
+        // create_new does not follow a symlink left at the temp path, and the
+        // contents stay private until the mode is set
+        match std::fs::remove_file(&tmp) {
+            Err(err) if err.kind() != std::io::ErrorKind::NotFound => {
+                return Err(err).with_context(|| format!("failed to remove {}", tmp))
+            }
+            _ => (),
+        }
+        let written = std::fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .mode(0o600)
+            .open(&tmp)
+            .and_then(|mut f| f.write_all(&contents))
+            .with_context(|| format!("failed to write {}", tmp))
+            .and_then(|_| meta.apply(Path::new(&tmp)))
+            .and_then(|_| {
+                std::fs::rename(&tmp, &dst)
+                    .with_context(|| format!("failed to rename {} to {}", tmp, dst))
+            });
+        if written.is_err() {
+            let _ = std::fs::remove_file(&tmp);
+        }
+        written
+    }
+
+    // The mode and owner a package records for a file, relative to the root,
+    // falling back to root and 0644 like the mtree defaults where it records
+    // none.
+    fn packaged_meta(&self, path: &str) -> Result<FileMeta> {
+        let mut meta = FileMeta {
+            mode: 0o644,
+            uid: 0,
+            gid: 0,
+        };
+        let owner = self.owner(&Path::new(&self.opts.root).join(path))?;
+        let pkg = match owner.package {
+            Some(name) => self.package(&name)?,
+            None => return Ok(meta),
+        };
+        let data = self.source.verify_data(pkg)?;
+        if let Some((_, e)) = data.iter().find(|(p, _)| p == path) {
+            meta.mode = e.mode.unwrap_or(meta.mode);
+            meta.uid = e.uid.unwrap_or(meta.uid);
+            meta.gid = e.gid.unwrap_or(meta.gid);
+        }
+        Ok(meta)
+    }
+
+    /// Ignores a path, relative to the root, from the next run on by adding
+    /// it to the local file in the ignore dir, returning that file.
+    pub fn ignore_path(&self, path: &str) -> Result<PathBuf> {
+        let file = Path::new(&self.opts.ignore).join(LOCAL_IGNORE_FILE);
+        std::fs::OpenOptions::new()
+            .append(true)
+            .create(true)
+            .open(&file)
+            .and_then(|mut f| writeln!(f, "/{}", escape_pattern(path)))
+            .with_context(|| format!("failed to write {}", file.display()))?;
+        Ok(file)
+    }
+
+    /// Copies a file under the root into the same relative location in the
+    /// last repo dir, returning the repo path. If encrypt is true the file is
+    /// encrypted for the age recipients.
+    pub fn adopt(&self, path: &Path, encrypt: bool) -> Result<PathBuf> {
+        let (src, rel) = self.resolve(path)?;
+        let md = std::fs::symlink_metadata(&src)
+            .with_context(|| format!("failed to stat {}", src.display()))?;
+        if !md.file_type().is_file() {
+            return Err(anyhow!("{} is not a regular file", src.display()));
+        }
+        let repo = self
+            .opts
+            .repo
+            .last()
+            .ok_or_else(|| anyhow!("no repo dir configured"))?;
+        let mut dst = Path::new(repo).join(&rel);
+        if encrypt {
+            let mut name = dst.into_os_string();
+            name.push(secret::SUFFIX);
+            dst = PathBuf::from(name);
+        }
+        if let Some(dir) = dst.parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        if encrypt {
+            secret::encrypt(&self.opts.age_recipients, &src, &dst)?;
+        } else {
+            std::fs::copy(&src, &dst).with_context(|| {
+                format!("failed to copy {} to {}", src.display(), dst.display())
+            })?;
+            if self.opts.xattrs {
+                xattrs::copy_xattrs(&src, &dst)?;
+            }
+        }
+        let mut manifest = Manifest::load(repo)?;
+        manifest.set(&rel.to_string_lossy(), FileMeta::new(&md));
+        manifest.save(repo)?;
+        if git::is_work_tree(repo) {
+            git::add(repo, &dst)?;
+            git::add(repo, &Path::new(repo).join(MANIFEST_FILE))?;
+        }
+        Ok(dst)
+    }
+
+    /// Commits the files staged by adopt, if the last repo dir is in a git
+    /// work tree.
+    pub fn commit_adopted(&self, message: &str) -> Result<()> {
+        match self.opts.repo.last() {
+            Some(repo) if git::is_work_tree(repo) => git::commit(repo, message),
+            _ => Ok(()),
+        }
+    }
+
+    /// Lists the repo dirs that are in git work trees with uncommitted
+    /// changes.
+    pub fn dirty_repos(&self) -> Result<Vec<String>> {
+        let mut dirty = vec![];
+        for repo in &self.opts.repo {
+            if git::is_work_tree(repo) && git::is_dirty(repo)? {
+                dirty.push(repo.clone());
+            }
+        }
+        Ok(dirty)
+    }
+
+    /// Finds the package owning a path under the root, and whether it is a
+    /// backup file or shadowed by a repo file.
+    pub fn owner(&self, path: &Path) -> Result<Owner> {
+        let (abs, rel) = self.resolve(path)?;
+        let rel = rel.to_string_lossy();
+        let dir = format!("{}/", rel);
+        let mut owner = Owner {
+            repo: self.repo_path(&rel).is_some(),
+            ..Owner::default()
+        };
+        for pkg in &self.installed {
+            let owned = pkg
+                .files
+                .iter()
+                .any(|f| *f == rel || (abs.is_dir() && *f == dir));
+            if owned {
+                owner.package = Some(pkg.name.clone());
+                owner.backup = pkg.backup.iter().any(|(b, _)| *b == rel);
+                break;
+            }
+        }
+        Ok(owner)
+    }
+
+    /// Describes the base file of a .pacnew or .pacsave file, relative to the
+    /// root, or returns None for other files.
+    pub fn pacfile(&self, path: &str) -> Result<Option<PacFile>> {
+        let base = match pacfile_base(path) {
+            Some((_, base)) => base,
+            None => return Ok(None),
+        };
+        let mut pacfile = PacFile {
+            base: base.to_string(),
+            ..PacFile::default()
+        };
+        for pkg in &self.installed {
+            if !pkg.files.iter().any(|f| f == base) {
+                continue;
+            }
+            pacfile.package = Some(pkg.name.clone());
+            if let Some((_, hash)) = pkg.backup.iter().find(|(b, _)| b == base) {
+                let fp = format!("{}{}", self.opts.root, base);
+                pacfile.modified =
+                    filter_map_error(self.cache.backup_modified(hash, &fp)).flatten();
+            }
+            break;
+        }
+        Ok(Some(pacfile))
+    }
+
+    // Finds the ignore pattern deciding on a path, from the ignore dir or
+    // the .archdiffignore files in the dirs above it.
+    fn pattern_match(&self, abs: &Path, is_dir: bool) -> Result<IgnoreMatch> {
+        let mut matcher = Matcher::new(&self.ignore);
+        for dir in abs
+            .ancestors()
+            .skip(1)
+            .filter(|d| d.starts_with(&self.opts.root))
+        {
+            matcher.add_dir(dir)?;
+        }
+        Ok(match matcher.matched(abs, is_dir, true) {
+            ignore::Match::None => IgnoreMatch::None,
+            ignore::Match::Ignore(glob) => IgnoreMatch::Ignored(matcher::describe(glob)),
+            ignore::Match::Whitelist(glob) => IgnoreMatch::Reincluded(matcher::describe(glob)),
+        })
+    }
+
+    /// Decides whether the diff ignores a path under the root, and why. A
+    /// path that does not exist is taken to be a dir if it ends with a slash.
+    pub fn ignore_match(&self, path: &Path) -> Result<IgnoreMatch> {
+        let (abs, _) = self.resolve(path)?;
+        let is_dir = match std::fs::symlink_metadata(&abs) {
+            Ok(md) => md.is_dir(),
+            Err(_) => path.to_string_lossy().ends_with('/'),
+        };
+        let m = self.pattern_match(&abs, is_dir)?;
+        if let IgnoreMatch::Ignored(_) = m {
+            return Ok(m);
+        }
+        match self.owner(path)?.package {
+            Some(name) if self.ignore_pkgs.contains(&name) => Ok(IgnoreMatch::Package(name)),
+            _ => Ok(m),
+        }
+    }
+
+    // The paths matched by each ignore pattern are recorded next to the hash
+    // cache, so they are only kept when caching is enabled.
+    fn ignore_stats_path(&self) -> Option<PathBuf> {
+        self.opts
+            .cache
+            .as_ref()
+            .map(|cache| Path::new(cache).with_file_name("ignore-matches.json"))
+    }
+
+    /// Lists the ignore patterns, in the order they are loaded,
+    /// along with how many paths each matched in the last scan.
+    pub fn ignore_patterns(&self) -> Result<Vec<IgnorePattern>> {
+        let stats = match self.ignore_stats_path() {
+            Some(path) => IgnoreStats::load(&path)?,
+            None => None,
+        };
+        let mut patterns = vec![];
+        for (file, contents) in &self.ignore_sources {
+            let from = file.to_string_lossy();
+            for (n, line) in contents.lines().enumerate() {
+                let pattern = line.trim_end();
+                if pattern.trim().is_empty() || pattern.starts_with('#') {
+                    continue;
+                }
+                let (kind, matched) = match pattern.trim().strip_prefix("pkg:") {
+                    Some(pkg) => (
+                        PatternKind::Package,
+                        stats
+                            .as_ref()
+                            .map(|s| s.packages.get(pkg.trim()).copied().unwrap_or(0)),
+                    ),
+                    None => (
+                        PatternKind::of(pattern),
+                        stats.as_ref().map(|s| {
+                            s.patterns
+                                .get(from.as_ref())
+                                .and_then(|p| p.get(pattern))
+                                .copied()
+                                .unwrap_or(0)
+                        }),
+                    ),
+                };
+                patterns.push(IgnorePattern {
+                    file: file.clone(),
+                    line: n + 1,
+                    pattern: pattern.to_string(),
+                    kind,
+                    dir_only: kind != PatternKind::Package && pattern.ends_with('/'),
+                    matched,
+                });
+            }
+        }
+        Ok(patterns)
+    }
+
+    /// Describes every decision made about a path under the root when
+    /// computing the diff, one per line.
+    pub fn explain(&self, path: &Path) -> Result<Vec<String>> {
+        let (abs, rel) = self.resolve(path)?;
+        let md = std::fs::symlink_metadata(&abs).ok();
+        let is_dir = matches!(&md, Some(md) if md.is_dir());
+        let mut lines = vec![];
+        match &md {
+            Some(md) => lines.push(format!("exists, {} bytes", md.len())),
+            None => lines.push("does not exist".to_string()),
+        }
+
+        match self.pattern_match(&abs, is_dir)? {
+            IgnoreMatch::Ignored(pattern) => lines.push(format!("ignored by {}", pattern)),
+            IgnoreMatch::Reincluded(pattern) => lines.push(format!("re-included by {}", pattern)),
+            _ => lines.push("not matched by any ignore pattern".to_string()),
+        }
+
+        let owner = self.owner(path)?;
+        let rel = rel.to_string_lossy();
+        let pkg = match &owner.package {
+            Some(name) => {
+                lines.push(format!("owned by package {}", name));
+                if self.ignore_pkgs.contains(name) {
+                    lines.push(format!("package {} is ignored by a pkg: line", name));
+                }
+                Some(self.package(name)?)
+            }
+            None => {
+                lines.push("not owned by any package".to_string());
+                None
+            }
+        };
+        if self.no_extract.is_match(&rel) {
+            lines.push("matches NoExtract".to_string());
+        }
+        if self.no_upgrade.is_match(&rel) {
+            lines.push("matches NoUpgrade".to_string());
+        }
+
+        let fp = abs.to_string_lossy();
+        if let Some(pkg) = pkg {
+            if let Some((_, hash)) = pkg.backup.iter().find(|(b, _)| *b == rel) {
+                lines.push(match hash {
+                    BackupHash::Recorded(hash) => match HashAlgo::of_digest(hash) {
+                        Some(algo) => {
+                            let actual = self.cache.hash(algo, &fp);
+                            format!(
+                                "backup file, expected {} {}, actual {} {}",
+                                algo.name(),
+                                hash,
+                                algo.name(),
+                                actual.as_deref().unwrap_or("unknown")
+                            )
+                        }
+                        None => format!("backup file, expected {} in an unknown hash", hash),
+                    },
+                    BackupHash::Unmodified => {
+                        "backup file, unmodified according to the package manager".to_string()
+                    }
+                    BackupHash::Modified => {
+                        "backup file, modified according to the package manager".to_string()
+                    }
+                    BackupHash::Unreadable => {
+                        "backup file, unreadable to the package manager".to_string()
+                    }
+                    BackupHash::Unknown => "backup file, with no hash to compare".to_string(),
+                });
+            }
+            if self.opts.mtree || self.opts.metadata {
+                let mtree = self.source.verify_data(pkg)?;
+                if let Some((_, entry)) = mtree.iter().find(|(p, _)| *p == rel) {
+                    if let Some((algo, expected)) = entry.digest() {
+                        let actual = self.cache.hash(algo, &fp);
+                        lines.push(format!(
+                            "mtree expects {} {}, actual {} {}",
+                            algo.name(),
+                            expected,
+                            algo.name(),
+                            actual.as_deref().unwrap_or("unknown")
+                        ));
+                    }
+                    if let Some(link) = &entry.link {
+                        lines.push(format!("mtree expects a symlink to {}", link));
+                    }
+                }
+            }
+        }
+
+        if let Some(pacfile) = self.pacfile(&rel)? {
+            let package = match &pacfile.package {
+                Some(name) => format!("owned by package {}", name),
+                None => "not owned by any package".to_string(),
+            };
+            let modified = match pacfile.modified {
+                Some(true) => ", locally modified",
+                Some(false) => ", not modified",
+                None => "",
+            };
+            lines.push(format!(
+                "copy of {}{}, which is {}{}",
+                self.opts.root, pacfile.base, package, modified
+            ));
+        }
+
+        if let Some(src) = self.repo_path(&rel) {
+            let algo = self.opts.hash;
+            lines.push(format!(
+                "repo file {}, expected {} {}, actual {} {}",
+                src,
+                algo.name(),
+                self.cache.hash(algo, &src).as_deref().unwrap_or("unknown"),
+                algo.name(),
+                self.cache.hash(algo, &fp).as_deref().unwrap_or("unknown")
+            ));
+        } else {
+            lines.push("no repo file".to_string());
+        }
+        Ok(lines)
+    }
+
+    /// Archives the entries that exist under the root, along with their mode,
+    /// owner and xattrs, into a tar file compressed according to its suffix,
+    /// such as .tar.zst. Returns the number of paths archived.
+    pub fn export(&self, entries: &[Entry], out: &str) -> Result<usize> {
+        let paths: Vec<&str> = entries
+            .iter()
+            .filter(|e| !matches!(e.category, Category::Deleted | Category::NoExtract))
+            .map(|e| e.path.as_str())
+            .collect();
+        let mut child = std::process::Command::new("bsdtar")
+            .arg("-c")
+            .arg("--auto-compress")
+            .arg("--no-recursion")
+            .arg("-f")
+            .arg(out)
+            .arg("-C")
+            .arg(&self.opts.root)
+            .arg("--null")
+            .arg("-T")
+            .arg("-")
+            .stdin(std::process::Stdio::piped())
+            .spawn()
+            .context("failed to run bsdtar")?;
+        if let Some(mut stdin) = child.stdin.take() {
+            for path in &paths {
+                write!(stdin, "{}\0", path)?;
+            }
+        }
+        let status = child.wait()?;
+        if !status.success() {
+            return Err(anyhow!("failed to write {}: bsdtar {}", out, status));
+        }
+        Ok(paths.len())
+    }
+
+    /// Reads the original contents of a changed file: the repo copy for
+    /// modified repo files, and the copy in the package for modified or
+    /// deleted packaged files. Returns None for other categories, or if the package is no
+    /// longer in the package cache.
+    pub fn original(&self, entry: &Entry) -> Result<Option<Vec<u8>>> {
+        match entry.category {
+            Category::ModifiedRepo => {
+                let src = self
+                    .repo_path(&entry.path)
+                    .ok_or_else(|| anyhow!("{} is not in the repo", entry.path))?;
+                let contents = if src.ends_with(secret::SUFFIX) {
+                    secret::decrypt(&self.opts.age_identity, &src)?
+                } else {
+                    std::fs::read(&src).with_context(|| format!("failed to read {}", src))?
+                };
+                Ok(Some(contents))
+            }
+            Category::Modified
+            | Category::ModifiedBackup
+            | Category::NoUpgrade
+            | Category::Deleted
+            | Category::NoExtract => {
+                let owners = self.owner(&Path::new(&self.opts.root).join(&entry.path))?;
+                let pkg = match owners.package {
+                    Some(name) => self.package(&name)?,
+                    None => return Ok(None),
+                };
+                let archive = match self.package_file(pkg) {
+                    Some(archive) => archive,
+                    None => return Ok(None),
+                };
+                // pacman depends on libarchive, so bsdtar is always available
+                let output = std::process::Command::new("bsdtar")
+                    .arg("-xOf")
+                    .arg(&archive)
+                    .arg(&entry.path)
+                    .output()
+                    .context("failed to run bsdtar")?;
+                if !output.status.success() {
+                    return Err(anyhow!(
+                        "failed to extract {} from {}: {}",
+                        entry.path,
+                        archive.display(),
+                        String::from_utf8_lossy(&output.stderr).trim()
+                    ));
+                }
+                Ok(Some(output.stdout))
+            }
+            _ => Ok(None),
+        }
+    }
+
+    /// Merges a backup file on the system with its repo copy, using the copy
+    /// in the package as the common ancestor, like diff3 -m. Returns the
+    /// merged contents and whether they contain conflict markers.
+    pub fn merge(&self, path: &Path) -> Result<(Vec<u8>, bool)> {
+        let (abs, rel) = self.resolve(path)?;
+        let rel = rel.to_string_lossy().into_owned();
+        let entry = |category| Entry {
+            category,
+            path: rel.clone(),
+        };
+        let pristine = self
+            .original(&entry(Category::ModifiedBackup))?
+            .ok_or_else(|| {
+                anyhow!(
+                    "no packaged copy of {}, the package may not be in the package cache",
+                    abs.display()
+                )
+            })?;
+        let repo = self
+            .original(&entry(Category::ModifiedRepo))?
+            .unwrap_or_default();
+        let tmp = TempDir::new()?;
+        let pristine_path = tmp.write("package", &pristine)?;
+        let repo_path = tmp.write("repo", &repo)?;
+        let output = std::process::Command::new("diff3")
+            .arg("-m")
+            .arg("-L")
+            .arg(format!("{} (system)", abs.display()))
+            .arg("-L")
+            .arg(format!("{} (package)", abs.display()))
+            .arg("-L")
+            .arg(format!("{} (repo)", abs.display()))
+            .arg(&abs)
+            .arg(&pristine_path)
+            .arg(&repo_path)
+            .output();
+        let output = output.context("failed to run diff3")?;
+        // diff3 exits with 1 if there are conflicts and 2 if it failed
+        match output.status.code() {
+            Some(0) => Ok((output.stdout, false)),
+            Some(1) => Ok((output.stdout, true)),
+            _ => Err(anyhow!(
+                "failed to merge {}: {}",
+                abs.display(),
+                String::from_utf8_lossy(&output.stderr).trim()
+            )),
+        }
+    }
+
+    // Finds the archive of an installed package in the package cache.
+    fn package_file(&self, pkg: &Package) -> Option<PathBuf> {
+        let prefix = format!("{}-{}-", pkg.name, pkg.version);
+        for dir in &self.opts.pkg_cache_dirs {
+            let entries = match std::fs::read_dir(dir) {
+                Ok(entries) => entries,
+                Err(_) => continue,
+            };
+            for de in entries.filter_map(|de| de.ok()) {
+                let name = de.file_name().to_string_lossy().into_owned();
+                if name.starts_with(&prefix) && name.contains(".pkg.tar") && !name.ends_with(".sig")
+                {
+                    return Some(de.path());
+                }
+            }
+        }
+        None
+    }
+
+    /// Records the entries along with the hash and metadata of their files.
+    pub fn snapshot(&self, entries: Vec<Entry>) -> Snapshot {
+        let root = &self.opts.root;
+        let cache = &self.cache;
+        let algo = self.opts.hash;
+        let mut entries: Vec<SnapshotEntry> = entries
+            .into_par_iter()
+            .map(|e| {
+                let fp = format!("{}{}", root, e.path);
+                let md = std::fs::symlink_metadata(&fp).ok();
+                let hash = match &md {
+                    Some(md) if md.is_file() && !cache.too_large(md.len()) => cache.hash(algo, &fp),
+                    _ => None,
+                };
+                SnapshotEntry {
+                    path: e.path,
+                    category: e.category,
+                    hash,
+                    size: md.as_ref().map(|md| md.size()),
+                    mode: md.as_ref().map(|md| md.mode()),
+                    uid: md.as_ref().map(|md| md.uid()),
+                    gid: md.as_ref().map(|md| md.gid()),
+                    mtime: md.as_ref().map(|md| md.mtime()),
+                }
+            })
+            .collect();
+        entries.sort_by(|a, b| a.path.cmp(&b.path));
+        if let Err(err) = self.cache.save(false) {
+            error!("{:#}", err);
+        }
+        let time = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .unwrap_or_default()
+            .as_secs();
+        Snapshot {
+            host: filter_map_error(hostname()).unwrap_or_default(),
+            root: self.opts.root.clone(),
+            hash: algo.name().to_string(),
+            time,
+            entries,
+        }
+    }
+
+    /// Filters the entries down to those that are new or changed since the
+    /// snapshot saved in the state file, and saves a new snapshot there.
+    pub fn since_last_run(&self, entries: Vec<Entry>, state: &str) -> Result<Vec<Entry>> {
+        let _lock = self.lock();
+        let current = self.snapshot(entries);
+        let last = match std::fs::metadata(state) {
+            Ok(_) => Some(Snapshot::load(state)?),
+            Err(_) => None,
+        };
+        let changes = match last {
+            // a different hash means nothing can be compared
+            Some(last) if last.hash == current.hash => last.compare(&current)?,
+            _ => current
+                .entries
+                .iter()
+                .cloned()
+                .map(snapshot::Change::Added)
+                .collect(),
+        };
+        if let Some(dir) = Path::new(state).parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        current.save(state)?;
+        Ok(changes
+            .into_iter()
+            .filter_map(|c| match c {
+                snapshot::Change::Added(e) | snapshot::Change::Changed(_, e) => Some(Entry {
+                    category: e.category,
+                    path: e.path,
+                }),
+                snapshot::Change::Removed(_) => None,
+            })
+            .collect())
+    }
+
+    /// Lists the files archdiff writes itself while diffing: the hash cache,
+    /// the ignore stats and the lock, along with the temporary files they are
+    /// written through. Changes to them say nothing about the system, so a
+    /// Watcher should drop them.
+    pub fn own_files(&self) -> Vec<PathBuf> {
+        let mut files = vec![];
+        if let Some(cache) = &self.opts.cache {
+            files.push(PathBuf::from(cache));
+            files.push(PathBuf::from(format!("{}.tmp", cache)));
+        }
+        if let Some(stats) = self.ignore_stats_path() {
+            files.push(stats.with_extension("json.tmp"));
+            files.push(stats);
+        }
+        if let Some(lock) = &self.opts.lock {
+            files.push(PathBuf::from(lock));
+        }
+        files
+    }
+
+    /// Lists the directories that affect the diff: those under the root that
+    /// are not ignored, the repo directories and the local package database.
+    pub fn watch_dirs(&self) -> Vec<PathBuf> {
+        let mut matcher = Matcher::new(&self.ignore);
+        let virtual_mounts = &self.virtual_mounts;
+        let mut dirs: Vec<PathBuf> = WalkDir::new(&self.opts.root)
+            .same_file_system(self.opts.one_file_system)
+            .into_iter()
+            .filter_entry(|de| {
+                if !de.file_type().is_dir()
+                    || virtual_mounts.contains(de.path())
+                    || matcher.is_ignored(de.path(), true, false)
+                {
+                    return false;
+                }
+                filter_map_error(matcher.add_dir(de.path()));
+                true
+            })
+            .filter_map(filter_map_error)
+            .map(|de| de.into_path())
+            .collect();
+        for repo in &self.repos {
+            dirs.extend(
+                WalkDir::new(repo)
+                    .into_iter()
+                    .filter_map(filter_map_error)
+                    .filter(|de| de.file_type().is_dir())
+                    .map(|de| de.into_path()),
+            );
+        }
+        dirs.push(Path::new(&self.opts.dbpath).join("local"));
+        dirs
+    }
+
+    // Resolves a path against the current dir, returning it along with the
+    // path relative to the root.
+    fn resolve(&self, path: &Path) -> Result<(PathBuf, PathBuf)> {
+        let abs = std::env::current_dir()?.join(path);
+        let rel = abs
+            .strip_prefix(&self.opts.root)
+            .map_err(|_| anyhow!("{} is not under root {}", abs.display(), self.opts.root))?
+            .to_path_buf();
+        Ok((abs, rel))
+    }
+
+    /// Lists the installed packages that are not in any sync database, if
+    /// the foreign option is set. Packages ignored by a pkg: line are left
+    /// out.
+    pub fn foreign_packages(&self) -> HashSet<String> {
+        if !self.opts.foreign {
+            return HashSet::new();
+        }
+        if self.opts.sync_dbs.is_empty() && self.opts.backend.uses_sync_dbs() {
+            warn!("no sync databases in pacman.conf, cannot find foreign packages");
+            return HashSet::new();
+        }
+        self.installed
+            .iter()
+            .filter(|pkg| !self.ignore_pkgs.contains(&pkg.name))
+            .filter(|pkg| !self.sync.contains(&pkg.name))
+            .map(|pkg| pkg.name.clone())
+            .collect()
+    }
+
+    /// Computes the package differences, returning nothing if the scan is
+    /// limited to prefixes or packages. If the repo has a package list, explicitly
+    /// installed packages that are not listed and listed packages that are
+    /// not installed are reported. A listed group covers all its installed
+    /// packages, and is missing if none of them are installed. Packages
+    /// ignored by a pkg: line are never unlisted. Foreign packages are
+    /// reported as found by foreign_packages, and with the orphans option,
+    /// dependencies that nothing requires or optionally uses, like
+    /// pacman -Qdt.
+    pub fn package_diff(&self) -> Vec<PackageEntry> {
+        if !self.opts.prefixes.is_empty() || !self.opts.packages.is_empty() {
+            return vec![];
+        }
+        let mut entries: Vec<PackageEntry> = self
+            .foreign_packages()
+            .into_iter()
+            .map(|name| PackageEntry {
+                category: PackageCategory::Foreign,
+                name,
+            })
+            .collect();
+        if self.opts.orphans {
+            entries.extend(
+                self.installed
+                    .iter()
+                    .filter(|pkg| pkg.reason == Reason::Depend)
+                    .filter(|pkg| !self.ignore_pkgs.contains(&pkg.name))
+                    .filter(|pkg| !pkg.is_required(&self.installed))
+                    .map(|pkg| PackageEntry {
+                        category: PackageCategory::Orphan,
+                        name: pkg.name.clone(),
+                    }),
+            );
+        }
+        if !self.packages.found() {
+            entries.sort();
+            return entries;
+        }
+        let mut installed = HashSet::new();
+        for pkg in &self.installed {
+            installed.insert(pkg.name.clone());
+            installed.extend(pkg.groups.iter().cloned());
+            let listed = self.packages.contains(&pkg.name)
+                || pkg.groups.iter().any(|g| self.packages.contains(g));
+            if !listed && pkg.reason == Reason::Explicit && !self.ignore_pkgs.contains(&pkg.name) {
+                entries.push(PackageEntry {
+                    category: PackageCategory::Unlisted,
+                    name: pkg.name.clone(),
+                });
+            }
+        }
+        entries.extend(
+            self.packages
+                .iter()
+                .filter(|name| !installed.contains(*name))
+                .map(|name| PackageEntry {
+                    category: PackageCategory::Missing,
+                    name: name.to_string(),
+                }),
+        );
+        entries.sort();
+        entries
+    }
+
+    /// Replaces the unpackaged files under a dir with a single entry for the
+    /// dir, ending in a slash, if no package owns the dir and nothing else
+    /// under it is in the repo or reported. Only dirs with more than one file
+    /// are collapsed, and the topmost dir is used. Returns the entries sorted
+    /// by path, along with the number of files in each collapsed dir.
+    pub fn collapse(&self, entries: Vec<Entry>) -> (Vec<Entry>, HashMap<String, usize>) {
+        let mut owned = HashSet::new();
+        for pkg in &self.installed {
+            for f in &pkg.files {
+                if f.ends_with('/') {
+                    owned.insert(f.clone());
+                }
+            }
+        }
+        let mut blocked = HashSet::new();
+        let others = entries
+            .iter()
+            .filter(|e| e.category != Category::Unpackaged)
+            .map(|e| e.path.clone());
+        for p in self.repo_files().into_iter().map(|(p, _)| p).chain(others) {
+            for (i, _) in p.match_indices('/') {
+                blocked.insert(p[..=i].to_string());
+            }
+        }
+        let top = |path: &str| -> Option<String> {
+            path.match_indices('/')
+                .map(|(i, _)| &path[..=i])
+                .find(|dir| !owned.contains(*dir) && !blocked.contains(*dir))
+                .map(str::to_string)
+        };
+        let mut counts: HashMap<String, usize> = HashMap::new();
+        let tops: Vec<Option<String>> = entries
+            .iter()
+            .map(|e| match e.category {
+                Category::Unpackaged => top(&e.path),
+                _ => None,
+            })
+            .collect();
+        for dir in tops.iter().flatten() {
+            *counts.entry(dir.clone()).or_default() += 1;
+        }
+        counts.retain(|_, n| *n > 1);
+        let mut collapsed: Vec<Entry> = entries
+            .into_iter()
+            .zip(tops)
+            .filter(|(_, dir)| !matches!(dir, Some(dir) if counts.contains_key(dir)))
+            .map(|(e, _)| e)
+            .collect();
+        collapsed.extend(counts.keys().map(|dir| Entry {
+            category: Category::Unpackaged,
+            path: dir.clone(),
+        }));
+        collapsed.sort_by(|a, b| a.path.cmp(&b.path));
+        (collapsed, counts)
+    }
+
+    /// Computes the differences between the root and the installed packages
+    /// and repo, sorted by path.
+    pub fn diff(&self) -> Vec<Entry> {
+        let all = Mutex::new(vec![]);
+        self.diff_stream(|e| all.lock().unwrap().push(e));
+        let mut all = all.into_inner().unwrap();
+        all.sort_by(|a, b| a.path.cmp(&b.path));
+        all
+    }
+
+    /// Recomputes the differences at the paths a Watcher reported, along with
+    /// the files of the packages owning them, and merges them into the last
+    /// diff. Changes to the package database, the repo or the ignore dir may
+    /// affect any path, so they recompute the whole diff.
+    pub fn update(&self, last: &[Entry], changed: &[PathBuf]) -> Vec<Entry> {
+        let owners = self.owners();
+        let mut paths = vec![];
+        let mut packages = HashSet::new();
+        for path in changed {
+            let global = path.starts_with(&self.opts.dbpath)
+                || path.starts_with(&self.opts.ignore)
+                || self.repos.iter().any(|r| path.starts_with(r));
+            let rel = match path.strip_prefix(&self.opts.root) {
+                Ok(rel) if !global => rel.to_string_lossy().into_owned(),
+                _ => return self.diff(),
+            };
+            // the patterns of an .archdiffignore file apply to its whole dir
+            if path.file_name() == Some(std::ffi::OsStr::new(matcher::IGNORE_FILE)) {
+                let dir = Path::new(&rel).parent().unwrap_or_else(|| Path::new(""));
+                paths.push(dir.to_string_lossy().into_owned());
+                continue;
+            }
+            for owned in [rel.clone(), format!("{}/", rel)].iter() {
+                if let Some(pkg) = owners.get(owned) {
+                    if self.opts.packages.is_empty() || self.opts.packages.contains(pkg) {
+                        packages.insert(pkg.clone());
+                    }
+                }
+            }
+            if self.in_scope(&rel) {
+                paths.push(rel);
+            }
+        }
+        if paths.iter().any(|p| p.is_empty()) {
+            return self.diff();
+        }
+        let paths = prefixes(&paths);
+        if paths.is_empty() && packages.is_empty() {
+            return last.to_vec();
+        }
+        let packages: Vec<String> = packages.into_iter().collect();
+        let files: HashSet<&str> = self
+            .installed
+            .iter()
+            .filter(|pkg| packages.contains(&pkg.name))
+            .flat_map(|pkg| pkg.files.iter().map(|f| f.trim_end_matches('/')))
+            .collect();
+        let mut all: Vec<Entry> = last
+            .iter()
+            .filter(|e| !paths.iter().any(|p| under(p, &e.path)) && !files.contains(&*e.path))
+            .cloned()
+            .collect();
+        let found = Mutex::new(vec![]);
+        // no prefixes would mean the whole root rather than none
+        if !paths.is_empty() {
+            self.diff_scoped(&paths, &self.opts.packages, |e| {
+                found.lock().unwrap().push(e)
+            });
+        }
+        if !packages.is_empty() {
+            self.diff_scoped(&self.opts.prefixes, &packages, |e| {
+                found.lock().unwrap().push(e)
+            });
+        }
+        all.extend(found.into_inner().unwrap());
+        all.sort();
+        all.dedup();
+        all.sort_by(|a, b| a.path.cmp(&b.path));
+        all
+    }
+
+    /// Computes the differences like diff, but calls emit with each entry as
+    /// soon as it is found instead of waiting for all the checks to finish.
+    /// Entries arrive in no particular order, possibly from multiple threads.
+    /// Once SIGINT is caught by interrupt::catch, the walk and the checks
+    /// stop and the files not checked yet are left out.
+    pub fn diff_stream<F: Fn(Entry) + Sync>(&self, emit: F) {
+        self.diff_scoped(&self.opts.prefixes, &self.opts.packages, emit)
+    }
+
+    // Computes the differences like diff_stream, limited to the prefixes and
+    // the packages given instead of those in the options.
+    fn diff_scoped<F: Fn(Entry) + Sync>(&self, prefixes: &[String], packages: &[String], emit: F) {
+        let _lock = self.lock();
+        let progress = &self.progress;
+        let unreadable = Skipped::new(self.opts.tolerant);
+        let skipped = &unreadable;
+        progress.reset();
+        let _reporter = if self.opts.progress {
+            Some(Reporter::start(progress.clone()))
+        } else {
+            None
+        };
+        let mut pkg_files = HashSet::new();
+        let mut pkg_backup_files = HashMap::new();
+        let mut verified = vec![];
+        let mut ignored_pkg_files = HashSet::new();
+        let mut ignore_stats = IgnoreStats::default();
+        // the files of the packages the diff is limited to, if any
+        let only_packages = !packages.is_empty();
+        let mut selected_files = HashSet::new();
+        for pkg in &self.installed {
+            if self.ignore_pkgs.contains(&pkg.name) {
+                ignored_pkg_files.extend(pkg.files.iter().cloned());
+                ignore_stats
+                    .packages
+                    .insert(pkg.name.clone(), pkg.files.len());
+                continue;
+            }
+            if only_packages {
+                if !packages.contains(&pkg.name) {
+                    continue;
+                }
+                selected_files.extend(pkg.files.iter().cloned());
+            }
+            if self.opts.mtree || self.opts.metadata {
+                verified.push(pkg);
+            }
+            pkg_files.extend(
+                pkg.files
+                    .iter()
+                    .filter(|f| self.within(prefixes, f))
+                    .cloned(),
+            );
+            pkg_backup_files.extend(
+                pkg.backup
+                    .iter()
+                    .filter(|(b, _)| self.within(prefixes, b))
+                    .cloned(),
+            );
+        }
+
+        // decompressing the mtree files is slow, so read them in parallel
+        let source = &self.source;
+        let mtree: HashMap<String, MtreeEntry> = verified
+            .into_par_iter()
+            .filter_map(|pkg| filter_map_error(source.verify_data(pkg)))
+            .flat_map_iter(|entries| entries)
+            .collect();
+
+        let root = &self.opts.root;
+        let cache = &self.cache;
+        let algo = self.opts.hash;
+        let root_len = self.opts.root.len();
+        let mut matcher = Matcher::new(&self.ignore);
+        let virtual_mounts = &self.virtual_mounts;
+
+        let (no_extract, no_upgrade) = (&self.no_extract, &self.no_upgrade);
+        let skip_mode = self.opts.skip_mode;
+        let report = |(category, path): (Category, String)| {
+            if let Some(category) =
+                skip_category(no_extract, no_upgrade, skip_mode, category, &path)
+            {
+                emit(Entry { category, path })
+            }
+        };
+        let mut packaged = HashSet::new();
+        let mut metadata = vec![];
+        let mut capable = HashSet::new();
+
+        // untracked files on disk, under each prefix or the whole root, which
+        // are not looked for when the diff is limited to packages
+        let starts: Vec<String> = if only_packages {
+            vec![]
+        } else if prefixes.is_empty() {
+            vec![root.clone()]
+        } else {
+            prefixes.iter().map(|p| format!("{}{}", root, p)).collect()
+        };
+        for start in &starts {
+            let max_depth = match self.opts.max_depth {
+                Some(max) => max.saturating_sub(depth(&start[root_len..])),
+                None => usize::MAX,
+            };
+            let start = Path::new(start);
+            // the ignore files in the dirs above a prefix apply to it too
+            let mut above: Vec<&Path> = start
+                .ancestors()
+                .skip(1)
+                .take_while(|dir| dir.starts_with(root))
+                .collect();
+            above.reverse();
+            for dir in above {
+                filter_map_error(matcher.add_dir(dir));
+            }
+            if start != Path::new(root) && matcher.is_ignored(start, start.is_dir(), true) {
+                debug!("ignoring {}", start.display());
+                continue;
+            }
+            // a prefix that is gone has nothing untracked to walk, while its
+            // packaged files are still reported as deleted below
+            if matches!(std::fs::symlink_metadata(start),
+                Err(err) if err.kind() == std::io::ErrorKind::NotFound)
+            {
+                debug!("{} does not exist", start.display());
+                continue;
+            }
+            // set while filtering a dir whose contents are all ignored
+            let prune = Cell::new(false);
+            let mut walk = WalkDir::new(start)
+                .same_file_system(self.opts.one_file_system)
+                .max_depth(max_depth)
+                .into_iter()
+                .filter_entry(|de| {
+                    prune.set(false);
+                    let is_dir = de.file_type().is_dir();
+                    if is_dir && virtual_mounts.contains(de.path()) {
+                        debug!("skipping virtual filesystem {}", de.path().display());
+                        return false;
+                    }
+                    let m = matcher.matched(de.path(), is_dir, false);
+                    if let Some(glob) = m.inner() {
+                        ignore_stats.add(glob);
+                    }
+                    if let ignore::Match::Ignore(glob) = m {
+                        debug!(
+                            "ignoring {} by {}",
+                            de.path().display(),
+                            matcher::describe(glob)
+                        );
+                        return false;
+                    }
+                    if is_dir {
+                        trace!("walking {}", de.path().display());
+                        filter_map_error(matcher.add_dir(de.path()));
+                        prune.set(matcher.prunes(de.path()));
+                    }
+                    true
+                });
+            while let Some(r) = walk.next() {
+                if interrupt::interrupted() {
+                    break;
+                }
+                let de = match r {
+                    Ok(de) => de,
+                    Err(err) => {
+                        skipped.walk_error(err);
+                        continue;
+                    }
+                };
+                if de.file_type().is_dir() && prune.replace(false) {
+                    debug!(
+                        "skipping {}, everything in it is ignored",
+                        de.path().display()
+                    );
+                    walk.skip_current_dir();
+                }
+                progress.scanned();
+                let path = &de.path().to_string_lossy()[root_len..];
+                if de.file_type().is_dir() {
+                    if self.opts.metadata && mtree.contains_key(path) {
+                        metadata.push(path.to_string());
+                    }
+                    continue;
+                }
+                let removed = pkg_files.remove(path);
+                if !removed {
+                    if !ignored_pkg_files.contains(path) {
+                        let category = pacfile_base(path).map_or(Category::Unpackaged, |(c, _)| c);
+                        report((category, path.to_string()));
+                    }
+                    continue;
+                }
+                if self.opts.mtree && !pkg_backup_files.contains_key(path) {
+                    packaged.insert(path.to_string());
+                }
+                if self.opts.metadata {
+                    metadata.push(path.to_string());
+                }
+                if self.opts.xattrs && de.file_type().is_file() {
+                    capable.insert(path.to_string());
+                }
+            }
+        }
+
+        // the counts of a partial scan would be misleading, so they are only
+        // recorded after walking the whole root
+        let full_scan = self.full_scan(prefixes, packages);
+        if full_scan && !interrupt::interrupted() {
+            if let Some(path) = self.ignore_stats_path() {
+                filter_map_error(ignore_stats.save(&path));
+            }
+        }
+
+        // without a walk, the files of the selected packages are looked up
+        // directly, and those that are missing are left to be reported
+        if only_packages {
+            let mut found = vec![];
+            for path in &pkg_files {
+                if interrupt::interrupted() {
+                    break;
+                }
+                let fp = format!("{}{}", root, path);
+                let is_dir = path.ends_with('/');
+                if matcher.is_ignored(Path::new(&fp), is_dir, true) {
+                    continue;
+                }
+                let md = match std::fs::symlink_metadata(&fp) {
+                    Ok(md) => md,
+                    Err(_) => continue,
+                };
+                progress.scanned();
+                if is_dir {
+                    let dir = path.trim_end_matches('/');
+                    if self.opts.metadata && mtree.contains_key(dir) {
+                        metadata.push(dir.to_string());
+                    }
+                    continue;
+                }
+                found.push(path.clone());
+                if self.opts.mtree && !pkg_backup_files.contains_key(path) {
+                    packaged.insert(path.clone());
+                }
+                if self.opts.metadata {
+                    metadata.push(path.clone());
+                }
+                if self.opts.xattrs && md.file_type().is_file() {
+                    capable.insert(path.clone());
+                }
+            }
+            for path in found {
+                pkg_files.remove(&path);
+            }
+        }
+
+        // repo files that have been changed
+        let ignored = &matcher;
+        let mut repo_files = self.repo_files();
+        repo_files.retain(|(p, _)| {
+            !ignored_pkg_files.contains(p)
+                && self.within(prefixes, p)
+                && (!only_packages || selected_files.contains(p))
+        });
+        for (path, _) in &repo_files {
+            pkg_backup_files.remove(path);
+            packaged.remove(path);
+            capable.remove(path);
+        }
+        // the repo manifest takes precedence over mtree data
+        metadata.retain(|p| self.manifest.get(p).is_none());
+        let repo_checks = if self.opts.xattrs { 3 } else { 2 };
+        progress.to_check(
+            repo_files.len() * repo_checks
+                + packaged.len()
+                + metadata.len()
+                + capable.len()
+                + pkg_files.len()
+                + pkg_backup_files.len(),
+        );
+        let manifest = &self.manifest;
+        let identity = &self.opts.age_identity;
+        let mtree = &mtree;
+        let check_xattrs = self.opts.xattrs;
+        let report = &report;
+        let repo_files = &repo_files;
+        // the checks are independent, so run them all at once
+        rayon::scope(|s| {
+            if check_xattrs {
+                s.spawn(move |_| {
+                    repo_files
+                        .par_iter()
+                        .inspect(|_| progress.checked())
+                        .filter(|_| !interrupt::interrupted())
+                        .filter_map(|(p, src)| {
+                            let src = filter_map_error(xattrs::read_xattrs(src))?;
+                            let dst =
+                                filter_map_error(xattrs::read_xattrs(format!("{}{}", &root, p)))?;
+                            if src == dst {
+                                None
+                            } else {
+                                Some((Category::Xattrs, p.clone()))
+                            }
+                        })
+                        .for_each(report);
+                });
+            }
+            s.spawn(move |_| {
+                repo_files
+                    .par_iter()
+                    .inspect(|_| progress.checked())
+                    .filter(|_| !interrupt::interrupted())
+                    .filter_map(|(p, _)| {
+                        let expected = manifest.get(p)?;
+                        let dst = format!("{}{}", &root, p);
+                        let md = skipped.check(
+                            &dst,
+                            std::fs::symlink_metadata(&dst)
+                                .with_context(|| format!("failed to stat {}", dst)),
+                        )?;
+                        if FileMeta::new(&md) == expected {
+                            None
+                        } else {
+                            Some((Category::Metadata, p.clone()))
+                        }
+                    })
+                    .for_each(report);
+            });
+            s.spawn(move |_| {
+                repo_files
+                    .par_iter()
+                    .inspect(|_| progress.checked())
+                    .filter(|_| !interrupt::interrupted())
+                    .filter_map(|(p, src)| {
+                        let dst = format!("{}{}", &root, &p);
+                        if !repo_file_differs(cache, algo, identity, src, &dst)? {
+                            None
+                        } else {
+                            Some((Category::ModifiedRepo, p.clone()))
+                        }
+                    })
+                    .for_each(report);
+            });
+            // packaged files that have been changed
+            s.spawn(move |_| {
+                packaged
+                    .into_par_iter()
+                    .inspect(|_| progress.checked())
+                    .filter(|_| !interrupt::interrupted())
+                    .filter_map(|p| {
+                        let entry = mtree.get(&p)?;
+                        let fp = format!("{}{}", &root, &p);
+                        if entry.kind == "link" {
+                            let target = std::fs::read_link(&fp).ok();
+                            if target.as_deref() == entry.link.as_deref().map(Path::new) {
+                                return None;
+                            }
+                            return Some((Category::Modified, p));
+                        }
+                        if entry.kind != "file" {
+                            return None;
+                        }
+                        let md = skipped.check(
+                            &fp,
+                            std::fs::symlink_metadata(&fp)
+                                .with_context(|| format!("failed to stat {}", fp)),
+                        )?;
+                        if !md.file_type().is_file() {
+                            return None;
+                        }
+                        if matches!(entry.size, Some(size) if size != md.size()) {
+                            return Some((Category::Modified, p));
+                        }
+                        if entry.time == Some(md.mtime()) {
+                            return None;
+                        }
+                        if cache.too_large(md.size()) {
+                            // the size matches but the mtime does not
+                            debug!(
+                                "comparing {} by size and mtime only, it is too large to hash",
+                                fp
+                            );
+                            return Some((Category::Modified, p));
+                        }
+                        let (algo, expected) = entry.digest()?;
+                        let actual = skipped.check(&fp, cache.try_hash(algo, &fp))?;
+                        if expected == actual {
+                            None
+                        } else {
+                            Some((Category::Modified, p))
+                        }
+                    })
+                    .for_each(report);
+            });
+            // packaged files whose mode or owner changed
+            s.spawn(move |_| {
+                metadata
+                    .into_par_iter()
+                    .inspect(|_| progress.checked())
+                    .filter(|_| !interrupt::interrupted())
+                    .filter_map(|p| {
+                        let entry = mtree.get(&p)?;
+                        if entry.kind == "link" {
+                            return None;
+                        }
+                        let fp = format!("{}{}", &root, &p);
+                        let md = skipped.check(
+                            &fp,
+                            std::fs::symlink_metadata(&fp)
+                                .with_context(|| format!("failed to stat {}", fp)),
+                        )?;
+                        let changed = matches!(entry.mode, Some(mode) if mode != md.mode() & 0o7777)
+                            || matches!(entry.uid, Some(uid) if uid != md.uid())
+                            || matches!(entry.gid, Some(gid) if gid != md.gid());
+                        if changed {
+                            Some((Category::Metadata, p))
+                        } else {
+                            None
+                        }
+                    })
+                    .for_each(report);
+            });
+            // packaged files with capabilities, which mtree data does not record
+            s.spawn(move |_| {
+                capable
+                    .into_par_iter()
+                    .inspect(|_| progress.checked())
+                    .filter(|_| !interrupt::interrupted())
+                    .filter_map(|p| {
+                        let fp = format!("{}{}", &root, &p);
+                        if skipped.check(&fp, xattrs::has_capability(&fp))? {
+                            Some((Category::Capability, p))
+                        } else {
+                            None
+                        }
+                    })
+                    .for_each(report);
+            });
+            // deleted files from packages
+            s.spawn(move |_| {
+                pkg_files
+                    .into_par_iter()
+                    .inspect(|_| progress.checked())
+                    .filter(|_| !interrupt::interrupted())
+                    .filter_map(|p| {
+                        let fp = format!("{}{}", &root, &p);
+                        if ignored.is_ignored(Path::new(&fp), p.ends_with('/'), true) {
+                            None
+                        } else {
+                            match std::fs::metadata(&fp)
+                                .with_context(|| format!("failed to stat {}", fp))
+                            {
+                                // a file in an unreadable dir is not known to be deleted
+                                Err(err) if is_permission_denied(&err) => {
+                                    skipped.check(&fp, Err(err))
+                                }
+                                Err(_) => Some((Category::Deleted, p)),
+                                Ok(_) => None,
+                            }
+                        }
+                    })
+                    .for_each(report);
+            });
+            // backup files that have been changed
+            s.spawn(move |_| {
+                pkg_backup_files
+                    .into_par_iter()
+                    .inspect(|_| progress.checked())
+                    .filter(|_| !interrupt::interrupted())
+                    .filter_map(|(p, expected_hash)| {
+                        let fp = format!("{}{}", &root, &p);
+                        if ignored.is_ignored(Path::new(&fp), false, true) {
+                            None
+                        } else {
+                            // package managers record hashes for backup files, but
+                            // not sizes to compare large files by instead
+                            if let Ok(md) = std::fs::metadata(&fp) {
+                                if cache.too_large(md.len()) {
+                                    warn!("not checking {}, it is too large to hash", fp);
+                                    return None;
+                                }
+                            }
+                            skipped
+                                .check(&fp, cache.backup_modified(&expected_hash, &fp))
+                                .flatten()
+                                .filter(|modified| *modified)
+                                .map(|_| (Category::ModifiedBackup, p))
+                        }
+                    })
+                    .for_each(report);
+            });
+        });
+
+        // runs limited to some paths, depth or packages only saw part of the
+        // cache, so the rest is kept for the next full run
+        if let Err(err) = self.cache.save(full_scan && !interrupt::interrupted()) {
+            error!("{:#}", err);
+        }
+        unreadable.summarize();
+    }
+}
@@ -0,0 +1,230 @@
+use crate::mtree::{read_mtree, MtreeEntry};
+use crate::source::{BackupHash, Package, PackageSource, Reason};
+use anyhow::{anyhow, Context, Result};
+use flate2::read::MultiGzDecoder;
+use rayon::prelude::*;
+use std::collections::{HashMap, HashSet};
+use std::io::{Read, Seek, SeekFrom};
+use std::path::Path;
+use xz2::read::XzDecoder;
+
+// Splits a pacman database file into its %SECTION% blocks, each holding one
+// value per line up to a blank line.
+fn sections(contents: &str) -> HashMap<&str, Vec<&str>> {
+    let mut sections = HashMap::new();
+    let mut lines = contents.lines();
+    while let Some(line) = lines.next() {
+        if !(line.len() > 2 && line.starts_with('%') && line.ends_with('%')) {
+            continue;
+        }
+        let values = lines.by_ref().take_while(|l| !l.is_empty()).collect();
+        sections.insert(&line[1..line.len() - 1], values);
+    }
+    sections
+}
+
+fn read(dir: &Path, name: &str) -> Result<String> {
+    let path = dir.join(name);
+    std::fs::read_to_string(&path).with_context(|| format!("failed to read {}", path.display()))
+}
+
+// Reads the desc and files of an installed package from its dir in the local
+// database.
+fn read_package(dir: &Path) -> Result<Package> {
+    let desc = read(dir, "desc")?;
+    let desc = sections(&desc);
+    let files = read(dir, "files")?;
+    let files = sections(&files);
+    let list = |sections: &HashMap<&str, Vec<&str>>, key: &str| -> Vec<String> {
+        sections
+            .get(key)
+            .map(|values| values.iter().map(|v| v.to_string()).collect())
+            .unwrap_or_default()
+    };
+    let first = |key: &str| -> Result<String> {
+        desc.get(key)
+            .and_then(|values| values.first())
+            .map(|v| v.to_string())
+            .ok_or_else(|| anyhow!("no %{}% in {}", key, dir.join("desc").display()))
+    };
+    Ok(Package {
+        name: first("NAME")?,
+        version: first("VERSION")?,
+        reason: match first("REASON").as_deref() {
+            Ok("1") => Reason::Depend,
+            _ => Reason::Explicit,
+        },
+        groups: list(&desc, "GROUPS"),
+        depends: list(&desc, "DEPENDS"),
+        optdepends: list(&desc, "OPTDEPENDS"),
+        provides: list(&desc, "PROVIDES"),
+        files: list(&files, "FILES"),
+        backup: files
+            .get("BACKUP")
+            .map(|values| {
+                values
+                    .iter()
+                    .filter_map(|v| {
+                        let mut parts = v.splitn(2, '\t');
+                        let path = parts.next()?.to_string();
+                        Some((path, BackupHash::Recorded(parts.next()?.to_string())))
+                    })
+                    .collect()
+            })
+            .unwrap_or_default(),
+    })
+}
+
+/// LocalDb reads the pacman database by parsing its files, without going
+/// through libalpm.
+pub struct LocalDb {
+    pub dbpath: String,
+    /// The sync databases to list available packages from.
+    pub sync_dbs: Vec<String>,
+}
+
+impl PackageSource for LocalDb {
+    fn packages(&self) -> Result<Vec<Package>> {
+        load(&self.dbpath)
+    }
+
+    fn available(&self) -> Result<HashSet<String>> {
+        sync_packages(&self.dbpath, &self.sync_dbs)
+    }
+
+    fn verify_data(&self, pkg: &Package) -> Result<Vec<(String, MtreeEntry)>> {
+        read_local_mtree(&self.dbpath, pkg)
+    }
+}
+
+/// Reads the mtree file pacman keeps for an installed package in the local
+/// database.
+pub fn read_local_mtree(dbpath: &str, pkg: &Package) -> Result<Vec<(String, MtreeEntry)>> {
+    read_mtree(
+        Path::new(dbpath)
+            .join("local")
+            .join(format!("{}-{}", pkg.name, pkg.version))
+            .join("mtree"),
+    )
+}
+
+// Reads the installed packages from the local database, sorted by name.
+fn load(dbpath: &str) -> Result<Vec<Package>> {
+    let local = Path::new(dbpath).join("local");
+    let dirs = std::fs::read_dir(&local)
+        .with_context(|| format!("failed to read directory {}", local.display()))?
+        .map(|de| de.map(|de| de.path()))
+        .collect::<std::io::Result<Vec<_>>>()
+        .with_context(|| format!("failed to read directory {}", local.display()))?;
+    // the ALPM_DB_VERSION file sits next to the package dirs, so only dirs
+    // are read
+    let mut pkgs = dirs
+        .into_par_iter()
+        .filter(|dir| dir.is_dir())
+        .map(|dir| read_package(&dir))
+        .collect::<Result<Vec<_>>>()?;
+    pkgs.sort_by(|a, b| a.name.cmp(&b.name));
+    Ok(pkgs)
+}
+
+// Opens a tar archive compressed with gzip, zstd or xz, which repo-add can
+// all write sync databases with, telling them apart by their magic bytes.
+// Archives that are none of those are read as plain tar.
+pub(crate) fn open_archive(path: &Path) -> Result<Box<dyn Read>> {
+    let mut f =
+        std::fs::File::open(path).with_context(|| format!("failed to open {}", path.display()))?;
+    let mut magic = vec![];
+    f.by_ref()
+        .take(6)
+        .read_to_end(&mut magic)
+        .with_context(|| format!("failed to read {}", path.display()))?;
+    f.seek(SeekFrom::Start(0))
+        .with_context(|| format!("failed to read {}", path.display()))?;
+    Ok(match magic.as_slice() {
+        [0x1f, 0x8b, ..] => Box::new(MultiGzDecoder::new(f)),
+        [0x28, 0xb5, 0x2f, 0xfd, ..] => Box::new(
+            zstd::Decoder::new(f).with_context(|| format!("failed to read {}", path.display()))?,
+        ),
+        [0xfd, b'7', b'z', b'X', b'Z', 0] => Box::new(XzDecoder::new_multi_decoder(f)),
+        _ => Box::new(f),
+    })
+}
+
+// Lists the names of the packages in the sync databases of the given repos,
+// which are tar archives with a name-version-release dir for each package.
+fn sync_packages(dbpath: &str, repos: &[String]) -> Result<HashSet<String>> {
+    let mut names = HashSet::new();
+    for repo in repos {
+        let path = Path::new(dbpath).join("sync").join(format!("{}.db", repo));
+        let mut archive = tar::Archive::new(open_archive(&path)?);
+        let entries = archive
+            .entries()
+            .with_context(|| format!("failed to read {}", path.display()))?;
+        for entry in entries {
+            let entry = entry.with_context(|| format!("failed to read {}", path.display()))?;
+            let name = entry
+                .path()
+                .with_context(|| format!("failed to read {}", path.display()))?;
+            // every entry is in or is the dir of a package, and the version
+            // and release never contain dashes
+            let dir = name
+                .iter()
+                .next()
+                .and_then(|d| d.to_str())
+                .unwrap_or_default();
+            if let Some(pkg) = dir.rsplitn(3, '-').nth(2) {
+                names.insert(pkg.to_string());
+            }
+        }
+    }
+    Ok(names)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::sync_packages;
+    use crate::TempDir;
+    use std::io::Write;
+
+    // Builds a sync database with a desc file for each package, where the
+    // long names need GNU long name entries.
+    fn db(names: &[&str]) -> Vec<u8> {
+        let mut builder = tar::Builder::new(vec![]);
+        for name in names {
+            let mut header = tar::Header::new_gnu();
+            header.set_size(0);
+            header.set_mode(0o644);
+            builder
+                .append_data(&mut header, format!("{}-1.0-1/desc", name), &[][..])
+                .unwrap();
+        }
+        builder.into_inner().unwrap()
+    }
+
+    #[test]
+    fn sync_dbs() {
+        let tmp = TempDir::new().unwrap();
+        let sync = tmp.0.join("sync");
+        std::fs::create_dir(&sync).unwrap();
+        let long = "x".repeat(120);
+
+        let mut gz = flate2::write::GzEncoder::new(vec![], flate2::Compression::default());
+        gz.write_all(&db(&["foo", "lib32-foo-bar", &long])).unwrap();
+        std::fs::write(sync.join("core.db"), gz.finish().unwrap()).unwrap();
+        let zst = zstd::encode_all(&db(&["baz"])[..], 0).unwrap();
+        std::fs::write(sync.join("extra.db"), zst).unwrap();
+        std::fs::write(sync.join("plain.db"), db(&["qux"])).unwrap();
+
+        let repos: Vec<String> = ["core", "extra", "plain"]
+            .iter()
+            .map(|r| r.to_string())
+            .collect();
+        let names = sync_packages(&tmp.0.to_string_lossy(), &repos).unwrap();
+        let mut names: Vec<&str> = names.iter().map(String::as_str).collect();
+        names.sort_unstable();
+        assert_eq!(
+            names,
+            vec!["baz", "foo", "lib32-foo-bar", "qux", long.as_str()]
+        );
+    }
+}
@@ -0,0 +1,108 @@
+use anyhow::{anyhow, Context, Result};
+use log::warn;
+use std::os::unix::io::AsRawFd;
+use std::path::Path;
+use std::time::Duration;
+
+/// Lock is an exclusive lock on a file, released when dropped.
+pub struct Lock {
+    _file: std::fs::File,
+}
+
+impl Lock {
+    /// Takes the lock, waiting for another process holding it to finish.
+    pub fn acquire(path: &str) -> Result<Self> {
+        if let Some(dir) = Path::new(path).parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        // a lock file created by root can still be locked by other users, as
+        // flock only needs it to be open for reading
+        let file = match std::fs::OpenOptions::new()
+            .create(true)
+            .truncate(false)
+            .write(true)
+            .open(path)
+        {
+            Err(err) if err.kind() == std::io::ErrorKind::PermissionDenied => {
+                std::fs::File::open(path)
+            }
+            result => result,
+        }
+        .with_context(|| format!("failed to open {}", path))?;
+        // SAFETY: the fd is open for as long as file lives
+        if unsafe { libc::flock(file.as_raw_fd(), libc::LOCK_EX | libc::LOCK_NB) } == 0 {
+            return Ok(Self { _file: file });
+        }
+        let err = std::io::Error::last_os_error();
+        if err.raw_os_error() != Some(libc::EWOULDBLOCK) {
+            return Err(err).with_context(|| format!("failed to lock {}", path));
+        }
+        eprintln!("waiting for another archdiff run to finish");
+        // SAFETY: the fd is open for as long as file lives
+        if unsafe { libc::flock(file.as_raw_fd(), libc::LOCK_EX) } != 0 {
+            return Err(std::io::Error::last_os_error())
+                .with_context(|| format!("failed to lock {}", path));
+        }
+        Ok(Self { _file: file })
+    }
+}
+
+/// PacmanLock controls what happens when pacman is in the middle of a
+/// transaction, where packages and their files do not match yet.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum PacmanLock {
+    /// Wait for pacman to finish.
+    Wait,
+    /// Log a warning and compute the diff anyway.
+    Warn,
+    /// Fail with an error.
+    Abort,
+}
+
+impl std::str::FromStr for PacmanLock {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "wait" => Ok(PacmanLock::Wait),
+            "warn" => Ok(PacmanLock::Warn),
+            "abort" => Ok(PacmanLock::Abort),
+            _ => Err(anyhow!("unknown pacman lock mode {}", s)),
+        }
+    }
+}
+
+/// Checks for the lock file pacman holds during a transaction in the
+/// database dir, and waits, warns or fails as the mode says.
+pub fn check_pacman(dbpath: &str, mode: PacmanLock) -> Result<()> {
+    let lck = Path::new(dbpath).join("db.lck");
+    if !lck.exists() {
+        return Ok(());
+    }
+    match mode {
+        PacmanLock::Wait => {
+            eprintln!(
+                "waiting for pacman to finish, remove {} if it is not running",
+                lck.display()
+            );
+            while lck.exists() {
+                if crate::interrupt::interrupted() {
+                    return Err(anyhow!("interrupted while waiting for pacman"));
+                }
+                std::thread::sleep(Duration::from_millis(500));
+            }
+        }
+        PacmanLock::Warn => warn!(
+            "{} exists, the diff may be wrong while pacman is running",
+            lck.display()
+        ),
+        PacmanLock::Abort => {
+            return Err(anyhow!(
+                "{} exists, pacman is running or was interrupted",
+                lck.display()
+            ))
+        }
+    }
+    Ok(())
+}
@@ -1,193 +1,2514 @@
 use anyhow::{anyhow, Context, Result};
-use ignore::gitignore::{Gitignore, GitignoreBuilder};
-use log::error;
-use rayon::prelude::*;
-use std::collections::{HashMap, HashSet};
-use std::fmt::Display;
-use std::os::unix::ffi::OsStrExt;
+use archdiff::backup::{self, Backup};
+use archdiff::config::Config;
+use archdiff::daemon;
+use archdiff::fleet::{Fleet, Tokens};
+use archdiff::hooks::Hooks;
+use archdiff::http;
+use archdiff::interrupt;
+use archdiff::pacman::PacmanConf;
+use archdiff::roots::{self, Difference, Tree};
+use archdiff::snapshot::{Change, Snapshot};
+use archdiff::systemd;
+use archdiff::template::Template;
+use archdiff::watch::Watcher;
+use archdiff::{
+    pacfile_base, Action, App, Category, Entry, HashAlgo, IgnoreMatch, Options, PackageCategory,
+    PackageEntry,
+};
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::io::Write;
+use std::path::Path;
+use std::sync::atomic::{AtomicBool, AtomicI32, Ordering};
+use std::sync::{Arc, Mutex, RwLock};
+use std::time::{Duration, Instant, SystemTime};
 use structopt::StructOpt;
-use walkdir::WalkDir;
+
+mod tui;
 
 #[derive(StructOpt)]
-#[structopt(name = "colaz")]
+#[structopt(name = "archdiff")]
 struct Args {
-    #[structopt(long, help = "root dir", default_value = "/")]
-    root: String,
-    #[structopt(long, help = "database dir", default_value = "/var/lib/pacman")]
-    dbpath: String,
-    #[structopt(long, help = "repo dir", default_value = "/usr/share/archdiff")]
-    repo: String,
-    #[structopt(long, help = "ignore dir", default_value = "/etc/archdiff/ignore")]
-    ignore: String,
+    #[structopt(
+        long,
+        global = true,
+        help = "config file [default: /etc/archdiff/config.toml and ~/.config/archdiff/config.toml]",
+        parse(from_os_str)
+    )]
+    config: Option<std::path::PathBuf>,
+    #[structopt(
+        short,
+        long,
+        global = true,
+        parse(from_occurrences),
+        help = "log more details, repeat for even more"
+    )]
+    verbose: u8,
+    #[structopt(
+        long,
+        global = true,
+        help = "log format: text, json or journal [default: journal under systemd, otherwise text]"
+    )]
+    log_format: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "print the time, cpu time, peak memory and disk reads used to stderr when done"
+    )]
+    profile: bool,
+    #[structopt(long, global = true, help = "root dir [default: /]")]
+    root: Option<String>,
+    #[structopt(long, global = true, help = "database dir [default: /var/lib/pacman]")]
+    dbpath: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "do not descend into dirs on other filesystems than the root"
+    )]
+    one_file_system: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "also walk virtual and ephemeral filesystems like /proc, /sys and /tmp"
+    )]
+    virtual_fs: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "only walk this many levels of dirs below the root"
+    )]
+    max_depth: Option<usize>,
+    #[structopt(
+        long,
+        global = true,
+        help = "compare files larger than this by size instead of hashing them, for example 1G"
+    )]
+    max_hash_size: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        number_of_values = 1,
+        help = "repo dir, repeated or colon separated with later dirs overriding earlier ones [default: /usr/share/archdiff]"
+    )]
+    repo: Vec<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "list files of git repo dirs with git ls-files instead of walking them"
+    )]
+    repo_git: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "host name for the hosts/NAME dirs in the repo [default: the system host name]"
+    )]
+    hostname: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "ignore dir [default: /etc/archdiff/ignore]"
+    )]
+    ignore: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        number_of_values = 1,
+        use_delimiter = true,
+        help = "ignore all files owned by this package, repeated or comma separated"
+    )]
+    exclude_package: Vec<String>,
+    #[structopt(
+        long,
+        global = true,
+        number_of_values = 1,
+        help = "ignore paths matching this pattern, like a line of the ignore files, repeated for more"
+    )]
+    exclude: Vec<String>,
+    #[structopt(
+        long,
+        global = true,
+        number_of_values = 1,
+        help = "read more ignore patterns from this file, - for stdin, repeated for more"
+    )]
+    ignore_from: Vec<String>,
+    #[structopt(
+        long,
+        global = true,
+        number_of_values = 1,
+        use_delimiter = true,
+        help = "only check the files owned by this package, repeated or comma separated"
+    )]
+    package: Vec<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "pacman config file for the default root and database dir [default: /etc/pacman.conf]"
+    )]
+    pacman_conf: Option<String>,
+    #[structopt(
+        long,
+        short,
+        global = true,
+        help = "number of parallel jobs for reading package data and checking files, 0 for one per cpu [default: 0]"
+    )]
+    jobs: Option<usize>,
+    #[structopt(
+        long,
+        global = true,
+        help = "hash cache file [default: /var/cache/archdiff/hashes]"
+    )]
+    cache: Option<String>,
+    #[structopt(long, global = true, help = "disable the hash cache")]
+    no_cache: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "lock file so runs do not race on the cache, empty to not lock [default: /run/lock/archdiff.lock]"
+    )]
+    lock: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "when pacman is running a transaction: wait, warn or abort [default: wait]"
+    )]
+    pacman_lock: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "hash for repo files: md5, sha1, sha256, blake3 or xxhash [default: md5]"
+    )]
+    hash: Option<HashAlgo>,
+    #[structopt(
+        long,
+        global = true,
+        help = "age identity file for encrypted repo files [default: /etc/archdiff/age/identity]"
+    )]
+    age_identity: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "age recipients file for adopt --encrypt [default: /etc/archdiff/age/recipients]"
+    )]
+    age_recipients: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "check all packaged files against mtree data"
+    )]
+    mtree: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "report packaged files whose mode or owner differ from mtree data"
+    )]
+    metadata: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "compare xattrs of repo files and report packaged files with capabilities"
+    )]
+    xattrs: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "show files scanned, bytes hashed and an ETA on stderr while scanning"
+    )]
+    progress: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "list packages installed as dependencies that nothing depends on"
+    )]
+    orphans: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "list packages that are not in any sync database"
+    )]
+    foreign: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "summarize paths that cannot be read for lack of permission [default: when not root]"
+    )]
+    tolerant: bool,
+    #[structopt(
+        long,
+        global = true,
+        conflicts_with = "tolerant",
+        help = "log an error for each path that cannot be read for lack of permission"
+    )]
+    strict: bool,
+    #[structopt(
+        long,
+        global = true,
+        help = "how to report files matching pacman's NoExtract and NoUpgrade: exclude, mark or off [default: exclude]"
+    )]
+    pacman_skip: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "how to read the package database: auto, alpm, local to parse it without libalpm, pacman to run pacman, dpkg, rpm or apk [default: auto]"
+    )]
+    backend: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "color output by category: auto, always or never [default: auto]"
+    )]
+    color: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "daemon socket to listen on, or to query for diff, status and is-dirty"
+    )]
+    socket: Option<String>,
+    #[structopt(
+        long,
+        global = true,
+        help = "state file for --since-last-run [default: /var/lib/archdiff/last-run.json]"
+    )]
+    state: Option<String>,
+    #[structopt(subcommand)]
+    cmd: Option<Command>,
 }
 
-struct App {
-    alpm: alpm::Alpm,
-    ignore: Gitignore,
-    args: Args,
+#[derive(StructOpt)]
+enum Command {
+    #[structopt(about = "show the differences between the system and packages (default)")]
+    Diff(DiffArgs),
+    #[structopt(about = "show the differences under /etc")]
+    Etc(DiffArgs),
+    #[structopt(about = "check packaged files against the package mtree data, like paccheck")]
+    Verify(VerifyArgs),
+    #[structopt(about = "show the number of differences per category")]
+    Status,
+    #[structopt(
+        about = "copy changed repo files onto the root",
+        visible_alias = "sync"
+    )]
+    Apply(ApplyArgs),
+    #[structopt(about = "put back the files changed by the last apply")]
+    Undo,
+    #[structopt(about = "copy files from the root into the repo")]
+    Adopt(AdoptArgs),
+    #[structopt(about = "merge backup files with their repo copy and the packaged copy")]
+    Merge(MergeArgs),
+    #[structopt(about = "review .pacnew files and merge, accept or delete them")]
+    Pacnew,
+    #[structopt(about = "show the package owning a path")]
+    Owner(OwnerArgs),
+    #[structopt(about = "explain how the diff treats a path")]
+    Explain(ExplainArgs),
+    #[structopt(about = "debug the ignore patterns")]
+    Ignore(IgnoreCommand),
+    #[structopt(about = "print differences as they appear and disappear")]
+    Watch(WatchArgs),
+    #[structopt(about = "keep the diff up to date and serve it on a unix socket")]
+    Daemon(DaemonArgs),
+    #[structopt(about = "exit with status 1 if there are differences under a path")]
+    IsDirty(IsDirtyArgs),
+    #[structopt(about = "write Prometheus metrics for the node exporter textfile collector")]
+    Metrics(MetricsArgs),
+    #[structopt(about = "save the diff along with file hashes and metadata as JSON")]
+    Snapshot(SnapshotArgs),
+    #[structopt(about = "show the changes between two snapshots")]
+    Compare(CompareArgs),
+    #[structopt(about = "show the differences between two directory trees")]
+    Roots(RootsArgs),
+    #[structopt(about = "push snapshots to an archdiff server periodically")]
+    Agent(AgentArgs),
+    #[structopt(about = "collect snapshots from agents and serve the drift of the fleet")]
+    Server(ServerArgs),
+    #[structopt(about = "archive the contents of changed and unpackaged files")]
+    Export(ExportArgs),
+    #[structopt(about = "browse the differences and adopt, ignore, apply or restore them")]
+    Tui,
+    #[structopt(about = "print the version, commit, rustc and libalpm version")]
+    Version,
 }
 
-fn hash_file<P: AsRef<std::path::Path>>(path: P) -> Result<String> {
-    let hash = alpm::compute_md5sum(path.as_ref().as_os_str().as_bytes())
-        .map_err(|_| anyhow!("failed to hash {}", path.as_ref().display()))?;
-    Ok(hash)
+#[derive(Default, StructOpt)]
+struct DiffArgs {
+    #[structopt(long, help = "group output by category, same as --group-by category")]
+    group: bool,
+    #[structopt(long, help = "group output by category or package")]
+    group_by: Option<String>,
+    #[structopt(
+        long,
+        help = "list every file in unpackaged dirs instead of the dir with a file count"
+    )]
+    expand: bool,
+    #[structopt(
+        long,
+        short,
+        help = "show the mode, owner, group, size and mtime of each file"
+    )]
+    long: bool,
+    #[structopt(
+        long,
+        help = "output format: plain, tree, csv, tsv, yaml or template [default: plain]"
+    )]
+    format: Option<String>,
+    #[structopt(
+        long,
+        help = "template for --format template, using {path}, {code}, {category} and {package}"
+    )]
+    template: Option<String>,
+    #[structopt(
+        long,
+        help = "exit with the status of the most severe difference, see the readme"
+    )]
+    check: bool,
+    #[structopt(
+        long,
+        short,
+        parse(from_occurrences),
+        help = "print only the number of differences per category, or nothing when repeated"
+    )]
+    quiet: u8,
+    #[structopt(
+        long,
+        help = "only consider these category codes for --check, for example MB"
+    )]
+    check_only: Option<String>,
+    #[structopt(
+        long,
+        short = "0",
+        help = "print only the paths, each followed by a NUL character"
+    )]
+    print0: bool,
+    #[structopt(
+        long = "diff",
+        help = "show a unified diff of modified files against the repo or package copy"
+    )]
+    show_diff: bool,
+    #[structopt(
+        long,
+        help = "only show differences that are new or changed since the last run with this flag"
+    )]
+    since_last_run: bool,
+    #[structopt(
+        long,
+        help = "print the number and total size of differences per category, top level dir and package"
+    )]
+    stats: bool,
+    #[structopt(
+        long,
+        help = "print differences as soon as they are found, unsorted and ungrouped"
+    )]
+    stream: bool,
+    #[structopt(
+        long,
+        allow_hyphen_values = true,
+        value_terminator = ";",
+        help = "run a command for each difference, ended by ';', where {} or {path}, {code}, {category} and {package} are replaced"
+    )]
+    exec: Vec<String>,
+    #[structopt(help = "only scan these paths [default: the whole root]")]
+    paths: Vec<String>,
 }
 
-fn hash_file_logged<P: AsRef<std::path::Path>>(path: P) -> Option<String> {
-    match hash_file(&path) {
-        Ok(hash) => Some(hash),
-        Err(err) => {
-            error!("IO error for operation on {:?}: {}", path.as_ref(), err);
-            None
+#[derive(Clone, Copy, PartialEq)]
+enum GroupBy {
+    Category,
+    Package,
+}
+
+impl std::str::FromStr for GroupBy {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "category" => Ok(GroupBy::Category),
+            "package" => Ok(GroupBy::Package),
+            _ => Err(anyhow!("unknown grouping {}", s)),
         }
     }
 }
 
-fn filter_map_error<Error: Display, O>(result: std::result::Result<O, Error>) -> Option<O> {
-    match result {
-        Ok(o) => Some(o),
-        Err(err) => {
-            error!("{}", err);
-            None
+#[derive(StructOpt)]
+struct ApplyArgs {
+    #[structopt(long, short = "n", help = "only print what would be copied")]
+    dry_run: bool,
+    #[structopt(
+        long,
+        conflicts_with = "dry-run",
+        help = "print what would be changed along with content diffs, without changing anything"
+    )]
+    plan: bool,
+    #[structopt(long, short, help = "confirm each file")]
+    interactive: bool,
+    #[structopt(long, short, help = "apply even if a git repo has uncommitted changes")]
+    force: bool,
+    #[structopt(
+        long,
+        help = "also remove files that were removed from the repo since the last apply"
+    )]
+    delete: bool,
+    #[structopt(
+        long,
+        help = "also install the packages missing from the repo package list with pacman"
+    )]
+    packages: bool,
+    #[structopt(
+        long,
+        requires = "packages",
+        help = "also remove explicitly installed packages that are not listed"
+    )]
+    remove_unlisted: bool,
+}
+
+#[derive(StructOpt)]
+struct AdoptArgs {
+    #[structopt(required = true, help = "files to adopt", parse(from_os_str))]
+    paths: Vec<std::path::PathBuf>,
+    #[structopt(long, short, help = "encrypt the files with age")]
+    encrypt: bool,
+    #[structopt(long, short, help = "commit the files if the repo is a git repo")]
+    commit: bool,
+}
+
+#[derive(StructOpt)]
+struct VerifyArgs {
+    #[structopt(help = "only check these packages [default: all packages]")]
+    packages: Vec<String>,
+}
+
+#[derive(StructOpt)]
+struct MergeArgs {
+    #[structopt(required = true, help = "files to merge", parse(from_os_str))]
+    paths: Vec<std::path::PathBuf>,
+    #[structopt(
+        long,
+        short,
+        help = "write the merged contents onto the files unless there are conflicts"
+    )]
+    write: bool,
+}
+
+#[derive(StructOpt)]
+struct OwnerArgs {
+    #[structopt(required = true, help = "paths to look up", parse(from_os_str))]
+    paths: Vec<std::path::PathBuf>,
+}
+
+#[derive(StructOpt)]
+struct ExplainArgs {
+    #[structopt(required = true, help = "paths to explain", parse(from_os_str))]
+    paths: Vec<std::path::PathBuf>,
+}
+
+#[derive(StructOpt)]
+struct IsDirtyArgs {
+    #[structopt(required = true, help = "paths to check", parse(from_os_str))]
+    paths: Vec<std::path::PathBuf>,
+}
+
+#[derive(StructOpt)]
+struct MetricsArgs {
+    #[structopt(long, short, help = "file to write, or standard output if not set")]
+    output: Option<String>,
+}
+
+#[derive(StructOpt)]
+struct SnapshotArgs {
+    #[structopt(long, short, help = "file to write, or standard output if not set")]
+    output: Option<String>,
+}
+
+#[derive(StructOpt)]
+struct ExportArgs {
+    #[structopt(
+        long,
+        short,
+        help = "archive to write, compressed according to its suffix such as .tar.zst"
+    )]
+    output: String,
+}
+
+#[derive(StructOpt)]
+struct CompareArgs {
+    #[structopt(help = "the earlier snapshot")]
+    old: String,
+    #[structopt(help = "the later snapshot")]
+    new: String,
+    #[structopt(
+        long,
+        help = "compare snapshots of different hosts by file contents, with host names in paths replaced by {host}"
+    )]
+    hosts: bool,
+}
+
+#[derive(StructOpt)]
+struct RootsArgs {
+    #[structopt(help = "the reference tree, like a mounted golden image")]
+    first: String,
+    #[structopt(help = "the tree compared against it")]
+    second: String,
+    #[structopt(
+        long,
+        help = "package database of the first tree, to compare packages and skip the files of those that differ"
+    )]
+    first_dbpath: Option<String>,
+    #[structopt(long, help = "package database of the second tree")]
+    second_dbpath: Option<String>,
+}
+
+#[derive(StructOpt)]
+enum IgnoreCommand {
+    #[structopt(
+        about = "show whether paths are ignored and by which pattern, exiting with status 1 if none are"
+    )]
+    Test(IgnoreTestArgs),
+    #[structopt(
+        about = "list the loaded ignore patterns and how many paths each matched in the last scan"
+    )]
+    List,
+}
+
+#[derive(StructOpt)]
+struct IgnoreTestArgs {
+    #[structopt(required = true, help = "paths to test", parse(from_os_str))]
+    paths: Vec<std::path::PathBuf>,
+}
+
+#[derive(StructOpt)]
+struct WatchArgs {
+    #[structopt(
+        long,
+        help = "also show a desktop notification when new differences appear"
+    )]
+    notify: bool,
+}
+
+#[derive(StructOpt)]
+struct DaemonArgs {
+    #[structopt(
+        long,
+        help = "also serve the diff as JSON over HTTP on this address, like 127.0.0.1:7879"
+    )]
+    http: Option<String>,
+}
+
+#[derive(StructOpt)]
+struct AgentArgs {
+    #[structopt(help = "URL of the archdiff server, like http://fleet:7878")]
+    server: String,
+    #[structopt(long, default_value = "3600", help = "seconds between snapshots")]
+    interval: u64,
+    #[structopt(long, help = "push one snapshot and exit")]
+    once: bool,
+    #[structopt(long, help = "file holding the token the server expects of this host")]
+    token_file: Option<String>,
+}
+
+#[derive(StructOpt)]
+struct ServerArgs {
+    #[structopt(long, default_value = "127.0.0.1:7878", help = "address to listen on")]
+    listen: String,
+    #[structopt(
+        long,
+        default_value = "/var/lib/archdiff/fleet",
+        help = "dir to store the snapshot of each host in"
+    )]
+    dir: String,
+    #[structopt(
+        long,
+        default_value = "/etc/archdiff/fleet-tokens",
+        help = "file with the tokens agents push with, as HOST TOKEN or a shared TOKEN per line"
+    )]
+    tokens: String,
+}
+
+impl Args {
+    // Merges the config files with the flags, which take precedence.
+    fn config(&self) -> Result<Config> {
+        let paths = match &self.config {
+            Some(path) => vec![path.clone()],
+            None => Config::default_paths(),
+        };
+        let mut config = Config::default();
+        for path in paths {
+            config = config.merge(Config::load(path)?);
         }
+        let diff = match &self.cmd {
+            Some(Command::Diff(opts)) | Some(Command::Etc(opts)) => Some(opts),
+            _ => None,
+        };
+        Ok(config.merge(Config {
+            root: self.root.clone(),
+            dbpath: self.dbpath.clone(),
+            one_file_system: if self.one_file_system {
+                Some(true)
+            } else {
+                None
+            },
+            virtual_fs: if self.virtual_fs { Some(true) } else { None },
+            max_depth: self.max_depth,
+            max_hash_size: self.max_hash_size.clone(),
+            repo: if self.repo.is_empty() {
+                None
+            } else {
+                Some(self.repo.join(":"))
+            },
+            repo_git: if self.repo_git { Some(true) } else { None },
+            hostname: self.hostname.clone(),
+            ignore: self.ignore.clone(),
+            user_ignore: None,
+            pacman_conf: self.pacman_conf.clone(),
+            jobs: self.jobs,
+            cache: self.cache.clone(),
+            no_cache: if self.no_cache { Some(true) } else { None },
+            lock: self.lock.clone(),
+            pacman_lock: self.pacman_lock.clone(),
+            hash: self.hash.map(|h| h.name().to_string()),
+            age_identity: self.age_identity.clone(),
+            age_recipients: self.age_recipients.clone(),
+            mtree: if self.mtree { Some(true) } else { None },
+            metadata: if self.metadata { Some(true) } else { None },
+            xattrs: if self.xattrs { Some(true) } else { None },
+            progress: if self.progress { Some(true) } else { None },
+            orphans: if self.orphans { Some(true) } else { None },
+            foreign: if self.foreign { Some(true) } else { None },
+            tolerant: if self.tolerant {
+                Some(true)
+            } else if self.strict {
+                Some(false)
+            } else {
+                None
+            },
+            pacman_skip: self.pacman_skip.clone(),
+            backend: self.backend.clone(),
+            group: diff.filter(|d| d.group).map(|_| true),
+            group_by: diff.and_then(|d| d.group_by.clone()),
+            expand: diff.filter(|d| d.expand).map(|_| true),
+            long: diff.filter(|d| d.long).map(|_| true),
+            format: diff.and_then(|d| d.format.clone()),
+            template: diff.and_then(|d| d.template.clone()),
+            color: self.color.clone(),
+            socket: self.socket.clone(),
+            state: self.state.clone(),
+            hooks: None,
+        }))
     }
 }
 
-// TODO: command to sync /usr/share/archdiff automatically
+// Output holds the settings for printing the diff.
+struct Output {
+    group_by: Option<GroupBy>,
+    template: Option<Template>,
+    // Print the entries as a tree of dirs.
+    tree: bool,
+    // Print the entries as a table with this separator, for csv and tsv.
+    separator: Option<char>,
+    // Print the entries as YAML, like a snapshot.
+    yaml: bool,
+    color: bool,
+    // List every unpackaged file rather than collapsing unpackaged dirs.
+    expand: bool,
+    // Show the metadata of each file, like ls -l.
+    long: bool,
+}
 
-impl App {
-    #[allow(clippy::new_ret_no_self)]
-    fn new(mut args: Args) -> Result<Self> {
-        if !args.root.ends_with('/') {
-            args.root.push('/');
-        }
-        if !args.repo.ends_with('/') {
-            args.repo.push('/');
-        }
+impl Output {
+    fn new(config: &Config) -> Result<Self> {
+        let group_by = match &config.group_by {
+            Some(group_by) => Some(group_by.parse()?),
+            None if config.group == Some(true) => Some(GroupBy::Category),
+            None => None,
+        };
+        let tree = config.format.as_deref() == Some("tree");
+        let yaml = config.format.as_deref() == Some("yaml");
+        let separator = match config.format.as_deref() {
+            Some("csv") => Some(','),
+            Some("tsv") => Some('\t'),
+            _ => None,
+        };
+        let template = match (config.format.as_deref(), &config.template) {
+            (None, None) | (Some("plain"), _) | (Some("tree"), _) => None,
+            (Some("csv"), _) | (Some("tsv"), _) | (Some("yaml"), _) => None,
+            (None, Some(template)) | (Some("template"), Some(template)) => Some(template.parse()?),
+            (Some("template"), None) => {
+                return Err(anyhow!("--format template requires --template"))
+            }
+            (Some(format), _) => return Err(anyhow!("unknown format {}", format)),
+        };
+        let color = match config.color.as_deref() {
+            None | Some("auto") => {
+                // SAFETY: isatty only inspects the file descriptor
+                let tty = unsafe { libc::isatty(libc::STDOUT_FILENO) } == 1;
+                tty && std::env::var_os("NO_COLOR").is_none()
+            }
+            Some("always") => true,
+            Some("never") => false,
+            Some(color) => return Err(anyhow!("unknown color mode {}", color)),
+        };
         Ok(Self {
-            alpm: alpm::Alpm::new(args.root.as_bytes(), args.dbpath.as_bytes())?,
-            ignore: Self::build_gitignore(&args.ignore)?,
-            args,
+            group_by,
+            template,
+            tree,
+            separator,
+            yaml,
+            color,
+            expand: config.expand == Some(true),
+            long: config.long == Some(true),
         })
     }
 
-    fn build_gitignore(ignore: &str) -> Result<Gitignore> {
-        let mut gi_builder = GitignoreBuilder::new("/");
-        let ignores = std::fs::read_dir(ignore)
-            .with_context(|| format!("failed to read directory {}", ignore))?;
-        for path in ignores {
-            let path = path?;
-            let oerr = gi_builder.add(path.path());
-            if let Some(err) = oerr {
-                return Err(err.into());
+    // Formats an entry as its category code and path, with the metadata of
+    // the file in between for long output.
+    fn entry(&self, root: &str, e: &Entry) -> String {
+        let path = format!("{}{}", root, e.path);
+        let line = if self.long {
+            format!("{} {} {}", e.category.code(), long_listing(&path), path)
+        } else {
+            format!("{} {}", e.category.code(), path)
+        };
+        self.paint(e.category, &line)
+    }
+
+    // Wraps s in the ANSI color for the category, if color is enabled.
+    fn paint(&self, category: Category, s: &str) -> String {
+        if !self.color {
+            return s.to_string();
+        }
+        let code = match category {
+            Category::Unpackaged | Category::Pacnew | Category::Pacsave => "33",
+            Category::Deleted => "31",
+            Category::Modified => "35",
+            Category::ModifiedBackup => "36",
+            Category::ModifiedRepo => "34",
+            Category::Metadata | Category::Xattrs | Category::Capability => "32",
+            Category::NoExtract | Category::NoUpgrade => "90",
+        };
+        format!("\x1b[{}m{}\x1b[0m", code, s)
+    }
+
+    // Like paint, but for package differences, colored like the matching
+    // file categories.
+    fn paint_package(&self, category: PackageCategory, s: &str) -> String {
+        match category {
+            PackageCategory::Unlisted | PackageCategory::Foreign => {
+                self.paint(Category::Unpackaged, s)
             }
+            PackageCategory::Missing => self.paint(Category::Deleted, s),
+            PackageCategory::Orphan => self.paint(Category::NoExtract, s),
         }
-        Ok(gi_builder.build()?)
     }
+}
 
-    fn run(&self) {
-        let mut pkg_files = HashSet::new();
-        let mut pkg_backup_files = HashMap::new();
-        for pkg in self.alpm.localdb().pkgs() {
-            pkg_files.extend(pkg.files().files().iter().map(|f| f.name().to_string()));
-            pkg_backup_files.extend(
-                pkg.backup()
-                    .iter()
-                    .map(|b| (b.name().to_string(), b.hash().to_string())),
-            );
+// Describes a file like ls -l: its mode, owner, group, size and mtime, or
+// dashes if it does not exist.
+fn long_listing(path: &str) -> String {
+    use std::os::unix::fs::MetadataExt;
+    let md = match std::fs::symlink_metadata(path) {
+        Ok(md) => md,
+        Err(_) => return format!("{:10} {:8} {:8} {:>10} {:16}", "-", "-", "-", "-", "-"),
+    };
+    format!(
+        "{} {:8} {:8} {:>10} {}",
+        mode_string(md.mode()),
+        user_name(md.uid()),
+        group_name(md.gid()),
+        md.len(),
+        local_time(md.mtime())
+    )
+}
+
+// Formats a mode like ls, as in -rwxr-xr-x.
+fn mode_string(mode: u32) -> String {
+    let kind = match mode & libc::S_IFMT {
+        libc::S_IFDIR => 'd',
+        libc::S_IFLNK => 'l',
+        libc::S_IFCHR => 'c',
+        libc::S_IFBLK => 'b',
+        libc::S_IFIFO => 'p',
+        libc::S_IFSOCK => 's',
+        _ => '-',
+    };
+    let mut s = String::from(kind);
+    for (i, special, c) in [(6, 0o4000, 's'), (3, 0o2000, 's'), (0, 0o1000, 't')] {
+        let bits = (mode >> i) & 7;
+        s.push(if bits & 4 != 0 { 'r' } else { '-' });
+        s.push(if bits & 2 != 0 { 'w' } else { '-' });
+        s.push(match (bits & 1 != 0, mode & special != 0) {
+            (true, true) => c,
+            (false, true) => c.to_ascii_uppercase(),
+            (true, false) => 'x',
+            (false, false) => '-',
+        });
+    }
+    s
+}
+
+// Looks up the name of a user, falling back to the uid.
+fn user_name(uid: u32) -> String {
+    // SAFETY: getpwuid returns NULL or a pointer to a static passwd, which is
+    // only read before the next call on this thread
+    unsafe {
+        let pw = libc::getpwuid(uid);
+        if pw.is_null() {
+            return uid.to_string();
         }
+        std::ffi::CStr::from_ptr((*pw).pw_name)
+            .to_string_lossy()
+            .into_owned()
+    }
+}
 
-        let root = &self.args.root;
-        let ignored = &self.ignore;
-        let root_len = self.args.root.len();
-        let repo_len = self.args.repo.len();
-
-        let mut all = vec![];
-
-        // untracked files on disk
-        WalkDir::new(&self.args.root)
-            .into_iter()
-            .filter_entry(|de| {
-                self.ignore
-                    .matched(de.path(), de.file_type().is_dir())
-                    .is_none()
-            })
-            .filter_map(filter_map_error)
-            .for_each(|de| {
-                if de.file_type().is_dir() {
-                    return;
-                }
-                let path = &de.path().to_string_lossy()[root_len..];
-                let removed = pkg_files.remove(path);
-                if !removed {
-                    all.push(('?', path.to_string()));
-                }
-            });
+// Looks up the name of a group, falling back to the gid.
+fn group_name(gid: u32) -> String {
+    // SAFETY: as with getpwuid in user_name
+    unsafe {
+        let gr = libc::getgrgid(gid);
+        if gr.is_null() {
+            return gid.to_string();
+        }
+        std::ffi::CStr::from_ptr((*gr).gr_name)
+            .to_string_lossy()
+            .into_owned()
+    }
+}
+
+// Formats a unix time in the local time zone, as in 2021-03-04 15:06.
+fn local_time(secs: i64) -> String {
+    // SAFETY: tm is plain data and filled in by localtime_r
+    let mut tm: libc::tm = unsafe { std::mem::zeroed() };
+    let t = secs as libc::time_t;
+    // SAFETY: t and tm are valid for the call
+    if unsafe { libc::localtime_r(&t, &mut tm) }.is_null() {
+        return secs.to_string();
+    }
+    format!(
+        "{:04}-{:02}-{:02} {:02}:{:02}",
+        tm.tm_year + 1900,
+        tm.tm_mon + 1,
+        tm.tm_mday,
+        tm.tm_hour,
+        tm.tm_min
+    )
+}
+
+fn confirm(prompt: &str) -> Result<bool> {
+    Ok(matches!(
+        ask(&format!("{} [y/N]", prompt))?.as_str(),
+        "y" | "Y" | "yes"
+    ))
+}
+
+// Prompts on stderr and reads a line of input, trimmed.
+fn ask(prompt: &str) -> Result<String> {
+    eprint!("{} ", prompt);
+    std::io::stderr().flush()?;
+    let mut line = String::new();
+    std::io::stdin().read_line(&mut line)?;
+    Ok(line.trim().to_string())
+}
+
+// The files in the repo as of the last apply, used to find the files that
+// apply --delete removes.
+const DEFAULT_SYNCED: &str = "/var/lib/archdiff/synced.json";
+
+// Where apply saves the files it changes, for undo.
+const DEFAULT_BACKUPS: &str = "/var/lib/archdiff/backups";
+
+// The socket the daemon listens on unless configured otherwise.
+const DEFAULT_SOCKET: &str = "/run/archdiff.sock";
+
+// The state file for --since-last-run unless configured otherwise.
+const DEFAULT_STATE: &str = "/var/lib/archdiff/last-run.json";
+
+// The exit status of diff --check, from the least to the most severe
+// difference found, so wrappers can branch without parsing the output.
+// verify and is-dirty only tell whether anything differs, with
+// EXIT_DIFFERENT. Errors exit with EXIT_ERROR for every command.
+const EXIT_DIFFERENT: i32 = 1;
+const EXIT_MODIFIED_BACKUP: i32 = 2;
+const EXIT_MODIFIED_REPO: i32 = 3;
+const EXIT_ERROR: i32 = 10;
+
+// The exit status of ignore test when none of the paths are ignored, like
+// git check-ignore.
+const EXIT_NOT_IGNORED: i32 = 1;
 
-        // repo files that have been changed
-        WalkDir::new(&self.args.repo)
-            .into_iter()
-            .filter_map(filter_map_error)
-            .for_each(|de| {
-                if de.file_type().is_dir() {
-                    return;
+// The exit status for a difference of a category, where anything but a
+// modified backup or repo file only counts as different.
+fn exit_status(category: Category) -> i32 {
+    match category {
+        Category::ModifiedBackup => EXIT_MODIFIED_BACKUP,
+        Category::ModifiedRepo => EXIT_MODIFIED_REPO,
+        _ => EXIT_DIFFERENT,
+    }
+}
+
+// Computes the diff, or fetches it from the daemon if a socket is configured.
+fn entries(app: &App, socket: Option<&str>) -> Result<Vec<Entry>> {
+    match socket {
+        Some(socket) => {
+            let mut all = daemon::query(socket)?;
+            all.retain(|e| app.in_scope(&e.path));
+            Ok(all)
+        }
+        None => Ok(app.diff()),
+    }
+}
+
+fn diff(app: &App, opts: &DiffArgs, output: &Output, config: &Config) -> Result<i32> {
+    let check_only = match &opts.check_only {
+        Some(codes) => codes
+            .chars()
+            .map(|c| Category::from_code(c).ok_or_else(|| anyhow!("unknown category {}", c)))
+            .collect::<Result<Vec<_>>>()?,
+        None => Category::ALL.to_vec(),
+    };
+    if opts.stream {
+        let status = stream(app, opts, output, config, &check_only)?;
+        if interrupt::interrupted() {
+            return Err(anyhow!("interrupted, the differences shown are incomplete"));
+        }
+        return Ok(status);
+    }
+    let start = Instant::now();
+    let mut all = entries(app, config.socket.as_deref())?;
+    let elapsed = start.elapsed();
+    // an interrupted diff is still shown, but cannot be compared to or saved
+    // as the last run
+    let partial = interrupt::interrupted();
+    if partial && opts.since_last_run {
+        return Err(anyhow!("interrupted, the last run was not updated"));
+    }
+    if partial {
+        log::warn!("interrupted, showing the differences found so far");
+    }
+    if opts.since_last_run {
+        let state = config.state.as_deref().unwrap_or(DEFAULT_STATE);
+        all = app.since_last_run(all, state)?;
+    }
+    // package differences have no path, so only plain output shows them
+    let plain = !opts.print0
+        && !opts.show_diff
+        && opts.exec.is_empty()
+        && output.template.is_none()
+        && output.separator.is_none()
+        && !output.yaml;
+    let packages = if plain && !opts.since_last_run && !partial {
+        app.package_diff()
+    } else {
+        vec![]
+    };
+    let mut status = all
+        .iter()
+        .filter(|e| check_only.contains(&e.category))
+        .map(|e| exit_status(e.category))
+        .max()
+        .unwrap_or(0);
+    if opts.check_only.is_none() && !packages.is_empty() {
+        status = status.max(EXIT_DIFFERENT);
+    }
+    if opts.quiet > 1 {
+        // only the exit status is of interest
+    } else if opts.quiet == 1 {
+        let mut counts = BTreeMap::new();
+        for e in &all {
+            *counts.entry(e.category).or_insert(0) += 1;
+        }
+        print_counts(output, &counts, &packages);
+    } else if opts.stats {
+        stats(app, &all, output, elapsed);
+    } else if opts.print0 {
+        let mut out = std::io::stdout();
+        for e in &all {
+            write!(out, "{}{}\0", app.root(), e.path)?;
+        }
+        out.flush()?;
+    } else if opts.show_diff {
+        for e in &all {
+            let path = format!("{}{}", app.root(), e.path);
+            println!("{}", output.entry(app.root(), e));
+            let shown = match app.original(e) {
+                Ok(Some(original)) => show_diff(&original, &path),
+                Ok(None) => Ok(()),
+                Err(err) => Err(err),
+            };
+            if let Err(err) = shown {
+                log::error!("{:#}", err);
+            }
+        }
+    } else if !opts.exec.is_empty() {
+        exec(app, &opts.exec, &all)?;
+    } else if output.yaml {
+        let snapshot = serde_json::to_value(app.snapshot(all))?;
+        print!("{}", archdiff::yaml::to_string(&snapshot));
+    } else if let Some(separator) = output.separator {
+        print_table(app, all, separator);
+    } else if output.tree {
+        let empty = all.is_empty();
+        print_tree(app, all, output);
+        print_packages(&packages, output, empty);
+    } else if let Some(template) = &output.template {
+        let owners = app.owners();
+        for e in &all {
+            println!("{}", template.render(&fields(app, &owners, e)));
+        }
+    } else {
+        let empty = all.is_empty();
+        print_diff(app, all, output);
+        print_packages(&packages, output, empty);
+    }
+    if partial {
+        return Err(anyhow!("interrupted, the differences shown are incomplete"));
+    }
+    Ok(if opts.check { status } else { 0 })
+}
+
+// Prints the number and total size of the entries per category, top level
+// dir and package, and how long the scan took.
+fn stats(app: &App, all: &[Entry], output: &Output, elapsed: Duration) {
+    let owners = app.owners();
+    let mut categories: BTreeMap<Category, (usize, u64)> = BTreeMap::new();
+    let mut dirs: BTreeMap<String, (usize, u64)> = BTreeMap::new();
+    let mut packages: BTreeMap<String, (usize, u64)> = BTreeMap::new();
+    for e in all {
+        let size = std::fs::symlink_metadata(format!("{}{}", app.root(), e.path))
+            .map(|md| md.len())
+            .unwrap_or(0);
+        let dir = match e.path.find('/') {
+            Some(i) => format!("{}{}", app.root(), &e.path[..i]),
+            None => app.root().to_string(),
+        };
+        let pkg = package(&owners, &e.path).map_or("unpackaged", String::as_str);
+        for stat in [
+            categories.entry(e.category).or_default(),
+            dirs.entry(dir).or_default(),
+            packages.entry(pkg.to_string()).or_default(),
+        ] {
+            stat.0 += 1;
+            stat.1 += size;
+        }
+    }
+    let line = |(n, size): (usize, u64)| format!("{} files, {}", n, human_size(size));
+    println!("categories:");
+    for (c, stat) in categories {
+        println!("  {}: {}", output.paint(c, c.label()), line(stat));
+    }
+    println!("\ndirs:");
+    for (dir, stat) in dirs {
+        println!("  {}: {}", dir, line(stat));
+    }
+    println!("\npackages:");
+    for (pkg, stat) in packages {
+        println!("  {}: {}", pkg, line(stat));
+    }
+    println!("\nscanned in {:.1}s", elapsed.as_secs_f64());
+}
+
+// Formats a number of bytes using binary units.
+fn human_size(bytes: u64) -> String {
+    if bytes < 1024 {
+        return format!("{} B", bytes);
+    }
+    let mut size = bytes as f64 / 1024.0;
+    for unit in &["KiB", "MiB", "GiB"] {
+        if size < 1024.0 {
+            return format!("{:.1} {}", size, unit);
+        }
+        size /= 1024.0;
+    }
+    format!("{:.1} TiB", size)
+}
+
+// The template fields for an entry.
+fn fields<'a>(app: &App, owners: &HashMap<String, String>, e: &Entry) -> HashMap<&'a str, String> {
+    let mut fields = HashMap::new();
+    fields.insert("path", format!("{}{}", app.root(), e.path));
+    fields.insert("code", e.category.code().to_string());
+    fields.insert("category", e.category.label().to_string());
+    if let Some(pkg) = package(owners, &e.path) {
+        fields.insert("package", pkg.clone());
+    }
+    fields
+}
+
+// Finds the package owning a path, or the base file of a .pacnew or .pacsave
+// file.
+fn package<'a>(owners: &'a HashMap<String, String>, path: &str) -> Option<&'a String> {
+    owners
+        .get(path)
+        .or_else(|| pacfile_base(path).and_then(|(_, base)| owners.get(base)))
+}
+
+// Runs a command for each entry, with the template fields replaced in each
+// argument, and fails if any of them fail.
+fn exec(app: &App, args: &[String], all: &[Entry]) -> Result<()> {
+    let args = args
+        .iter()
+        .map(|arg| arg.replace("{}", "{path}").parse())
+        .collect::<Result<Vec<Template>>>()?;
+    let owners = app.owners();
+    let mut failed = 0;
+    for e in all {
+        let fields = fields(app, &owners, e);
+        let argv: Vec<String> = args.iter().map(|arg| arg.render(&fields)).collect();
+        let status = std::process::Command::new(&argv[0])
+            .args(&argv[1..])
+            .status()
+            .with_context(|| format!("failed to run {}", argv[0]))?;
+        if !status.success() {
+            log::error!("{} failed for {}: {}", argv[0], fields["path"], status);
+            failed += 1;
+        }
+    }
+    if failed > 0 {
+        return Err(anyhow!("--exec failed for {} differences", failed));
+    }
+    Ok(())
+}
+
+// Prints entries as the diff finds them, returning the exit status for the
+// check, or 0 without it.
+fn stream(
+    app: &App,
+    opts: &DiffArgs,
+    output: &Output,
+    config: &Config,
+    check_only: &[Category],
+) -> Result<i32> {
+    if output.group_by.is_some()
+        || output.template.is_some()
+        || output.tree
+        || output.separator.is_some()
+        || output.yaml
+        || !opts.exec.is_empty()
+    {
+        return Err(anyhow!("--stream only supports plain output"));
+    }
+    if opts.since_last_run || opts.show_diff || config.socket.is_some() {
+        return Err(anyhow!(
+            "--stream cannot be used with --since-last-run, --diff or --socket"
+        ));
+    }
+    let status = AtomicI32::new(0);
+    let counts = Mutex::new(BTreeMap::new());
+    let root = app.root();
+    app.diff_stream(|e| {
+        if opts.check && check_only.contains(&e.category) {
+            status.fetch_max(exit_status(e.category), Ordering::Relaxed);
+        }
+        if opts.quiet > 0 {
+            *counts.lock().unwrap().entry(e.category).or_insert(0) += 1;
+        } else if opts.print0 {
+            print!("{}{}\0", root, e.path);
+        } else {
+            println!("{}", output.entry(root, &e));
+        }
+    });
+    // the counts are only known once the diff is done, and package
+    // differences are left out like the rest of the streamed output
+    if opts.quiet == 1 {
+        print_counts(output, &counts.into_inner().unwrap(), &[]);
+    }
+    std::io::stdout().flush()?;
+    Ok(status.into_inner())
+}
+
+// Runs diff to compare the original contents against a file.
+fn show_diff(original: &[u8], path: &str) -> Result<()> {
+    let label = format!("{} (original)", path);
+    unified_diff(("-", &label), (path, path), original)
+}
+
+// Like show_diff, but returns the diff instead of printing it.
+fn diff_text(original: &[u8], path: &str) -> Result<String> {
+    let label = format!("{} (original)", path);
+    let mut child = diff_command(("-", &label), (path, path))
+        .stdout(std::process::Stdio::piped())
+        .spawn()
+        .context("failed to run diff")?;
+    // diff reads both files before printing anything, so the input can be
+    // written before the output is read
+    if let Some(mut stdin) = child.stdin.take() {
+        stdin.write_all(original)?;
+    }
+    let output = child.wait_with_output()?;
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+// Builds diff -u on two files given with their labels, where - reads stdin.
+fn diff_command(old: (&str, &str), new: (&str, &str)) -> std::process::Command {
+    let mut cmd = std::process::Command::new("diff");
+    cmd.arg("-u")
+        .arg("--label")
+        .arg(old.1)
+        .arg("--label")
+        .arg(new.1)
+        .arg(old.0)
+        .arg(new.0)
+        .stdin(std::process::Stdio::piped());
+    cmd
+}
+
+// Runs diff -u on two files given with their labels, where - reads the
+// contents given as input.
+fn unified_diff(old: (&str, &str), new: (&str, &str), input: &[u8]) -> Result<()> {
+    let mut child = diff_command(old, new)
+        .spawn()
+        .context("failed to run diff")?;
+    if let Some(mut stdin) = child.stdin.take() {
+        stdin.write_all(input)?;
+    }
+    child.wait()?;
+    Ok(())
+}
+
+fn print_diff(app: &App, all: Vec<Entry>, output: &Output) {
+    let root = app.root();
+    let (mut all, counts) = if output.expand {
+        (all, HashMap::new())
+    } else {
+        app.collapse(all)
+    };
+    let files = |e: &Entry| match counts.get(&e.path) {
+        Some(n) => format!(" ({} files)", n),
+        None => String::new(),
+    };
+    if output.group_by == Some(GroupBy::Package) {
+        // unpackaged files sort last, in their own section
+        let owners = app.owners();
+        let foreign = app.foreign_packages();
+        let mut all: Vec<_> = all.iter().map(|e| (package(&owners, &e.path), e)).collect();
+        all.sort_by(|a, b| (a.0.is_none(), a).cmp(&(b.0.is_none(), b)));
+        let mut last = None;
+        for (owner, e) in all {
+            if last != Some(owner) {
+                if last.is_some() {
+                    println!();
+                }
+                match owner {
+                    Some(pkg) if foreign.contains(pkg) => println!("{} (foreign):", pkg),
+                    Some(pkg) => println!("{}:", pkg),
+                    None => println!("unpackaged:"),
                 }
-                let path = &de.path().to_string_lossy()[repo_len..];
-                pkg_backup_files.remove(path);
-                let repo_hash = match hash_file_logged(de.path()) {
-                    None => return,
-                    Some(h) => h,
-                };
-                let actual_hash = match hash_file_logged(&format!("{}{}", &root, path)) {
-                    None => return,
-                    Some(h) => h,
-                };
-                if repo_hash != actual_hash {
-                    all.push(('R', path.to_string()));
+                last = Some(owner);
+            }
+            println!("  {}{}", output.entry(root, e), files(e));
+        }
+    } else if output.group_by == Some(GroupBy::Category) {
+        all.sort();
+        let mut last = None;
+        for e in &all {
+            if last != Some(e.category) {
+                if last.is_some() {
+                    println!();
                 }
+                println!("{}:", output.paint(e.category, e.category.label()));
+                last = Some(e.category);
+            }
+            let path = format!("{}{}", root, e.path);
+            if output.long {
+                println!("  {} {}{}", long_listing(&path), path, files(e));
+            } else {
+                println!("  {}{}", path, files(e));
+            }
+        }
+    } else {
+        all.iter()
+            .for_each(|e| println!("{}{}", output.entry(root, e), files(e)));
+    }
+}
+
+// Prints the entries as a table with a header row, one column per field,
+// quoting fields as needed for csv and escaping tabs and newlines for tsv.
+fn print_table(app: &App, all: Vec<Entry>, separator: char) {
+    let field = |s: &str| -> String {
+        if separator == '\t' {
+            s.replace('\\', "\\\\")
+                .replace('\t', "\\t")
+                .replace('\n', "\\n")
+        } else if s.contains(&[',', '"', '\n', '\r'][..]) {
+            format!("\"{}\"", s.replace('"', "\"\""))
+        } else {
+            s.to_string()
+        }
+    };
+    let sep = separator.to_string();
+    println!(
+        "{}",
+        ["path", "code", "category", "package", "size", "mtime", "hash"].join(&sep)
+    );
+    let owners = app.owners();
+    let snapshot = app.snapshot(all);
+    for e in &snapshot.entries {
+        let row = [
+            format!("{}{}", app.root(), e.path),
+            e.category.code().to_string(),
+            e.category.label().to_string(),
+            package(&owners, &e.path).cloned().unwrap_or_default(),
+            e.size.map(|s| s.to_string()).unwrap_or_default(),
+            e.mtime.map(|t| t.to_string()).unwrap_or_default(),
+            e.hash.clone().unwrap_or_default(),
+        ];
+        let row: Vec<String> = row.iter().map(|s| field(s)).collect();
+        println!("{}", row.join(&sep));
+    }
+}
+
+// Node is a dir in the tree output, with the number of files per category
+// under it.
+#[derive(Default)]
+struct Node {
+    dirs: BTreeMap<String, Node>,
+    files: Vec<(String, Entry)>,
+    counts: BTreeMap<Category, usize>,
+}
+
+impl Node {
+    fn insert(&mut self, name: &str, e: Entry, n: usize) {
+        *self.counts.entry(e.category).or_default() += n;
+        match name.find('/') {
+            // collapsed dirs end in a slash and are shown like files
+            Some(i) if i + 1 < name.len() => self
+                .dirs
+                .entry(name[..=i].to_string())
+                .or_default()
+                .insert(&name[i + 1..], e, n),
+            _ => self.files.push((name.to_string(), e)),
+        }
+    }
+
+    // Describes the counts, as in "3 M, 12 ?".
+    fn summary(&self, output: &Output) -> String {
+        let counts: Vec<String> = self
+            .counts
+            .iter()
+            .map(|(c, n)| output.paint(*c, &format!("{} {}", n, c.code())))
+            .collect();
+        counts.join(", ")
+    }
+
+    fn print(&self, indent: usize, output: &Output, files: &dyn Fn(&Entry) -> String) {
+        for (name, dir) in &self.dirs {
+            // dirs with a single dir in them are joined, as in usr/share/
+            let mut name = name.clone();
+            let mut dir = dir;
+            while dir.files.is_empty() && dir.dirs.len() == 1 {
+                let (child, next) = dir.dirs.iter().next().unwrap();
+                name.push_str(child);
+                dir = next;
+            }
+            println!(
+                "{:indent$}{} ({})",
+                "",
+                name,
+                dir.summary(output),
+                indent = indent
+            );
+            dir.print(indent + 2, output, files);
+        }
+        for (name, e) in &self.files {
+            let line = format!("{} {}", e.category.code(), name);
+            println!(
+                "{:indent$}{}{}",
+                "",
+                output.paint(e.category, &line),
+                files(e),
+                indent = indent
+            );
+        }
+    }
+}
+
+// Prints the entries as an indented tree of dirs, each with the number of
+// differences under it per category.
+fn print_tree(app: &App, all: Vec<Entry>, output: &Output) {
+    let (all, counts) = if output.expand {
+        (all, HashMap::new())
+    } else {
+        app.collapse(all)
+    };
+    let mut root = Node::default();
+    for e in all {
+        let n = counts.get(&e.path).copied().unwrap_or(1);
+        let path = e.path.clone();
+        root.insert(&path, e, n);
+    }
+    if root.counts.is_empty() {
+        return;
+    }
+    println!("{} ({})", app.root(), root.summary(output));
+    let files = |e: &Entry| match counts.get(&e.path) {
+        Some(n) => format!(" ({} files)", n),
+        None => String::new(),
+    };
+    root.print(2, output, &files);
+}
+
+// Prints the package differences in their own section after the files.
+fn print_packages(packages: &[PackageEntry], output: &Output, first: bool) {
+    if packages.is_empty() {
+        return;
+    }
+    if !first {
+        println!();
+    }
+    println!("packages:");
+    for p in packages {
+        let line = format!("{} {}", p.category.label(), p.name);
+        println!("  {}", output.paint_package(p.category, &line));
+    }
+}
+
+// Prints the packaged files that differ from the package, and returns
+// EXIT_DIFFERENT if there are any.
+fn verify(app: &App, opts: &VerifyArgs, output: &Output) -> Result<i32> {
+    let owners = app.owners();
+    let all: Vec<Entry> = app
+        .diff()
+        .into_iter()
+        .filter(|e| {
+            matches!(
+                e.category,
+                Category::Deleted
+                    | Category::Modified
+                    | Category::ModifiedBackup
+                    | Category::Metadata
+            )
+        })
+        .filter(|e| {
+            opts.packages.is_empty()
+                || matches!(owners.get(&e.path), Some(pkg) if opts.packages.contains(pkg))
+        })
+        .collect();
+    let failed = !all.is_empty();
+    print_diff(app, all, output);
+    if interrupt::interrupted() {
+        return Err(anyhow!("interrupted, the differences shown are incomplete"));
+    }
+    Ok(if failed { EXIT_DIFFERENT } else { 0 })
+}
+
+fn status(app: &App, output: &Output, socket: Option<&str>) -> Result<()> {
+    let mut counts = BTreeMap::new();
+    for e in entries(app, socket)? {
+        *counts.entry(e.category).or_insert(0) += 1;
+    }
+    print_counts(output, &counts, &app.package_diff());
+    Ok(())
+}
+
+// Prints the number of differences per category, followed by the number of
+// package differences per category.
+fn print_counts(output: &Output, counts: &BTreeMap<Category, usize>, packages: &[PackageEntry]) {
+    for (c, n) in counts {
+        println!("{}: {}", output.paint(*c, c.label()), n);
+    }
+    let mut package_counts = BTreeMap::new();
+    for p in packages {
+        *package_counts.entry(p.category).or_insert(0) += 1;
+    }
+    for (c, n) in package_counts {
+        let label = format!("{} packages", c.label());
+        println!("{}: {}", output.paint_package(c, &label), n);
+    }
+}
+
+// Returns EXIT_DIFFERENT if any of the paths has differences.
+fn is_dirty(app: &App, opts: &IsDirtyArgs, socket: Option<&str>) -> Result<i32> {
+    let dirs = opts
+        .paths
+        .iter()
+        .map(|p| Ok(std::env::current_dir()?.join(p)))
+        .collect::<Result<Vec<_>>>()?;
+    let dirty = entries(app, socket)?.iter().any(|e| {
+        let path = Path::new(app.root()).join(&e.path);
+        dirs.iter().any(|d| path.starts_with(d))
+    });
+    Ok(if dirty { EXIT_DIFFERENT } else { 0 })
+}
+
+fn metrics(app: &App, opts: &MetricsArgs, socket: Option<&str>) -> Result<()> {
+    let start = Instant::now();
+    let all = entries(app, socket)?;
+    let text = archdiff::metrics::render(&all, start.elapsed(), SystemTime::now());
+    match &opts.output {
+        Some(path) => archdiff::metrics::write(path, &text)?,
+        None => print!("{}", text),
+    }
+    Ok(())
+}
+
+fn snapshot(app: &App, opts: &SnapshotArgs, socket: Option<&str>) -> Result<()> {
+    let snapshot = app.snapshot(entries(app, socket)?);
+    match &opts.output {
+        Some(path) => snapshot.save(path)?,
+        None => println!("{}", serde_json::to_string_pretty(&snapshot)?),
+    }
+    Ok(())
+}
+
+fn export(app: &App, opts: &ExportArgs, socket: Option<&str>) -> Result<()> {
+    let n = app.export(&entries(app, socket)?, &opts.output)?;
+    eprintln!("archived {} files into {}", n, opts.output);
+    Ok(())
+}
+
+// Prints the version along with the commit and rustc it was built with, which
+// build.rs records, and the version of the linked libalpm, if any.
+fn version() {
+    println!("archdiff {}", env!("CARGO_PKG_VERSION"));
+    println!("commit {}", env!("ARCHDIFF_COMMIT"));
+    println!("{}", env!("ARCHDIFF_RUSTC"));
+    #[cfg(feature = "alpm")]
+    println!("libalpm {}", alpm::version());
+    #[cfg(not(feature = "alpm"))]
+    println!("libalpm none, built without it");
+}
+
+// Prints paths that only differ in the new snapshot (+), only differed in the
+// old one (-), or differ in both but in a different way (~).
+fn compare(opts: &CompareArgs, output: &Output) -> Result<()> {
+    let old = Snapshot::load(&opts.old)?;
+    let new = Snapshot::load(&opts.new)?;
+    if opts.hosts {
+        return compare_hosts(&old, &new, output);
+    }
+    for change in old.compare(&new)? {
+        let (sign, e) = match &change {
+            Change::Added(e) => ('+', e),
+            Change::Removed(e) => ('-', e),
+            Change::Changed(_, e) => ('~', e),
+        };
+        let line = format!("{} {} {}{}", sign, e.category.code(), new.root, e.path);
+        println!("{}", output.paint(e.category, &line));
+    }
+    Ok(())
+}
+
+// Prints paths that only differ on the first host (-), only on the second
+// (+), or on both but with different contents (~), along with the category
+// on each host.
+fn compare_hosts(a: &Snapshot, b: &Snapshot, output: &Output) -> Result<()> {
+    let name = |s: &Snapshot| {
+        if s.host.is_empty() {
+            "?"
+        } else {
+            s.host.as_str()
+        }
+        .to_string()
+    };
+    println!("--- {}", name(a));
+    println!("+++ {}", name(b));
+    for change in a.compare_hosts(b)? {
+        let (line, category) = match &change {
+            Change::Removed(e) => (format!("- {} {}", e.category.code(), e.path), e.category),
+            Change::Added(e) => (format!("+ {} {}", e.category.code(), e.path), e.category),
+            Change::Changed(x, y) => (
+                format!("~ {}{} {}", x.category.code(), y.category.code(), y.path),
+                y.category,
+            ),
+        };
+        println!("{}", output.paint(category, &line));
+    }
+    Ok(())
+}
+
+fn roots(args: &RootsArgs, opts: &Options, output: &Output) -> Result<()> {
+    let tree = |root: &str, dbpath: &Option<String>| -> Result<Tree> {
+        let packages = match dbpath {
+            Some(dbpath) => Some(opts.backend.open(root, dbpath, &[])?.1),
+            None => None,
+        };
+        Ok(Tree {
+            root: root.to_string(),
+            packages,
+        })
+    };
+    let first = tree(&args.first, &args.first_dbpath)?;
+    let second = tree(&args.second, &args.second_dbpath)?;
+    for p in roots::compare_packages(&first, &second) {
+        let (sign, category) = match (&p.first, &p.second) {
+            (Some(_), None) => ('-', Category::Deleted),
+            (None, Some(_)) => ('+', Category::Unpackaged),
+            _ => ('~', Category::Modified),
+        };
+        let line = format!(
+            "{} package {} {} {}",
+            sign,
+            p.name,
+            p.first.as_deref().unwrap_or("-"),
+            p.second.as_deref().unwrap_or("-")
+        );
+        println!("{}", output.paint(category, &line));
+    }
+    for (path, difference) in roots::compare(&first, &second) {
+        let (sign, category) = match difference {
+            Difference::Removed => ('-', Category::Deleted),
+            Difference::Added => ('+', Category::Unpackaged),
+            Difference::Metadata => ('~', Category::Metadata),
+            _ => ('~', Category::Modified),
+        };
+        let line = format!("{} /{} ({})", sign, path, difference.label());
+        println!("{}", output.paint(category, &line));
+    }
+    Ok(())
+}
+
+// Pushes a snapshot to the server every interval. Failures are logged and
+// retried at the next interval, so a server restart loses nothing.
+fn agent(app: &App, opts: &AgentArgs) -> Result<()> {
+    let host = archdiff::hostname()?;
+    let url = format!(
+        "{}/hosts/{}",
+        opts.server.trim_end_matches('/'),
+        http::encode(&host)
+    );
+    let token = match &opts.token_file {
+        Some(path) => Some(
+            std::fs::read_to_string(path)
+                .with_context(|| format!("failed to read {}", path))?
+                .trim()
+                .to_string(),
+        ),
+        None => None,
+    };
+    loop {
+        let snapshot = app.snapshot(app.diff());
+        let pushed = http::post(&url, &serde_json::to_vec(&snapshot)?, token.as_deref());
+        if opts.once {
+            return pushed;
+        }
+        if let Err(err) = pushed {
+            log::error!("{:#}", err);
+        }
+        std::thread::sleep(Duration::from_secs(opts.interval));
+    }
+}
+
+fn server(opts: &ServerArgs) -> Result<()> {
+    let fleet = Fleet::new(&opts.dir, Tokens::load(&opts.tokens)?)?;
+    let listener = http::listen(&opts.listen)?;
+    eprintln!("listening on {}", opts.listen);
+    http::serve(listener, |req| fleet.handle(req));
+    Ok(())
+}
+
+// Tells systemd about the state of the daemon, logging rather than failing
+// when it cannot be reached.
+fn notify(state: &str) {
+    if let Err(err) = systemd::notify(state) {
+        log::error!("{:#}", err);
+    }
+}
+
+// Serves the diff on the socket, and over HTTP if an address is given,
+// recomputing it whenever something changes.
+fn run_daemon(
+    app: &App,
+    socket: &str,
+    opts: &DaemonArgs,
+    config: &Config,
+    hooks: &Hooks,
+) -> Result<()> {
+    let mut watcher = watcher(app, config)?;
+    let entries = Arc::new(RwLock::new(app.diff()));
+    daemon::serve(socket, entries.clone())?;
+    let listener = match &opts.http {
+        Some(addr) => Some(http::listen(addr)?),
+        None => None,
+    };
+    let n = entries
+        .read()
+        .map_err(|_| anyhow!("entries lock poisoned"))?
+        .len();
+    notify(&format!("READY=1\nSTATUS={} differences", n));
+    let stop = AtomicBool::new(false);
+    std::thread::scope(|s| {
+        if let Some(listener) = listener {
+            let (entries, stop) = (&entries, &stop);
+            s.spawn(move || http::serve_until(listener, |req| api(app, entries, req), stop));
+        }
+        let result = update_loop(app, &mut watcher, &entries, hooks);
+        // the scope waits for the HTTP thread, so it is stopped for the error
+        // to be returned
+        stop.store(true, Ordering::Relaxed);
+        result
+    })
+}
+
+// Updates the diff at the paths that change whenever something does, until an
+// error. The watchdog is pinged from here, so a stuck diff stops the pings and
+// systemd restarts the daemon. This means WatchdogSec= has to be longer than a
+// diff takes.
+fn update_loop(
+    app: &App,
+    watcher: &mut Watcher,
+    entries: &RwLock<Vec<Entry>>,
+    hooks: &Hooks,
+) -> Result<()> {
+    let watchdog = systemd::watchdog_interval();
+    let mut last: BTreeSet<Entry> = if hooks.is_empty() {
+        BTreeSet::new()
+    } else {
+        entries
+            .read()
+            .map_err(|_| anyhow!("entries lock poisoned"))?
+            .iter()
+            .cloned()
+            .collect()
+    };
+    loop {
+        if watchdog.is_some() {
+            notify("WATCHDOG=1");
+        }
+        let changed = match watcher.wait_timeout(Duration::from_millis(500), watchdog)? {
+            Some(changed) => changed,
+            None => continue,
+        };
+        notify("STATUS=updating the diff");
+        // the lock is only held to copy the entries, not while updating them
+        let previous = entries
+            .read()
+            .map_err(|_| anyhow!("entries lock poisoned"))?
+            .clone();
+        let current = app.update(&previous, &changed);
+        let n = current.len();
+        if !hooks.is_empty() {
+            let next: BTreeSet<Entry> = current.iter().cloned().collect();
+            hooks.run(app.root(), &last, &next);
+            last = next;
+        }
+        *entries
+            .write()
+            .map_err(|_| anyhow!("entries lock poisoned"))? = current;
+        notify(&format!("STATUS={} differences", n));
+    }
+}
+
+// Answers the HTTP API of the daemon:
+//
+// - GET /diff lists the differences, only those in the categories given with
+//   ?category= by name or code if any.
+// - GET /file/PATH shows the difference of a path, along with a unified diff
+//   against its repo or package copy when there is one.
+fn api(app: &App, entries: &RwLock<Vec<Entry>>, req: &http::Request) -> http::Response {
+    if req.method != "GET" {
+        return http::Response::error(405, "method not allowed");
+    }
+    let entries = match entries.read() {
+        Ok(entries) => entries,
+        Err(_) => return http::Response::error(500, "entries lock poisoned"),
+    };
+    let json = |e: &Entry| {
+        serde_json::json!({
+            "path": format!("{}{}", app.root(), e.path),
+            "category": e.category,
+            "code": e.category.code().to_string(),
+        })
+    };
+    if req.path == "/diff" {
+        let mut categories = vec![];
+        for (k, v) in &req.query {
+            if k != "category" {
+                continue;
+            }
+            let category = Category::ALL.iter().copied().find(|c| {
+                serde_json::to_value(c)
+                    .ok()
+                    .as_ref()
+                    .and_then(|c| c.as_str())
+                    == Some(v)
+                    || v.chars().eq(std::iter::once(c.code()))
             });
+            match category {
+                Some(category) => categories.push(category),
+                None => return http::Response::error(400, &format!("unknown category {}", v)),
+            }
+        }
+        let all: Vec<_> = entries
+            .iter()
+            .filter(|e| categories.is_empty() || categories.contains(&e.category))
+            .map(json)
+            .collect();
+        return http::Response::json(&all);
+    }
+    if let Some(path) = req.path.strip_prefix("/file/") {
+        // the entry is cloned so the lock is not held while the original is
+        // read and diffed, which would hold up the next rescan
+        let e = match entries.iter().find(|e| e.path == path) {
+            Some(e) => e.clone(),
+            None => return http::Response::error(404, &format!("no difference at /{}", path)),
+        };
+        drop(entries);
+        let diff = match app.original(&e) {
+            Ok(Some(original)) => diff_text(&original, &format!("{}{}", app.root(), e.path)),
+            Ok(None) => Ok(String::new()),
+            Err(err) => Err(err),
+        };
+        return match diff {
+            Ok(diff) => {
+                let mut value = json(&e);
+                value["diff"] = serde_json::Value::String(diff);
+                http::Response::json(&value)
+            }
+            Err(err) => http::Response::error(500, &format!("{:#}", err)),
+        };
+    }
+    http::Response::error(404, "not found")
+}
 
-        // deleted files from packages
-        all.par_extend(pkg_files.into_par_iter().filter_map(|p| {
-            let fp = format!("{}{}", &root, &p);
-            if ignored.matched(&fp, false).is_ignore() {
-                None
+fn apply(app: &App, opts: &ApplyArgs) -> Result<()> {
+    if opts.plan {
+        if opts.packages {
+            for argv in pacman_commands(app, opts.remove_unlisted) {
+                println!("{}", argv.join(" "));
+            }
+        }
+        return plan(app, opts.delete);
+    }
+    if !opts.dry_run && !opts.force {
+        if let Some(repo) = app.dirty_repos()?.first() {
+            return Err(anyhow!(
+                "{} has uncommitted changes, use --force to apply anyway",
+                repo
+            ));
+        }
+    }
+    // packages go first, since they may provide files the repo overrides
+    if opts.packages {
+        for argv in pacman_commands(app, opts.remove_unlisted) {
+            if opts.dry_run {
+                println!("{}", argv.join(" "));
+                continue;
+            }
+            let status = std::process::Command::new(&argv[0])
+                .args(&argv[1..])
+                .status()
+                .context("failed to run pacman")?;
+            if !status.success() {
+                return Err(anyhow!("{} failed: {}", argv.join(" "), status));
+            }
+        }
+    }
+    let backup = Backup::new(DEFAULT_BACKUPS, app.root());
+    for (action, p) in app.plan() {
+        let dst = format!("{}{}", app.root(), p);
+        if opts.dry_run {
+            println!("{}", dst);
+            continue;
+        }
+        if opts.interactive && !confirm(&format!("apply {}?", dst))? {
+            continue;
+        }
+        backup.save(&p)?;
+        match action {
+            Action::Chmod(_) => app.apply_metadata(&p)?,
+            _ => app.apply_file(&p)?,
+        }
+        println!("{}", dst);
+    }
+    if opts.delete {
+        for p in app.removed_repo_files(DEFAULT_SYNCED)? {
+            let dst = format!("{}{}", app.root(), p);
+            if opts.dry_run {
+                println!("{} (removed)", dst);
+                continue;
+            }
+            if opts.interactive && !confirm(&format!("remove {}?", dst))? {
+                continue;
+            }
+            backup.save(&p)?;
+            app.remove_file(&p)?;
+            println!("{} (removed)", dst);
+        }
+    }
+    if !opts.dry_run {
+        app.record_repo_files(DEFAULT_SYNCED)?;
+    }
+    Ok(())
+}
+
+fn undo(app: &App) -> Result<()> {
+    let latest = backup::latest(DEFAULT_BACKUPS)?
+        .ok_or_else(|| anyhow!("no backups in {}", DEFAULT_BACKUPS))?;
+    for path in backup::undo(app.root(), &latest)? {
+        println!("{}", path);
+    }
+    Ok(())
+}
+
+// The pacman commands that install the missing packages and, if remove is
+// true, remove the unlisted ones.
+fn pacman_commands(app: &App, remove: bool) -> Vec<Vec<String>> {
+    let mut missing = vec![];
+    let mut unlisted = vec![];
+    for p in app.package_diff() {
+        match p.category {
+            PackageCategory::Missing => missing.push(p.name),
+            PackageCategory::Unlisted => unlisted.push(p.name),
+            PackageCategory::Foreign | PackageCategory::Orphan => (),
+        }
+    }
+    let pacman = |args: &[&str], names: Vec<String>| {
+        let mut argv = vec!["pacman".to_string()];
+        if app.root() != "/" {
+            argv.push("--sysroot".to_string());
+            argv.push(app.root().to_string());
+        }
+        argv.extend(args.iter().map(|a| a.to_string()));
+        argv.extend(names);
+        argv
+    };
+    let mut commands = vec![];
+    if !missing.is_empty() {
+        commands.push(pacman(&["-S", "--needed"], missing));
+    }
+    if remove && !unlisted.is_empty() {
+        commands.push(pacman(&["-Rs"], unlisted));
+    }
+    commands
+}
+
+// Prints what apply would do to each file, with a diff for content changes.
+fn plan(app: &App, delete: bool) -> Result<()> {
+    if delete {
+        for p in app.removed_repo_files(DEFAULT_SYNCED)? {
+            println!("remove {}{}", app.root(), p);
+        }
+    }
+    for (action, p) in app.plan() {
+        let dst = format!("{}{}", app.root(), p);
+        match &action {
+            Action::Create => println!("create {}", dst),
+            Action::Overwrite => println!("overwrite {}", dst),
+            Action::Link(target) => println!("link {} -> {}", dst, target.display()),
+            Action::Chmod(meta) => println!(
+                "chmod {} to mode {:04o} owner {}:{}",
+                dst, meta.mode, meta.uid, meta.gid
+            ),
+        }
+        if let Action::Create | Action::Overwrite = action {
+            let entry = Entry {
+                category: Category::ModifiedRepo,
+                path: p,
+            };
+            let contents = app.original(&entry)?.unwrap_or_default();
+            let old = if let Action::Create = action {
+                "/dev/null"
             } else {
-                match std::fs::metadata(&fp).with_context(|| format!("failed to stat {}", fp)) {
-                    Err(_) => Some(('D', p)),
-                    Ok(_) => None,
-                }
+                &dst
+            };
+            let label = format!("{} (repo)", dst);
+            unified_diff((old, &dst), ("-", &label), &contents)?;
+        }
+    }
+    Ok(())
+}
+
+fn adopt(app: &App, opts: &AdoptArgs) -> Result<()> {
+    for path in &opts.paths {
+        println!("{}", app.adopt(path, opts.encrypt)?.display());
+    }
+    if opts.commit {
+        let paths: Vec<_> = opts.paths.iter().map(|p| p.display().to_string()).collect();
+        app.commit_adopted(&format!("adopt {}", paths.join(" ")))?;
+    }
+    Ok(())
+}
+
+// Prints the three-way merge of each file, or writes it onto the file.
+fn merge(app: &App, opts: &MergeArgs) -> Result<()> {
+    let backup = Backup::new(DEFAULT_BACKUPS, app.root());
+    let mut conflicts = 0;
+    for path in &opts.paths {
+        let (merged, conflicted) = app.merge(path)?;
+        if conflicted {
+            log::error!("conflicts in {}", path.display());
+            conflicts += 1;
+        }
+        if !opts.write || conflicted {
+            std::io::stdout().write_all(&merged)?;
+            continue;
+        }
+        let abs = std::env::current_dir()?.join(path);
+        let rel = abs.strip_prefix(app.root()).unwrap_or(&abs);
+        backup.save(&rel.to_string_lossy())?;
+        std::fs::write(&abs, merged)
+            .with_context(|| format!("failed to write {}", abs.display()))?;
+        println!("{}", abs.display());
+    }
+    if conflicts > 0 {
+        return Err(anyhow!("{} files have conflicts", conflicts));
+    }
+    Ok(())
+}
+
+// Walks through the .pacnew files, asking what to do with each. Files
+// managed by the repo are compared with and replaced in the repo instead of
+// on the system, unless the repo copy is encrypted.
+fn pacnew(app: &App, socket: Option<&str>) -> Result<()> {
+    let backup = Backup::new(DEFAULT_BACKUPS, app.root());
+    let pacnews: Vec<Entry> = entries(app, socket)?
+        .into_iter()
+        .filter(|e| e.category == Category::Pacnew)
+        .collect();
+    for e in pacnews {
+        let pacfile = match app.pacfile(&e.path)? {
+            Some(pacfile) => pacfile,
+            None => continue,
+        };
+        let new = format!("{}{}", app.root(), e.path);
+        let repo = app
+            .repo_path(&pacfile.base)
+            .filter(|p| !p.ends_with(archdiff::secret::SUFFIX));
+        let target = repo
+            .clone()
+            .unwrap_or_else(|| format!("{}{}", app.root(), pacfile.base));
+        println!(
+            "{} ({}{})",
+            new,
+            pacfile.package.as_deref().unwrap_or("unpackaged"),
+            if pacfile.modified == Some(true) {
+                ", modified"
+            } else {
+                ""
             }
-        }));
-
-        // backup files that have been changed
-        all.par_extend(
-            pkg_backup_files
-                .into_par_iter()
-                .filter_map(|(p, expected_hash)| {
-                    let fp = format!("{}{}", &root, &p);
-                    if ignored.matched_path_or_any_parents(&fp, false).is_ignore() {
-                        None
-                    } else {
-                        hash_file_logged(&fp).and_then(|actual_hash| {
-                            if expected_hash == actual_hash {
-                                None
-                            } else {
-                                Some(('B', p))
-                            }
-                        })
+        );
+        loop {
+            let answer = ask(&format!(
+                "[v]iew diff against {}, [m]erge, [a]ccept, [d]elete, [s]kip or [q]uit?",
+                target
+            ))?;
+            match answer.as_str() {
+                "v" => unified_diff((&target, &target), (&new, &new), &[])?,
+                "m" => {
+                    let diffprog = std::env::var("DIFFPROG").unwrap_or_else(|_| "vim -d".into());
+                    let mut args = diffprog.split_whitespace();
+                    let prog = args.next().unwrap_or("vim");
+                    std::process::Command::new(prog)
+                        .args(args)
+                        .arg(&target)
+                        .arg(&new)
+                        .status()
+                        .with_context(|| format!("failed to run {}", prog))?;
+                    if confirm(&format!("delete {}?", new))? {
+                        backup.save(&e.path)?;
+                        app.remove_file(&e.path)?;
+                        break;
                     }
-                }),
+                }
+                "a" => {
+                    if repo.is_none() {
+                        backup.save(&pacfile.base)?;
+                    }
+                    std::fs::copy(&new, &target)
+                        .with_context(|| format!("failed to copy {} to {}", new, target))?;
+                    backup.save(&e.path)?;
+                    app.remove_file(&e.path)?;
+                    break;
+                }
+                "d" => {
+                    backup.save(&e.path)?;
+                    app.remove_file(&e.path)?;
+                    break;
+                }
+                "s" | "" => break,
+                "q" => return Ok(()),
+                _ => continue,
+            }
+        }
+    }
+    Ok(())
+}
+
+fn owner(app: &App, opts: &OwnerArgs) -> Result<()> {
+    for path in &opts.paths {
+        let owner = app.owner(path)?;
+        let mut desc = owner.package.unwrap_or_else(|| "unpackaged".to_string());
+        if owner.backup {
+            desc.push_str(", backup file");
+        }
+        if owner.repo {
+            desc.push_str(", shadowed by repo");
+        }
+        println!("{}: {}", path.display(), desc);
+    }
+    Ok(())
+}
+
+// Prints what the ignore rules decide for each path, returning
+// EXIT_NOT_IGNORED if none of them are.
+fn ignore_test(app: &App, opts: &IgnoreTestArgs) -> Result<i32> {
+    let mut any = false;
+    for path in &opts.paths {
+        let m = app.ignore_match(path)?;
+        any |= matches!(m, IgnoreMatch::Ignored(_) | IgnoreMatch::Package(_));
+        let why = match m {
+            IgnoreMatch::None => "not ignored".to_string(),
+            IgnoreMatch::Ignored(pattern) => format!("ignored by {}", pattern),
+            IgnoreMatch::Reincluded(pattern) => format!("not ignored, re-included by {}", pattern),
+            IgnoreMatch::Package(name) => format!("ignored along with package {}", name),
+        };
+        println!("{}: {}", path.display(), why);
+    }
+    Ok(if any { 0 } else { EXIT_NOT_IGNORED })
+}
+
+// Prints each ignore pattern as file:line: pattern, with its kind and how
+// many paths it matched in the last full scan.
+fn ignore_list(app: &App) -> Result<()> {
+    for p in app.ignore_patterns()? {
+        let matched = match p.matched {
+            Some(n) => format!("{} matched", n),
+            None => "not scanned".to_string(),
+        };
+        let dirs = if p.dir_only { ", dirs only" } else { "" };
+        println!(
+            "{}:{}: {} ({}{}, {})",
+            p.file.display(),
+            p.line,
+            p.pattern,
+            p.kind.label(),
+            dirs,
+            matched
         );
+    }
+    Ok(())
+}
 
-        all.sort_by(|(_, a), (_, b)| a.cmp(b));
-        all.iter()
-            .for_each(|(c, n)| println!("{} {}{}", c, &root, n));
+fn explain(app: &App, opts: &ExplainArgs) -> Result<()> {
+    for (i, path) in opts.paths.iter().enumerate() {
+        if i > 0 {
+            println!();
+        }
+        println!("{}:", path.display());
+        for line in app.explain(path)? {
+            println!("  {}", line);
+        }
+    }
+    Ok(())
+}
+
+// Watches the directories that affect the diff, leaving out the files
+// archdiff writes itself, so a diff does not set off the next one.
+fn watcher(app: &App, config: &Config) -> Result<Watcher> {
+    let mut watcher = Watcher::new()?;
+    for dir in app.watch_dirs() {
+        if let Err(err) = watcher.add(&dir) {
+            log::error!("{:#}", err);
+        }
+    }
+    for file in app.own_files() {
+        watcher.exclude(&file);
+    }
+    watcher.exclude(Path::new(config.state.as_deref().unwrap_or(DEFAULT_STATE)));
+    Ok(watcher)
+}
+
+// Loads the hooks from the config, failing on unknown events.
+fn hooks(config: &Config) -> Result<Hooks> {
+    Hooks::new(config.hooks.clone().unwrap_or_default())
+}
+
+// Prints the diff, and then prints entries as they are added (+) or removed
+// (-) whenever something changes.
+fn watch(
+    app: &App,
+    output: &Output,
+    opts: &WatchArgs,
+    config: &Config,
+    hooks: &Hooks,
+) -> Result<()> {
+    let mut watcher = watcher(app, config)?;
+    let root = app.root();
+    let mut entries = app.diff();
+    let mut last: BTreeSet<Entry> = entries.iter().cloned().collect();
+    for e in &last {
+        println!("{}", output.entry(root, e));
+    }
+    loop {
+        let changed = watcher.wait(Duration::from_millis(500))?;
+        entries = app.update(&entries, &changed);
+        let current: BTreeSet<Entry> = entries.iter().cloned().collect();
+        for e in last.difference(&current) {
+            println!("- {}", output.entry(root, e));
+        }
+        let added: Vec<&Entry> = current.difference(&last).collect();
+        for e in &added {
+            println!("+ {}", output.entry(root, e));
+        }
+        if opts.notify && !added.is_empty() {
+            if let Err(err) = notify_desktop(root, &added) {
+                log::error!("{:#}", err);
+            }
+        }
+        hooks.run(root, &last, &current);
+        last = current;
+    }
+}
+
+// Shows a desktop notification summarizing new differences, through
+// org.freedesktop.Notifications on the session bus. busctl comes with
+// systemd, so this needs no D-Bus library.
+fn notify_desktop(root: &str, added: &[&Entry]) -> Result<()> {
+    const SHOWN: usize = 5;
+    let mut counts: BTreeMap<Category, usize> = BTreeMap::new();
+    for e in added {
+        *counts.entry(e.category).or_default() += 1;
+    }
+    let summary = match added.len() {
+        1 => "1 new difference".to_string(),
+        n => format!("{} new differences", n),
+    };
+    let mut lines = vec![counts
+        .iter()
+        .map(|(c, n)| format!("{} {}", n, c.label()))
+        .collect::<Vec<_>>()
+        .join(", ")];
+    lines.extend(
+        added
+            .iter()
+            .take(SHOWN)
+            .map(|e| format!("{} {}{}", e.category.code(), root, e.path)),
+    );
+    if added.len() > SHOWN {
+        lines.push(format!("and {} more", added.len() - SHOWN));
+    }
+    let status = std::process::Command::new("busctl")
+        .args([
+            "--user",
+            // the timeout of -1 is not an option
+            "--",
+            "call",
+            "org.freedesktop.Notifications",
+            "/org/freedesktop/Notifications",
+            "org.freedesktop.Notifications",
+            "Notify",
+            // app name, replaced id, icon, summary, body, actions, hints and
+            // timeout, where -1 leaves the timeout to the server
+            "susssasa{sv}i",
+            "archdiff",
+            "0",
+            "",
+            &summary,
+            &lines.join("\n"),
+            "0",
+            "0",
+            "-1",
+        ])
+        .stdout(std::process::Stdio::null())
+        .status()
+        .context("failed to run busctl")?;
+    if !status.success() {
+        return Err(anyhow!(
+            "busctl failed to send the notification: {}",
+            status
+        ));
+    }
+    Ok(())
+}
+
+// Profile prints the resources used by the process to stderr when dropped, so
+// it is printed even if the command fails. It is held by run, which returns
+// before main calls exit, since exit skips the destructors.
+struct Profile {
+    start: Instant,
+}
+
+impl Profile {
+    fn start() -> Self {
+        Self {
+            start: Instant::now(),
+        }
+    }
+}
+
+impl Drop for Profile {
+    fn drop(&mut self) {
+        // SAFETY: rusage is plain data and filled in by getrusage
+        let mut usage: libc::rusage = unsafe { std::mem::zeroed() };
+        // SAFETY: usage is a valid rusage
+        if unsafe { libc::getrusage(libc::RUSAGE_SELF, &mut usage) } != 0 {
+            log::error!(
+                "failed to get resource usage: {}",
+                std::io::Error::last_os_error()
+            );
+            return;
+        }
+        let secs = |tv: libc::timeval| tv.tv_sec as f64 + tv.tv_usec as f64 / 1e6;
+        eprintln!(
+            "time {:.2}s, user {:.2}s, system {:.2}s",
+            self.start.elapsed().as_secs_f64(),
+            secs(usage.ru_utime),
+            secs(usage.ru_stime)
+        );
+        // ru_maxrss is in kilobytes on linux, and block counts are in 512
+        // byte units
+        eprintln!(
+            "peak memory {}, read {}, {} major page faults",
+            human_size(usage.ru_maxrss as u64 * 1024),
+            human_size(usage.ru_inblock as u64 * 512),
+            usage.ru_majflt
+        );
     }
 }
 
-fn main() -> Result<()> {
-    pretty_env_logger::init();
-    App::new(Args::from_args())?.run();
+// Sets up logging to stderr at the level chosen by the number of -v flags,
+// which RUST_LOG overrides.
+fn init_logger(verbose: u8, format: Option<&str>) -> Result<()> {
+    let level = match verbose {
+        0 => log::LevelFilter::Error,
+        1 => log::LevelFilter::Info,
+        2 => log::LevelFilter::Debug,
+        _ => log::LevelFilter::Trace,
+    };
+    let mut builder = pretty_env_logger::formatted_builder();
+    builder.filter_level(level);
+    if let Ok(filters) = std::env::var("RUST_LOG") {
+        builder.parse_filters(&filters);
+    }
+    let default = if systemd::logs_to_journal() {
+        "journal"
+    } else {
+        "text"
+    };
+    match format.unwrap_or(default) {
+        "text" => (),
+        // journald adds the time and reads the level from the <N> prefix
+        "journal" => {
+            builder.format(|buf, record| {
+                writeln!(
+                    buf,
+                    "<{}>{}",
+                    systemd::priority(record.level()),
+                    record.args()
+                )
+            });
+        }
+        "json" => {
+            builder.format(|buf, record| {
+                let time = SystemTime::now()
+                    .duration_since(std::time::UNIX_EPOCH)
+                    .unwrap_or_default();
+                let line = serde_json::json!({
+                    "time": time.as_secs_f64(),
+                    "level": record.level().to_string(),
+                    "target": record.target(),
+                    "message": record.args().to_string(),
+                });
+                writeln!(buf, "{}", line)
+            });
+        }
+        other => return Err(anyhow!("unknown log format {}", other)),
+    }
+    builder.init();
     Ok(())
 }
+
+fn main() {
+    let status = match run() {
+        Ok(status) => status,
+        Err(err) => {
+            eprintln!("Error: {:?}", err);
+            EXIT_ERROR
+        }
+    };
+    std::process::exit(status);
+}
+
+// Runs the command and returns the exit status. The commands return their
+// status instead of exiting, so everything held here, like the profile, is
+// dropped before main exits.
+fn run() -> Result<i32> {
+    let mut args = Args::from_args();
+    init_logger(args.verbose, args.log_format.as_deref())?;
+    let _profile = if args.profile {
+        Some(Profile::start())
+    } else {
+        None
+    };
+    if let Some(Command::Version) = &args.cmd {
+        version();
+        return Ok(0);
+    }
+    let config = args.config()?;
+    let mut opts = Options::default();
+    let pacman_conf = config.pacman_conf.as_deref().unwrap_or("/etc/pacman.conf");
+    PacmanConf::load(pacman_conf)?.apply(&mut opts);
+    config.apply(&mut opts)?;
+    opts.exclude_packages = args.exclude_package.clone();
+    opts.excludes = args.exclude.clone();
+    opts.ignore_from = args.ignore_from.clone();
+    opts.packages = args.package.clone();
+    match &args.cmd {
+        Some(Command::Diff(diff)) => opts.prefixes = diff.paths.clone(),
+        Some(Command::Etc(diff)) if diff.paths.is_empty() => opts.prefixes = vec!["etc".into()],
+        Some(Command::Etc(_)) => return Err(anyhow!("etc does not take paths")),
+        Some(Command::Verify(_)) => {
+            opts.mtree = true;
+            opts.metadata = true;
+        }
+        _ => (),
+    }
+    rayon::ThreadPoolBuilder::new()
+        .num_threads(config.jobs.unwrap_or(0))
+        .build_global()?;
+    let cmd = args.cmd.take();
+    let output = Output::new(&config)?;
+    if let Some(Command::Compare(opts)) = &cmd {
+        compare(opts, &output)?;
+        return Ok(0);
+    }
+    if let Some(Command::Roots(args)) = &cmd {
+        roots(args, &opts, &output)?;
+        return Ok(0);
+    }
+    if let Some(Command::Server(args)) = &cmd {
+        server(args)?;
+        return Ok(0);
+    }
+    if let None | Some(Command::Diff(_)) | Some(Command::Etc(_)) | Some(Command::Verify(_)) = &cmd {
+        interrupt::catch();
+    }
+    // checked once before the packages are loaded, since they do not match
+    // their files while pacman is in a transaction
+    archdiff::lock::check_pacman(&opts.dbpath, opts.pacman_lock)?;
+    let app = App::new(opts)?;
+    let socket = config.socket.as_deref();
+    let mut code = 0;
+    match cmd {
+        None => code = diff(&app, &DiffArgs::default(), &output, &config)?,
+        Some(Command::Diff(opts)) | Some(Command::Etc(opts)) => {
+            code = diff(&app, &opts, &output, &config)?
+        }
+        Some(Command::Verify(opts)) => code = verify(&app, &opts, &output)?,
+        Some(Command::Status) => status(&app, &output, socket)?,
+        Some(Command::Apply(opts)) => apply(&app, &opts)?,
+        Some(Command::Undo) => undo(&app)?,
+        Some(Command::Adopt(opts)) => adopt(&app, &opts)?,
+        Some(Command::Merge(opts)) => merge(&app, &opts)?,
+        Some(Command::Pacnew) => pacnew(&app, socket)?,
+        Some(Command::Owner(opts)) => owner(&app, &opts)?,
+        Some(Command::Explain(opts)) => explain(&app, &opts)?,
+        Some(Command::Ignore(IgnoreCommand::Test(opts))) => code = ignore_test(&app, &opts)?,
+        Some(Command::Ignore(IgnoreCommand::List)) => ignore_list(&app)?,
+        Some(Command::Watch(opts)) => watch(&app, &output, &opts, &config, &hooks(&config)?)?,
+        Some(Command::Daemon(opts)) => run_daemon(
+            &app,
+            socket.unwrap_or(DEFAULT_SOCKET),
+            &opts,
+            &config,
+            &hooks(&config)?,
+        )?,
+        Some(Command::IsDirty(opts)) => code = is_dirty(&app, &opts, socket)?,
+        Some(Command::Metrics(opts)) => metrics(&app, &opts, socket)?,
+        Some(Command::Snapshot(opts)) => snapshot(&app, &opts, socket)?,
+        Some(Command::Agent(opts)) => agent(&app, &opts)?,
+        Some(Command::Compare(_))
+        | Some(Command::Roots(_))
+        | Some(Command::Server(_))
+        | Some(Command::Version) => unreachable!(),
+        Some(Command::Export(opts)) => export(&app, &opts, socket)?,
+        Some(Command::Tui) => tui::run(&app, &output, entries(&app, socket)?)?,
+    }
+    Ok(code)
+}
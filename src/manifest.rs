@@ -0,0 +1,106 @@
+use anyhow::{anyhow, Context, Result};
+use std::collections::BTreeMap;
+use std::ffi::CString;
+use std::io::{BufWriter, Write};
+use std::os::unix::ffi::OsStrExt;
+use std::os::unix::fs::{MetadataExt, PermissionsExt};
+use std::path::Path;
+
+/// The name of the manifest file at the top of a repo dir.
+pub const MANIFEST_FILE: &str = ".archdiff-metadata";
+
+/// FileMeta is the ownership and permissions of a file.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct FileMeta {
+    pub mode: u32,
+    pub uid: u32,
+    pub gid: u32,
+}
+
+impl FileMeta {
+    pub fn new(md: &std::fs::Metadata) -> Self {
+        Self {
+            mode: md.mode() & 0o7777,
+            uid: md.uid(),
+            gid: md.gid(),
+        }
+    }
+
+    /// Sets the ownership and permissions of a file.
+    pub fn apply(&self, path: &Path) -> Result<()> {
+        let cpath = CString::new(path.as_os_str().as_bytes())?;
+        // SAFETY: cpath is a valid NUL terminated string
+        if unsafe { libc::chown(cpath.as_ptr(), self.uid, self.gid) } != 0 {
+            return Err(anyhow!(
+                "failed to change owner of {}: {}",
+                path.display(),
+                std::io::Error::last_os_error()
+            ));
+        }
+        // the mode is set after chown, which clears the setuid and setgid bits
+        std::fs::set_permissions(path, std::fs::Permissions::from_mode(self.mode))
+            .with_context(|| format!("failed to change mode of {}", path.display()))
+    }
+}
+
+/// Manifest records the metadata of repo files, which is lost when the repo
+/// is stored in git. Each line holds the octal mode, uid, gid and path
+/// relative to the repo dir, separated by tabs.
+#[derive(Clone, Debug, Default)]
+pub struct Manifest(BTreeMap<String, FileMeta>);
+
+impl Manifest {
+    /// Loads the manifest of a repo dir. A missing manifest is empty.
+    pub fn load(repo: &str) -> Result<Self> {
+        let path = Path::new(repo).join(MANIFEST_FILE);
+        let contents = match std::fs::read_to_string(&path) {
+            Ok(contents) => contents,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(Self::default()),
+            Err(err) => {
+                return Err(err).with_context(|| format!("failed to read {}", path.display()))
+            }
+        };
+        let mut files = BTreeMap::new();
+        for (n, line) in contents.lines().enumerate() {
+            let parts: Vec<&str> = line.splitn(4, '\t').collect();
+            let parse = || -> Option<(String, FileMeta)> {
+                let meta = FileMeta {
+                    mode: u32::from_str_radix(parts.get(0)?, 8).ok()?,
+                    uid: parts.get(1)?.parse().ok()?,
+                    gid: parts.get(2)?.parse().ok()?,
+                };
+                Some((parts.get(3)?.to_string(), meta))
+            };
+            let (file, meta) =
+                parse().ok_or_else(|| anyhow!("invalid line {} in {}", n + 1, path.display()))?;
+            files.insert(file, meta);
+        }
+        Ok(Self(files))
+    }
+
+    /// Saves the manifest into a repo dir.
+    pub fn save(&self, repo: &str) -> Result<()> {
+        let path = Path::new(repo).join(MANIFEST_FILE);
+        let f = std::fs::File::create(&path)
+            .with_context(|| format!("failed to create {}", path.display()))?;
+        let mut w = BufWriter::new(f);
+        for (file, meta) in &self.0 {
+            writeln!(w, "{:04o}\t{}\t{}\t{}", meta.mode, meta.uid, meta.gid, file)?;
+        }
+        w.flush()
+            .with_context(|| format!("failed to write {}", path.display()))
+    }
+
+    pub fn get(&self, path: &str) -> Option<FileMeta> {
+        self.0.get(path).copied()
+    }
+
+    pub fn set(&mut self, path: &str, meta: FileMeta) {
+        self.0.insert(path.to_string(), meta);
+    }
+
+    /// Adds the entries of other, replacing existing ones.
+    pub fn extend(&mut self, other: Manifest) {
+        self.0.extend(other.0);
+    }
+}
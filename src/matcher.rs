@@ -0,0 +1,157 @@
+use anyhow::{Context, Result};
+use ignore::gitignore::{Gitignore, GitignoreBuilder, Glob};
+use ignore::Match;
+use serde::{Deserialize, Serialize};
+use std::cmp::Reverse;
+use std::collections::BTreeMap;
+use std::path::Path;
+
+// The name of the per-directory ignore file.
+pub(crate) const IGNORE_FILE: &str = ".archdiffignore";
+
+// A name used to ask whether any entry in a dir would be ignored.
+const PROBE: &str = ".archdiff-probe";
+
+// Matcher combines the global ignore files with the .archdiffignore files
+// found in directories under the root. Patterns in deeper directories take
+// precedence, like nested .gitignore files.
+pub(crate) struct Matcher<'a> {
+    global: &'a Gitignore,
+    nested: Vec<Gitignore>,
+}
+
+impl<'a> Matcher<'a> {
+    pub fn new(global: &'a Gitignore) -> Self {
+        Self {
+            global,
+            nested: vec![],
+        }
+    }
+
+    // Loads the .archdiffignore file in dir, if there is one.
+    pub fn add_dir(&mut self, dir: &Path) -> Result<()> {
+        let path = dir.join(IGNORE_FILE);
+        if !path.is_file() {
+            return Ok(());
+        }
+        let mut builder = GitignoreBuilder::new(dir);
+        if let Some(err) = builder.add(&path) {
+            return Err(err.into());
+        }
+        self.nested.push(builder.build()?);
+        self.nested
+            .sort_by_key(|gi| Reverse(gi.path().components().count()));
+        Ok(())
+    }
+
+    // Checks if the path is ignored. The parents of the path are only
+    // considered if parents is true, which is unnecessary while walking since
+    // ignored directories are never entered.
+    pub fn is_ignored(&self, path: &Path, is_dir: bool, parents: bool) -> bool {
+        self.matched(path, is_dir, parents).is_ignore()
+    }
+
+    // Checks if everything inside dir is ignored by a pattern like dir/** or
+    // dir/*, so its contents need not be walked. Any whitelist pattern could
+    // re-include some of them, so nothing is pruned when there are some.
+    pub fn prunes(&self, dir: &Path) -> bool {
+        let whitelists = self
+            .nested
+            .iter()
+            .filter(|gi| dir.starts_with(gi.path()))
+            .chain(std::iter::once(self.global))
+            .any(|gi| gi.num_whitelists() > 0);
+        if whitelists {
+            return false;
+        }
+        let probe = dir.join(PROBE);
+        let prunable = |is_dir| match self.matched(&probe, is_dir, false) {
+            Match::Ignore(glob) => {
+                glob.original().ends_with("/**") || glob.original().ends_with("/*")
+            }
+            _ => false,
+        };
+        prunable(true) && prunable(false)
+    }
+
+    // Finds the pattern deciding whether the path is ignored.
+    pub fn matched(&self, path: &Path, is_dir: bool, parents: bool) -> Match<&Glob> {
+        let nested = self.nested.iter().filter(|gi| path.starts_with(gi.path()));
+        for gi in nested.chain(std::iter::once(self.global)) {
+            let m = if parents {
+                gi.matched_path_or_any_parents(path, is_dir)
+            } else {
+                gi.matched(path, is_dir)
+            };
+            if !m.is_none() {
+                return m;
+            }
+        }
+        Match::None
+    }
+}
+
+// Describes where a pattern came from as file:line: pattern.
+pub(crate) fn describe(glob: &Glob) -> String {
+    let from = match glob.from() {
+        Some(from) => from,
+        None => return glob.original().to_string(),
+    };
+    let line = std::fs::read_to_string(from).ok().and_then(|contents| {
+        contents
+            .lines()
+            .position(|l| l.trim_end() == glob.original())
+    });
+    match line {
+        Some(n) => format!("{}:{}: {}", from.display(), n + 1, glob.original()),
+        None => format!("{}: {}", from.display(), glob.original()),
+    }
+}
+
+// IgnoreStats counts the paths each pattern matched during the last scan,
+// keyed by the file the pattern is from and then the pattern, along with the
+// number of files owned by each package ignored by a pkg: line. Ignored dirs
+// are not walked, so a dir counts as one path however much is in it.
+#[derive(Default, Serialize, Deserialize)]
+pub(crate) struct IgnoreStats {
+    pub patterns: BTreeMap<String, BTreeMap<String, usize>>,
+    pub packages: BTreeMap<String, usize>,
+}
+
+impl IgnoreStats {
+    pub fn add(&mut self, glob: &Glob) {
+        let from = glob
+            .from()
+            .map(|f| f.to_string_lossy().into_owned())
+            .unwrap_or_default();
+        *self
+            .patterns
+            .entry(from)
+            .or_default()
+            .entry(glob.original().to_string())
+            .or_default() += 1;
+    }
+
+    // Loads the stats, or None if no scan has saved them yet.
+    pub fn load(path: &Path) -> Result<Option<Self>> {
+        match std::fs::read(path) {
+            Ok(contents) => Ok(Some(
+                serde_json::from_slice(&contents)
+                    .with_context(|| format!("failed to parse {}", path.display()))?,
+            )),
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => Ok(None),
+            Err(err) => Err(err).with_context(|| format!("failed to read {}", path.display())),
+        }
+    }
+
+    pub fn save(&self, path: &Path) -> Result<()> {
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {}", dir.display()))?;
+        }
+        let tmp = path.with_extension("json.tmp");
+        std::fs::write(&tmp, serde_json::to_vec(self)?)
+            .with_context(|| format!("failed to write {}", tmp.display()))?;
+        std::fs::rename(&tmp, path).with_context(|| format!("failed to rename {}", tmp.display()))
+    }
+}
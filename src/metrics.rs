@@ -0,0 +1,41 @@
+use crate::{Category, Entry};
+use anyhow::{Context, Result};
+use std::fmt::Write;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+/// Renders the number of entries per category along with the scan duration
+/// and time in the Prometheus text format.
+pub fn render(entries: &[Entry], duration: Duration, time: SystemTime) -> String {
+    let mut out = String::new();
+    out.push_str("# HELP archdiff_entries Number of differences by category.\n");
+    out.push_str("# TYPE archdiff_entries gauge\n");
+    for c in Category::ALL.iter() {
+        let n = entries.iter().filter(|e| e.category == *c).count();
+        let label = c.label().replace(' ', "_");
+        let _ = writeln!(out, "archdiff_entries{{category=\"{}\"}} {}", label, n);
+    }
+    out.push_str("# HELP archdiff_scan_duration_seconds Time taken to compute the diff.\n");
+    out.push_str("# TYPE archdiff_scan_duration_seconds gauge\n");
+    let _ = writeln!(
+        out,
+        "archdiff_scan_duration_seconds {}",
+        duration.as_secs_f64()
+    );
+    out.push_str("# HELP archdiff_last_scan_timestamp_seconds Time the diff was computed.\n");
+    out.push_str("# TYPE archdiff_last_scan_timestamp_seconds gauge\n");
+    let secs = time
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_secs();
+    let _ = writeln!(out, "archdiff_last_scan_timestamp_seconds {}", secs);
+    out
+}
+
+/// Writes the metrics to a file atomically, as the node exporter textfile
+/// collector expects.
+pub fn write(path: &str, metrics: &str) -> Result<()> {
+    let tmp = format!("{}.tmp", path);
+    std::fs::write(&tmp, metrics).with_context(|| format!("failed to write {}", tmp))?;
+    std::fs::rename(&tmp, path).with_context(|| format!("failed to rename {}", tmp))?;
+    Ok(())
+}
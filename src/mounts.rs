@@ -0,0 +1,78 @@
+use anyhow::{Context, Result};
+use std::collections::HashSet;
+use std::path::{Path, PathBuf};
+
+// The filesystem types whose contents are generated by the kernel or do not
+// survive a reboot, and so are never worth comparing against packages.
+const VIRTUAL_TYPES: &[&str] = &[
+    "autofs",
+    "binfmt_misc",
+    "bpf",
+    "cgroup",
+    "cgroup2",
+    "configfs",
+    "debugfs",
+    "devpts",
+    "devtmpfs",
+    "efivarfs",
+    "fusectl",
+    "hugetlbfs",
+    "mqueue",
+    "nsfs",
+    "proc",
+    "pstore",
+    "ramfs",
+    "rpc_pipefs",
+    "securityfs",
+    "sysfs",
+    "tmpfs",
+    "tracefs",
+];
+
+/// Lists the mount points under root with a virtual or ephemeral filesystem
+/// such as proc, sysfs or tmpfs, as found in /proc/mounts.
+pub fn virtual_mounts(root: &str) -> Result<HashSet<PathBuf>> {
+    let contents =
+        std::fs::read_to_string("/proc/mounts").context("failed to read /proc/mounts")?;
+    Ok(contents
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.split(' ');
+            let target = unescape(fields.nth(1)?);
+            let fstype = fields.next()?;
+            let path = Path::new(&target);
+            // the root itself may be a tmpfs, as on live systems
+            if VIRTUAL_TYPES.contains(&fstype) && path.starts_with(root) && path != Path::new(root)
+            {
+                Some(PathBuf::from(target))
+            } else {
+                None
+            }
+        })
+        .collect())
+}
+
+// Decodes the octal escapes /proc/mounts uses for spaces, tabs, newlines and
+// backslashes in paths.
+fn unescape(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    let mut rest = s;
+    while let Some(i) = rest.find('\\') {
+        out.push_str(&rest[..i]);
+        let code = rest
+            .get(i + 1..i + 4)
+            .and_then(|c| u8::from_str_radix(c, 8).ok());
+        match code {
+            Some(c) => {
+                out.push(c as char);
+                rest = &rest[i + 4..];
+            }
+            None => {
+                out.push('\\');
+                rest = &rest[i + 1..];
+            }
+        }
+    }
+    out.push_str(rest);
+    out
+}
@@ -0,0 +1,116 @@
+use crate::hash::HashAlgo;
+use anyhow::{Context, Result};
+use flate2::read::GzDecoder;
+use std::io::{BufRead, BufReader};
+use std::path::Path;
+
+/// MtreeEntry is the integrity data pacman records for a packaged path.
+#[derive(Clone, Debug, Default)]
+pub struct MtreeEntry {
+    pub kind: String,
+    pub uid: Option<u32>,
+    pub gid: Option<u32>,
+    pub mode: Option<u32>,
+    pub size: Option<u64>,
+    pub time: Option<i64>,
+    pub md5: Option<String>,
+    pub sha1: Option<String>,
+    pub sha256: Option<String>,
+    pub link: Option<String>,
+}
+
+impl MtreeEntry {
+    /// The strongest hash recorded for a file, along with its algorithm.
+    pub fn digest(&self) -> Option<(HashAlgo, &str)> {
+        if let Some(sha256) = &self.sha256 {
+            Some((HashAlgo::Sha256, sha256))
+        } else if let Some(sha1) = &self.sha1 {
+            Some((HashAlgo::Sha1, sha1))
+        } else {
+            self.md5.as_deref().map(|md5| (HashAlgo::Md5, md5))
+        }
+    }
+
+    fn set(&mut self, key: &str, value: Option<&str>) {
+        match key {
+            "type" => self.kind = value.unwrap_or_default().to_string(),
+            "uid" => self.uid = value.and_then(|v| v.parse().ok()),
+            "gid" => self.gid = value.and_then(|v| v.parse().ok()),
+            "mode" => self.mode = value.and_then(|v| u32::from_str_radix(v, 8).ok()),
+            "size" => self.size = value.and_then(|v| v.parse().ok()),
+            "time" => {
+                self.time = value.and_then(|v| v.split('.').next().and_then(|s| s.parse().ok()))
+            }
+            "md5digest" => self.md5 = value.map(str::to_string),
+            "sha256digest" => self.sha256 = value.map(str::to_string),
+            "link" => self.link = value.map(mtree_unescape),
+            _ => (),
+        }
+    }
+}
+
+// mtree escapes special characters in paths as backslash followed by three
+// octal digits.
+fn mtree_unescape(s: &str) -> String {
+    let b = s.as_bytes();
+    let mut out = Vec::with_capacity(b.len());
+    let mut i = 0;
+    while i < b.len() {
+        if b[i] == b'\\'
+            && i + 3 < b.len()
+            && b[i + 1..i + 4].iter().all(|c| (b'0'..=b'7').contains(c))
+        {
+            out.push((b[i + 1] - b'0') * 64 + (b[i + 2] - b'0') * 8 + (b[i + 3] - b'0'));
+            i += 4;
+        } else {
+            out.push(b[i]);
+            i += 1;
+        }
+    }
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+/// Reads a gzipped pacman mtree file, returning entries keyed by their path
+/// relative to the root. Package metadata files like .PKGINFO are skipped.
+pub fn read_mtree<P: AsRef<Path>>(path: P) -> Result<Vec<(String, MtreeEntry)>> {
+    let path = path.as_ref();
+    let f =
+        std::fs::File::open(path).with_context(|| format!("failed to open {}", path.display()))?;
+    let mut defaults = MtreeEntry::default();
+    let mut entries = vec![];
+    for line in BufReader::new(GzDecoder::new(f)).lines() {
+        let line = line.with_context(|| format!("failed to read {}", path.display()))?;
+        let mut fields = line.split_whitespace();
+        let first = match fields.next() {
+            None => continue,
+            Some(f) if f.starts_with('#') => continue,
+            Some(f) => f,
+        };
+        match first {
+            "/set" => {
+                for kv in fields {
+                    let mut kv = kv.splitn(2, '=');
+                    defaults.set(kv.next().unwrap_or_default(), kv.next());
+                }
+            }
+            "/unset" => {
+                for k in fields {
+                    defaults.set(k, None);
+                }
+            }
+            _ => {
+                let name = mtree_unescape(first.trim_start_matches("./"));
+                if name.is_empty() || name.starts_with('.') && !name.contains('/') {
+                    continue;
+                }
+                let mut entry = defaults.clone();
+                for kv in fields {
+                    let mut kv = kv.splitn(2, '=');
+                    entry.set(kv.next().unwrap_or_default(), kv.next());
+                }
+                entries.push((name, entry));
+            }
+        }
+    }
+    Ok(entries)
+}
@@ -0,0 +1,57 @@
+use anyhow::{Context, Result};
+use std::collections::BTreeSet;
+use std::path::Path;
+
+/// The name of the file at the top of a repo dir listing the packages and
+/// groups that should be explicitly installed, one per line.
+pub const PACKAGES_FILE: &str = ".archdiff-packages";
+
+/// PackageList is the set of package and group names listed in the repo.
+#[derive(Clone, Debug, Default)]
+pub struct PackageList {
+    names: BTreeSet<String>,
+    // Whether any repo dir has a package list, since an empty list still
+    // means every explicit package is unlisted.
+    found: bool,
+}
+
+impl PackageList {
+    /// Loads the package list of a repo dir, ignoring # comments and blank
+    /// lines. A missing file results in an empty list that is not found.
+    pub fn load(repo: &str) -> Result<Self> {
+        let path = Path::new(repo).join(PACKAGES_FILE);
+        let contents = match std::fs::read_to_string(&path) {
+            Ok(contents) => contents,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(Self::default()),
+            Err(err) => {
+                return Err(err).with_context(|| format!("failed to read {}", path.display()))
+            }
+        };
+        let names = contents
+            .lines()
+            .map(|line| line.split('#').next().unwrap_or_default().trim())
+            .filter(|name| !name.is_empty())
+            .map(str::to_string)
+            .collect();
+        Ok(Self { names, found: true })
+    }
+
+    /// Adds the names of other.
+    pub fn extend(&mut self, other: PackageList) {
+        self.names.extend(other.names);
+        self.found |= other.found;
+    }
+
+    /// Whether any repo dir has a package list.
+    pub fn found(&self) -> bool {
+        self.found
+    }
+
+    pub fn contains(&self, name: &str) -> bool {
+        self.names.contains(name)
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = &str> {
+        self.names.iter().map(String::as_str)
+    }
+}
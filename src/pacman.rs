@@ -0,0 +1,138 @@
+use crate::Options;
+use anyhow::{anyhow, Context, Result};
+use globset::{Glob, GlobMatcher};
+use std::path::Path;
+
+/// PacmanConf holds the settings archdiff uses from the [options] section of
+/// pacman.conf.
+#[derive(Debug, Default)]
+pub struct PacmanConf {
+    pub root_dir: Option<String>,
+    pub db_path: Option<String>,
+    pub no_extract: Vec<String>,
+    pub no_upgrade: Vec<String>,
+    pub cache_dirs: Vec<String>,
+    /// The names of the repo sections, in order.
+    pub repos: Vec<String>,
+}
+
+impl PacmanConf {
+    /// Loads a pacman.conf file. A missing file results in an empty config.
+    pub fn load<P: AsRef<Path>>(path: P) -> Result<Self> {
+        let path = path.as_ref();
+        let contents = match std::fs::read_to_string(path) {
+            Ok(contents) => contents,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(Self::default()),
+            Err(err) => {
+                return Err(err).with_context(|| format!("failed to read {}", path.display()))
+            }
+        };
+        Ok(Self::parse(&contents))
+    }
+
+    fn parse(contents: &str) -> Self {
+        let mut conf = Self::default();
+        let mut in_options = false;
+        for line in contents.lines() {
+            let line = line.split('#').next().unwrap_or_default().trim();
+            if line.is_empty() {
+                continue;
+            }
+            if line.starts_with('[') && line.ends_with(']') {
+                in_options = line == "[options]";
+                if !in_options {
+                    conf.repos.push(line[1..line.len() - 1].to_string());
+                }
+                continue;
+            }
+            if !in_options {
+                continue;
+            }
+            let mut kv = line.splitn(2, '=');
+            let key = kv.next().unwrap_or_default().trim();
+            let value = kv.next().unwrap_or_default().trim();
+            match key {
+                "RootDir" => conf.root_dir = Some(value.to_string()),
+                "DBPath" => conf.db_path = Some(value.to_string()),
+                "NoExtract" => conf
+                    .no_extract
+                    .extend(value.split_whitespace().map(str::to_string)),
+                "NoUpgrade" => conf
+                    .no_upgrade
+                    .extend(value.split_whitespace().map(str::to_string)),
+                "CacheDir" => conf
+                    .cache_dirs
+                    .extend(value.split_whitespace().map(str::to_string)),
+                _ => (),
+            }
+        }
+        conf
+    }
+
+    /// Overrides the options with the values set in pacman.conf.
+    pub fn apply(&self, opts: &mut Options) {
+        if let Some(root) = &self.root_dir {
+            opts.root = root.clone();
+        }
+        if let Some(dbpath) = &self.db_path {
+            opts.dbpath = dbpath.clone();
+        }
+        opts.no_extract = self.no_extract.clone();
+        opts.no_upgrade = self.no_upgrade.clone();
+        if !self.cache_dirs.is_empty() {
+            opts.pkg_cache_dirs = self.cache_dirs.clone();
+        }
+        opts.sync_dbs = self.repos.clone();
+    }
+}
+
+/// SkipMode controls how files matching NoExtract and NoUpgrade are reported.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum SkipMode {
+    /// Leave them out of the diff.
+    Exclude,
+    /// Report them in their own categories.
+    Mark,
+    /// Report them like any other file.
+    Off,
+}
+
+impl std::str::FromStr for SkipMode {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "exclude" => Ok(SkipMode::Exclude),
+            "mark" => Ok(SkipMode::Mark),
+            "off" => Ok(SkipMode::Off),
+            _ => Err(anyhow!("unknown skip mode {}", s)),
+        }
+    }
+}
+
+/// Patterns matches paths relative to the root like pacman matches NoExtract
+/// and NoUpgrade: the last matching pattern wins, and patterns starting with
+/// ! exclude matching paths.
+pub struct Patterns(Vec<(bool, GlobMatcher)>);
+
+impl Patterns {
+    pub fn new(patterns: &[String]) -> Result<Self> {
+        let mut compiled = vec![];
+        for pattern in patterns {
+            let (negated, glob) = match pattern.strip_prefix('!') {
+                Some(rest) => (true, rest),
+                None => (false, pattern.trim_start_matches('\\')),
+            };
+            let glob = Glob::new(glob).with_context(|| format!("invalid pattern {}", pattern))?;
+            compiled.push((negated, glob.compile_matcher()));
+        }
+        Ok(Self(compiled))
+    }
+
+    pub fn is_match(&self, path: &str) -> bool {
+        match self.0.iter().rev().find(|(_, glob)| glob.is_match(path)) {
+            Some((negated, _)) => !negated,
+            None => false,
+        }
+    }
+}
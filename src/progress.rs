@@ -0,0 +1,109 @@
+use std::io::Write;
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::thread::JoinHandle;
+use std::time::{Duration, Instant};
+
+/// Progress counts the work done by a diff, so it can be reported while the
+/// diff is running.
+#[derive(Debug, Default)]
+pub struct Progress {
+    scanned: AtomicU64,
+    to_check: AtomicU64,
+    checked: AtomicU64,
+    hashed: AtomicU64,
+    // When the first file was queued for checking, used for the ETA.
+    checking_since: Mutex<Option<Instant>>,
+}
+
+impl Progress {
+    /// Clears the counters for a new diff.
+    pub fn reset(&self) {
+        self.scanned.store(0, Ordering::Relaxed);
+        self.to_check.store(0, Ordering::Relaxed);
+        self.checked.store(0, Ordering::Relaxed);
+        self.hashed.store(0, Ordering::Relaxed);
+        *self.checking_since.lock().unwrap() = None;
+    }
+
+    /// Counts a file found while walking the root.
+    pub fn scanned(&self) {
+        self.scanned.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Adds files to the number of files that will be checked.
+    pub fn to_check(&self, n: usize) {
+        self.checking_since
+            .lock()
+            .unwrap()
+            .get_or_insert_with(Instant::now);
+        self.to_check.fetch_add(n as u64, Ordering::Relaxed);
+    }
+
+    /// Counts a file that has been checked.
+    pub fn checked(&self) {
+        self.checked.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Counts bytes read to compute a hash.
+    pub fn hashed(&self, bytes: u64) {
+        self.hashed.fetch_add(bytes, Ordering::Relaxed);
+    }
+
+    /// Describes the progress in a single line.
+    pub fn render(&self) -> String {
+        let scanned = self.scanned.load(Ordering::Relaxed);
+        let to_check = self.to_check.load(Ordering::Relaxed);
+        let checked = self.checked.load(Ordering::Relaxed);
+        let hashed = self.hashed.load(Ordering::Relaxed) as f64 / (1024.0 * 1024.0);
+        let mut line = format!(
+            "scanned {} files, checked {}/{}, hashed {:.1} MiB",
+            scanned, checked, to_check, hashed
+        );
+        let since = *self.checking_since.lock().unwrap();
+        if let Some(since) = since {
+            if checked > 0 && checked < to_check {
+                let eta =
+                    since.elapsed().as_secs_f64() * (to_check - checked) as f64 / checked as f64;
+                line.push_str(&format!(", eta {}s", eta.ceil() as u64));
+            }
+        }
+        line
+    }
+}
+
+/// Reporter periodically prints the progress to stderr until it is dropped.
+pub struct Reporter {
+    done: Arc<AtomicBool>,
+    handle: Option<JoinHandle<()>>,
+}
+
+impl Reporter {
+    pub fn start(progress: Arc<Progress>) -> Self {
+        let done = Arc::new(AtomicBool::new(false));
+        let handle = {
+            let done = done.clone();
+            std::thread::spawn(move || {
+                while !done.load(Ordering::Relaxed) {
+                    eprint!("\r\x1b[K{}", progress.render());
+                    let _ = std::io::stderr().flush();
+                    std::thread::sleep(Duration::from_millis(200));
+                }
+                eprint!("\r\x1b[K");
+            })
+        };
+        Self {
+            done,
+            handle: Some(handle),
+        }
+    }
+}
+
+impl Drop for Reporter {
+    fn drop(&mut self) {
+        self.done.store(true, Ordering::Relaxed);
+        if let Some(handle) = self.handle.take() {
+            let _ = handle.join();
+        }
+    }
+}
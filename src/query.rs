@@ -0,0 +1,237 @@
+use crate::localdb::read_local_mtree;
+use crate::mtree::MtreeEntry;
+use crate::source::{BackupHash, Package, PackageSource, Reason};
+use anyhow::{anyhow, Context, Result};
+use std::collections::{HashMap, HashSet};
+
+// Runs pacman against the root and database dir, in the C locale since its
+// output is parsed.
+fn pacman(root: &str, dbpath: &str, args: &[&str]) -> Result<String> {
+    let output = std::process::Command::new("pacman")
+        .arg("--root")
+        .arg(root)
+        .arg("--dbpath")
+        .arg(dbpath)
+        .args(args)
+        .env("LC_ALL", "C")
+        .output()
+        .context("failed to run pacman")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "pacman {} failed: {}",
+            args.join(" "),
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    String::from_utf8(output.stdout).context("pacman printed invalid utf-8")
+}
+
+// Splits the output of pacman -Qii into the fields of each package, where
+// fields look like "Name            : value" and values continue on indented
+// lines.
+fn fields(output: &str) -> Vec<HashMap<&str, Vec<&str>>> {
+    let mut pkgs = vec![];
+    let mut fields: HashMap<&str, Vec<&str>> = HashMap::new();
+    let mut key = "";
+    for line in output.lines() {
+        if line.is_empty() {
+            if !fields.is_empty() {
+                pkgs.push(std::mem::take(&mut fields));
+            }
+        } else if line.starts_with(' ') {
+            fields.entry(key).or_default().push(line.trim());
+        } else if let Some((k, v)) = line.split_once(" : ") {
+            key = k.trim();
+            fields.entry(key).or_default().push(v.trim());
+        }
+    }
+    if !fields.is_empty() {
+        pkgs.push(fields);
+    }
+    pkgs
+}
+
+/// Pacman reads the package database by running pacman -Qii and pacman -Ql,
+/// for when libalpm does not match the installed pacman. Backup file hashes
+/// are not printed by pacman, so only the status it reports for them is kept.
+/// The mtree files are read directly.
+pub struct Pacman {
+    pub root: String,
+    pub dbpath: String,
+}
+
+impl PackageSource for Pacman {
+    fn packages(&self) -> Result<Vec<Package>> {
+        load(&self.root, &self.dbpath)
+    }
+
+    fn available(&self) -> Result<HashSet<String>> {
+        Ok(pacman(&self.root, &self.dbpath, &["-Slq"])?
+            .lines()
+            .map(str::to_string)
+            .collect())
+    }
+
+    fn verify_data(&self, pkg: &Package) -> Result<Vec<(String, MtreeEntry)>> {
+        read_local_mtree(&self.dbpath, pkg)
+    }
+}
+
+fn load(root: &str, dbpath: &str) -> Result<Vec<Package>> {
+    let mut pkgs = parse(root, &pacman(root, dbpath, &["-Qii"])?)?;
+    let mut files: HashMap<&str, Vec<String>> = HashMap::new();
+    let list = pacman(root, dbpath, &["-Ql"])?;
+    for line in list.lines() {
+        if let Some((name, path)) = line.split_once(' ') {
+            let rel = path.strip_prefix(root).unwrap_or(path);
+            files.entry(name).or_default().push(rel.to_string());
+        }
+    }
+    for pkg in &mut pkgs {
+        pkg.files = files.remove(pkg.name.as_str()).unwrap_or_default();
+    }
+    pkgs.sort_by(|a, b| a.name.cmp(&b.name));
+    Ok(pkgs)
+}
+
+// Reads the packages from the output of pacman -Qii, without their files.
+fn parse(root: &str, info: &str) -> Result<Vec<Package>> {
+    let mut pkgs = vec![];
+    for fields in fields(info) {
+        let first = |key: &str| -> Result<String> {
+            fields
+                .get(key)
+                .and_then(|values| values.first())
+                .map(|v| v.to_string())
+                .ok_or_else(|| anyhow!("no {} in the output of pacman -Qii", key))
+        };
+        // lists are on one line separated by spaces, except optional
+        // dependencies which have a line each
+        let words = |key: &str| -> Vec<String> {
+            fields
+                .get(key)
+                .into_iter()
+                .flatten()
+                .flat_map(|v| v.split_whitespace())
+                .filter(|w| *w != "None")
+                .map(str::to_string)
+                .collect()
+        };
+        let lines = |key: &str| -> Vec<String> {
+            fields
+                .get(key)
+                .into_iter()
+                .flatten()
+                .filter(|v| **v != "None")
+                .map(|v| v.to_string())
+                .collect()
+        };
+        let mut backup = vec![];
+        // each backup file is printed as its status, a tab and its path
+        for line in lines("Backup Files") {
+            let (status, path) = match line.split_once('\t') {
+                Some(parts) => parts,
+                None => continue,
+            };
+            let rel = path.strip_prefix(root).unwrap_or(path).to_string();
+            let hash = match status {
+                "UNMODIFIED" => BackupHash::Unmodified,
+                "MODIFIED" => BackupHash::Modified,
+                "UNREADABLE" => BackupHash::Unreadable,
+                _ => BackupHash::Unknown,
+            };
+            backup.push((rel, hash));
+        }
+        pkgs.push(Package {
+            name: first("Name")?,
+            version: first("Version")?,
+            reason: match first("Install Reason")?.as_str() {
+                "Explicitly installed" => Reason::Explicit,
+                _ => Reason::Depend,
+            },
+            groups: words("Groups"),
+            depends: words("Depends On"),
+            optdepends: lines("Optional Deps"),
+            provides: words("Provides"),
+            files: vec![],
+            backup,
+        });
+    }
+    Ok(pkgs)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{fields, parse};
+    use crate::source::{BackupHash, Reason};
+
+    const INFO: &str = "\
+Name            : foo
+Version         : 1.2-1
+Groups          : None
+Depends On      : glibc  bar>=2
+Optional Deps   : baz: for the baz support
+                  qux [installed]
+Install Reason  : Installed as a dependency for another package
+Backup Files    : UNMODIFIED\t/root/etc/foo.conf
+                  MODIFIED\t/root/etc/foo.d/local.conf
+                  UNREADABLE\t/root/etc/foo.d/secret.conf
+                  MISSING\t/root/etc/foo.d/gone.conf
+
+Name            : bar
+Version         : 2.0-3
+Groups          : base base-devel
+Depends On      : None
+Provides        : libbar.so=1-64
+Optional Deps   : None
+Install Reason  : Explicitly installed
+Backup Files    : (none)
+";
+
+    #[test]
+    fn continuation_lines() {
+        let pkgs = fields(INFO);
+        assert_eq!(pkgs.len(), 2);
+        assert_eq!(
+            pkgs[0]["Optional Deps"],
+            vec!["baz: for the baz support", "qux [installed]"]
+        );
+        assert_eq!(pkgs[1]["Groups"], vec!["base base-devel"]);
+    }
+
+    #[test]
+    fn packages() {
+        let pkgs = parse("/root/", INFO).unwrap();
+        assert_eq!(pkgs.len(), 2);
+        let foo = &pkgs[0];
+        assert_eq!(foo.name, "foo");
+        assert_eq!(foo.version, "1.2-1");
+        assert_eq!(foo.reason, Reason::Depend);
+        assert!(foo.groups.is_empty());
+        assert_eq!(foo.depends, vec!["glibc", "bar>=2"]);
+        assert_eq!(
+            foo.optdepends,
+            vec!["baz: for the baz support", "qux [installed]"]
+        );
+        assert_eq!(
+            foo.backup,
+            vec![
+                ("etc/foo.conf".to_string(), BackupHash::Unmodified),
+                ("etc/foo.d/local.conf".to_string(), BackupHash::Modified),
+                ("etc/foo.d/secret.conf".to_string(), BackupHash::Unreadable),
+                ("etc/foo.d/gone.conf".to_string(), BackupHash::Unknown),
+            ]
+        );
+        let bar = &pkgs[1];
+        assert_eq!(bar.reason, Reason::Explicit);
+        assert_eq!(bar.groups, vec!["base", "base-devel"]);
+        assert!(bar.depends.is_empty());
+        assert_eq!(bar.provides, vec!["libbar.so=1-64"]);
+        assert!(bar.backup.is_empty());
+    }
+
+    #[test]
+    fn missing_field() {
+        assert!(parse("/", "Name            : foo\n").is_err());
+    }
+}
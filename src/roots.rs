@@ -0,0 +1,189 @@
+use crate::filter_map_error;
+use crate::source::Package;
+use anyhow::anyhow;
+use rayon::prelude::*;
+use std::collections::{BTreeMap, HashSet};
+use std::fs::Metadata;
+use std::io::Read;
+use std::os::unix::fs::MetadataExt;
+use std::path::{Path, PathBuf};
+use walkdir::WalkDir;
+
+/// Tree is a directory tree to compare, along with the packages installed in
+/// it when its package database is known.
+pub struct Tree {
+    pub root: String,
+    pub packages: Option<Vec<Package>>,
+}
+
+/// Difference is how a path differs between two trees.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Difference {
+    /// Only in the first tree.
+    Removed,
+    /// Only in the second tree.
+    Added,
+    /// A different kind of file, like a file in one and a dir in the other.
+    Kind,
+    Content,
+    /// A symlink pointing elsewhere.
+    Target,
+    /// The same content, but a different mode or owner.
+    Metadata,
+}
+
+impl Difference {
+    pub fn label(self) -> &'static str {
+        match self {
+            Difference::Removed => "removed",
+            Difference::Added => "added",
+            Difference::Kind => "kind",
+            Difference::Content => "content",
+            Difference::Target => "target",
+            Difference::Metadata => "metadata",
+        }
+    }
+}
+
+/// PackageDifference is a package installed in only one of the trees, or at
+/// different versions, with the version in each.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct PackageDifference {
+    pub name: String,
+    pub first: Option<String>,
+    pub second: Option<String>,
+}
+
+/// Lists the packages that differ between the trees, sorted by name, when
+/// both have their packages.
+pub fn compare_packages(first: &Tree, second: &Tree) -> Vec<PackageDifference> {
+    let (first, second) = match (&first.packages, &second.packages) {
+        (Some(first), Some(second)) => (first, second),
+        _ => return vec![],
+    };
+    let mut names: BTreeMap<&str, (Option<&str>, Option<&str>)> = BTreeMap::new();
+    for pkg in first {
+        names.entry(&pkg.name).or_default().0 = Some(&pkg.version);
+    }
+    for pkg in second {
+        names.entry(&pkg.name).or_default().1 = Some(&pkg.version);
+    }
+    names
+        .into_iter()
+        .filter(|(_, (a, b))| a != b)
+        .map(|(name, (a, b))| PackageDifference {
+            name: name.to_string(),
+            first: a.map(str::to_string),
+            second: b.map(str::to_string),
+        })
+        .collect()
+}
+
+// Lists the paths under a root relative to it, staying on its file system
+// and out of the other root when it is nested inside.
+fn walk(root: &str, skip: &Path) -> BTreeMap<String, Metadata> {
+    WalkDir::new(root)
+        .same_file_system(true)
+        .min_depth(1)
+        .into_iter()
+        .filter_entry(|de| de.path() != skip)
+        .filter_map(filter_map_error)
+        .filter_map(|de| {
+            let md = filter_map_error(de.metadata())?;
+            let rel = de.path().strip_prefix(root).ok()?;
+            Some((rel.to_string_lossy().into_owned(), md))
+        })
+        .collect()
+}
+
+// Compares the contents of two files of the same size.
+fn same_content(a: &Path, b: &Path) -> std::io::Result<bool> {
+    let mut a = std::fs::File::open(a)?;
+    let mut b = std::fs::File::open(b)?;
+    let mut buf_a = vec![0; 64 * 1024];
+    let mut buf_b = vec![0; 64 * 1024];
+    loop {
+        let n = a.read(&mut buf_a)?;
+        if n == 0 {
+            return Ok(true);
+        }
+        b.read_exact(&mut buf_b[..n])?;
+        if buf_a[..n] != buf_b[..n] {
+            return Ok(false);
+        }
+    }
+}
+
+/// Compares two trees, returning the paths that differ sorted by path. When
+/// both trees have their packages, the files of packages installed at
+/// different versions are left out, since those differences follow from the
+/// package differences.
+pub fn compare(first: &Tree, second: &Tree) -> Vec<(String, Difference)> {
+    let first_root = PathBuf::from(&first.root);
+    let second_root = PathBuf::from(&second.root);
+    let (a, b) = rayon::join(
+        || walk(&first.root, &second_root),
+        || walk(&second.root, &first_root),
+    );
+    let skipped: HashSet<&str> = match (&first.packages, &second.packages) {
+        (Some(first_pkgs), Some(second_pkgs)) => {
+            let changed: HashSet<String> = compare_packages(first, second)
+                .into_iter()
+                .map(|d| d.name)
+                .collect();
+            first_pkgs
+                .iter()
+                .chain(second_pkgs)
+                .filter(|pkg| changed.contains(&pkg.name))
+                .flat_map(|pkg| &pkg.files)
+                .map(|f| f.trim_end_matches('/'))
+                .collect()
+        }
+        _ => HashSet::new(),
+    };
+    let mut paths: BTreeMap<&str, (Option<&Metadata>, Option<&Metadata>)> = BTreeMap::new();
+    for (path, md) in &a {
+        paths.entry(path).or_default().0 = Some(md);
+    }
+    for (path, md) in &b {
+        paths.entry(path).or_default().1 = Some(md);
+    }
+    paths
+        .into_par_iter()
+        .filter(|(path, _)| !skipped.contains(path))
+        .filter_map(|(path, pair)| {
+            let (a, b) = match pair {
+                (Some(a), Some(b)) => (a, b),
+                (Some(_), None) => return Some((path.to_string(), Difference::Removed)),
+                (None, Some(_)) => return Some((path.to_string(), Difference::Added)),
+                (None, None) => return None,
+            };
+            let fa = first_root.join(path);
+            let fb = second_root.join(path);
+            let difference = if a.file_type() != b.file_type() {
+                Some(Difference::Kind)
+            } else if a.file_type().is_symlink() {
+                match (std::fs::read_link(&fa), std::fs::read_link(&fb)) {
+                    (Ok(ta), Ok(tb)) if ta == tb => None,
+                    _ => Some(Difference::Target),
+                }
+            } else if a.is_file()
+                && (a.len() != b.len()
+                    || !filter_map_error(
+                        same_content(&fa, &fb)
+                            .map_err(|err| anyhow!("failed to compare {}: {}", path, err)),
+                    )?)
+            {
+                Some(Difference::Content)
+            } else if a.mode() & 0o7777 != b.mode() & 0o7777
+                || a.uid() != b.uid()
+                || a.gid() != b.gid()
+            {
+                Some(Difference::Metadata)
+            } else {
+                None
+            };
+            difference.map(|d| (path.to_string(), d))
+        })
+        .collect()
+}
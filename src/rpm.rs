@@ -0,0 +1,387 @@
+use crate::hash::HashAlgo;
+use crate::mtree::MtreeEntry;
+use crate::source::{BackupHash, Package, PackageSource, Reason};
+use anyhow::{anyhow, Context, Result};
+use std::collections::{HashMap, HashSet};
+use std::path::Path;
+use std::sync::Mutex;
+
+// The fields printed for each file of a package, one line per file with the
+// path last since it is the only one that can hold spaces.
+const FILES: &str = "[F%{FILEFLAGS:fflags}\t%{FILEMODES:octal}\t%{FILESIZES}\t%{FILEUSERNAME}\t%{FILEGROUPNAME}\t%{FILEDIGESTS}\t%{FILELINKTOS}\t%{FILENAMES}\n]";
+
+// Runs a program in the C locale, since its output is parsed.
+fn run(program: &str, args: &[&str]) -> Result<String> {
+    let output = std::process::Command::new(program)
+        .args(args)
+        .env("LC_ALL", "C")
+        .output()
+        .with_context(|| format!("failed to run {}", program))?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "{} {} failed: {}",
+            program,
+            args.join(" "),
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    String::from_utf8(output.stdout).with_context(|| format!("{} printed invalid utf-8", program))
+}
+
+// Maps the names in a passwd or group file to their ids, which rpm does not
+// record.
+fn ids(path: &Path) -> HashMap<String, u32> {
+    std::fs::read_to_string(path)
+        .unwrap_or_default()
+        .lines()
+        .filter_map(|line| {
+            let mut parts = line.split(':');
+            let name = parts.next()?;
+            let id = parts.nth(1)?.parse().ok()?;
+            Some((name.to_string(), id))
+        })
+        .collect()
+}
+
+// Finds the hash algorithm of the file digests of a package, which rpm
+// numbers like OpenPGP does. Old packages record md5 without saying so.
+fn digest_algo(algo: &str) -> Option<HashAlgo> {
+    match algo {
+        "1" | "(none)" => Some(HashAlgo::Md5),
+        "8" => Some(HashAlgo::Sha256),
+        _ => None,
+    }
+}
+
+// A file of a package as printed with the FILES format.
+struct File<'a> {
+    flags: &'a str,
+    mode: u32,
+    size: &'a str,
+    user: &'a str,
+    group: &'a str,
+    digest: &'a str,
+    link: &'a str,
+    path: &'a str,
+}
+
+impl<'a> File<'a> {
+    fn parse(line: &'a str) -> Option<Self> {
+        let mut parts = line.splitn(8, '\t');
+        Some(Self {
+            flags: parts.next()?,
+            mode: u32::from_str_radix(parts.next()?, 8).ok()?,
+            size: parts.next()?,
+            user: parts.next()?,
+            group: parts.next()?,
+            digest: parts.next()?,
+            link: parts.next()?,
+            path: parts.next()?.trim_start_matches('/'),
+        })
+    }
+
+    fn is_dir(&self) -> bool {
+        self.mode & 0o170000 == 0o040000
+    }
+
+    // Ghost files are owned by a package without being part of it, like
+    // logs, and need not exist.
+    fn is_ghost(&self) -> bool {
+        self.flags.contains('g')
+    }
+}
+
+/// Rpm reads the packages installed on Fedora, RHEL and other rpm based
+/// systems by running rpm, whose database format differs between releases.
+/// Config files are the backup files. Rpm records no install reason, so every
+/// package counts as explicitly installed. Packages installed for several
+/// architectures, like multilib pairs, are named name.arch the way rpm -q
+/// prints them.
+pub struct Rpm {
+    root: String,
+    // The dirs and files of each installed package, kept from the query for
+    // all packages for verify_data.
+    entries: Mutex<HashMap<String, Vec<(String, MtreeEntry)>>>,
+}
+
+impl Rpm {
+    pub fn new(root: &str) -> Self {
+        Self {
+            root: root.to_string(),
+            entries: Mutex::default(),
+        }
+    }
+
+    fn query(&self, args: &[&str]) -> Result<String> {
+        let mut all = vec!["--root", self.root.as_str(), "-q"];
+        all.extend(args);
+        run("rpm", &all)
+    }
+}
+
+// Reads the mtree data of a file, going by the digest algorithm of its
+// package and the ids of the users and groups in the root.
+fn entry(
+    file: &File,
+    algo: Option<HashAlgo>,
+    users: &HashMap<String, u32>,
+    groups: &HashMap<String, u32>,
+) -> MtreeEntry {
+    let mut entry = MtreeEntry {
+        kind: match file.mode & 0o170000 {
+            0o040000 => "dir",
+            0o120000 => "link",
+            _ => "file",
+        }
+        .to_string(),
+        uid: users.get(file.user).copied(),
+        gid: groups.get(file.group).copied(),
+        mode: Some(file.mode & 0o7777),
+        ..MtreeEntry::default()
+    };
+    match entry.kind.as_str() {
+        "link" => entry.link = Some(file.link.to_string()),
+        "file" => {
+            entry.size = file.size.parse().ok();
+            match algo {
+                Some(HashAlgo::Md5) => entry.md5 = Some(file.digest.to_string()),
+                Some(HashAlgo::Sha256) => entry.sha256 = Some(file.digest.to_string()),
+                _ => (),
+            }
+        }
+        _ => (),
+    }
+    entry
+}
+
+// Reads the packages from the output of the query for all packages, along
+// with the mtree data of their files.
+fn parse(
+    output: &str,
+    users: &HashMap<String, u32>,
+    groups: &HashMap<String, u32>,
+) -> Vec<(Package, Vec<(String, MtreeEntry)>)> {
+    let mut pkgs: Vec<(Package, Vec<(String, MtreeEntry)>)> = vec![];
+    let mut arches = vec![];
+    let mut algo = None;
+    for line in output.lines() {
+        // every line starts with a letter saying what it holds
+        if line.is_empty() {
+            continue;
+        }
+        let (kind, value) = line.split_at(1);
+        if kind == "@" {
+            let mut parts = value.split('\t');
+            let name = parts.next().unwrap_or_default().to_string();
+            arches.push(parts.next().unwrap_or_default().to_string());
+            let version = parts.next().unwrap_or_default().to_string();
+            algo = digest_algo(parts.next().unwrap_or_default());
+            let pkg = Package {
+                name,
+                version,
+                reason: Reason::Explicit,
+                ..Package::default()
+            };
+            pkgs.push((pkg, vec![]));
+            continue;
+        }
+        let (pkg, entries) = match pkgs.last_mut() {
+            Some(pkg) => pkg,
+            None => continue,
+        };
+        match kind {
+            "R" => pkg.depends.push(value.to_string()),
+            "W" | "S" => pkg.optdepends.push(value.to_string()),
+            "P" => pkg.provides.push(value.to_string()),
+            "F" => {
+                let file = match File::parse(value) {
+                    Some(file) if !file.is_ghost() => file,
+                    _ => continue,
+                };
+                entries.push((file.path.to_string(), entry(&file, algo, users, groups)));
+                if file.is_dir() {
+                    pkg.files.push(format!("{}/", file.path));
+                    continue;
+                }
+                pkg.files.push(file.path.to_string());
+                if !file.flags.contains('c') {
+                    continue;
+                }
+                // config files in a digest algorithm archdiff cannot
+                // hash are not compared
+                let hash = match algo {
+                    Some(_) => BackupHash::Recorded(file.digest.to_string()),
+                    None => BackupHash::Unknown,
+                };
+                pkg.backup.push((file.path.to_string(), hash));
+            }
+            _ => (),
+        }
+    }
+    let mut counts: HashMap<String, usize> = HashMap::new();
+    for (pkg, _) in &pkgs {
+        *counts.entry(pkg.name.clone()).or_default() += 1;
+    }
+    for ((pkg, _), arch) in pkgs.iter_mut().zip(arches) {
+        if counts[&pkg.name] > 1 {
+            pkg.name = format!("{}.{}", pkg.name, arch);
+        }
+    }
+    pkgs.sort_by(|a, b| a.0.name.cmp(&b.0.name));
+    pkgs
+}
+
+impl PackageSource for Rpm {
+    fn packages(&self) -> Result<Vec<Package>> {
+        let format = format!(
+            "@%{{NAME}}\t%{{ARCH}}\t%|EPOCH?{{%{{EPOCH}}:}}:{{}}|%{{VERSION}}-%{{RELEASE}}\t%{{FILEDIGESTALGO}}\n[R%{{REQUIRENAME}}\n][W%{{RECOMMENDNAME}}\n][S%{{SUGGESTNAME}}\n][P%{{PROVIDENAME}}\n]{}",
+            FILES
+        );
+        let output = self.query(&["-a", "--queryformat", &format])?;
+        let users = ids(&Path::new(&self.root).join("etc/passwd"));
+        let groups = ids(&Path::new(&self.root).join("etc/group"));
+        let mut pkgs = vec![];
+        let mut all_entries = HashMap::new();
+        for (pkg, entries) in parse(&output, &users, &groups) {
+            all_entries.insert(pkg.name.clone(), entries);
+            pkgs.push(pkg);
+        }
+        *self.entries.lock().unwrap() = all_entries;
+        Ok(pkgs)
+    }
+
+    // The repos are read from the dnf cache, without refreshing it.
+    fn available(&self) -> Result<HashSet<String>> {
+        Ok(run(
+            "dnf",
+            &[
+                "--installroot",
+                &self.root,
+                "--cacheonly",
+                "--quiet",
+                "repoquery",
+                "--queryformat",
+                "%{name}\n",
+            ],
+        )?
+        .lines()
+        .filter(|l| !l.is_empty())
+        .map(str::to_string)
+        .collect())
+    }
+
+    fn verify_data(&self, pkg: &Package) -> Result<Vec<(String, MtreeEntry)>> {
+        Ok(self
+            .entries
+            .lock()
+            .unwrap()
+            .get(&pkg.name)
+            .cloned()
+            .unwrap_or_default())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::{digest_algo, parse, File};
+    use crate::hash::HashAlgo;
+    use crate::source::BackupHash;
+    use std::collections::HashMap;
+
+    #[test]
+    fn packages() {
+        let output = "\
+@glibc\tx86_64\t2.38-1\t8
+Rbash
+Pglibc
+Fc\t100644\t12\troot\troot\tabcd\t\t/etc/ld.so.conf
+F\t40755\t4096\troot\troot\t\t\t/usr/lib64
+@glibc\ti686\t2.38-1\t8
+Pglibc
+F\t40755\t4096\troot\troot\t\t\t/usr/lib
+@bash\tx86_64\t1:5.2-2\t10
+Fc\t100644\t3\troot\twheel\tffff\t\t/etc/bashrc
+Fg\t100644\t0\troot\troot\t\t\t/var/log/bash.log
+";
+        let users: HashMap<String, u32> = vec![("root".to_string(), 0)].into_iter().collect();
+        let groups: HashMap<String, u32> = vec![("root".to_string(), 0), ("wheel".to_string(), 10)]
+            .into_iter()
+            .collect();
+        let pkgs = parse(output, &users, &groups);
+        let names: Vec<&str> = pkgs.iter().map(|(p, _)| p.name.as_str()).collect();
+        // multilib pairs keep apart, other packages keep their plain names
+        assert_eq!(names, vec!["bash", "glibc.i686", "glibc.x86_64"]);
+
+        let (bash, entries) = &pkgs[0];
+        assert_eq!(bash.version, "1:5.2-2");
+        assert_eq!(bash.files, vec!["etc/bashrc"]);
+        // digests of an unknown algorithm are not compared
+        assert_eq!(
+            bash.backup,
+            vec![("etc/bashrc".to_string(), BackupHash::Unknown)]
+        );
+        assert_eq!(entries.len(), 1);
+        assert_eq!(entries[0].1.gid, Some(10));
+        assert_eq!(entries[0].1.sha256, None);
+
+        let (glibc, entries) = &pkgs[2];
+        assert_eq!(glibc.depends, vec!["bash"]);
+        assert_eq!(glibc.provides, vec!["glibc"]);
+        assert_eq!(glibc.files, vec!["etc/ld.so.conf", "usr/lib64/"]);
+        assert_eq!(
+            glibc.backup,
+            vec![(
+                "etc/ld.so.conf".to_string(),
+                BackupHash::Recorded("abcd".to_string())
+            )]
+        );
+        assert_eq!(entries[0].0, "etc/ld.so.conf");
+        assert_eq!(entries[0].1.sha256.as_deref(), Some("abcd"));
+        assert_eq!(entries[0].1.size, Some(12));
+        assert_eq!(entries[1].0, "usr/lib64");
+        assert_eq!(entries[1].1.kind, "dir");
+        assert_eq!(entries[1].1.mode, Some(0o755));
+    }
+
+    #[test]
+    fn parse_file() {
+        let line = "c\t100644\t42\troot\twheel\tabc123\t\t/etc/foo.conf";
+        let file = File::parse(line).unwrap();
+        assert_eq!(file.flags, "c");
+        assert_eq!(file.mode, 0o100644);
+        assert_eq!(file.size, "42");
+        assert_eq!(file.user, "root");
+        assert_eq!(file.group, "wheel");
+        assert_eq!(file.digest, "abc123");
+        assert_eq!(file.link, "");
+        assert_eq!(file.path, "etc/foo.conf");
+        assert!(!file.is_dir());
+        assert!(!file.is_ghost());
+    }
+
+    #[test]
+    fn parse_dir_and_ghost() {
+        let dir = File::parse("\t40755\t4096\troot\troot\t\t\t/usr/share/foo").unwrap();
+        assert!(dir.is_dir());
+        let ghost = File::parse("g\t100644\t0\troot\troot\t\t\t/var/log/foo.log").unwrap();
+        assert!(ghost.is_ghost());
+        // paths with tabs stay whole
+        let tab = File::parse("\t100644\t0\troot\troot\t\t\t/a\tb").unwrap();
+        assert_eq!(tab.path, "a\tb");
+    }
+
+    #[test]
+    fn parse_invalid() {
+        assert!(File::parse("").is_none());
+        assert!(File::parse("\tnotoctal\t0\troot\troot\t\t\t/a").is_none());
+        assert!(File::parse("\t100644\t0\troot").is_none());
+    }
+
+    #[test]
+    fn digest_algos() {
+        assert_eq!(digest_algo("(none)"), Some(HashAlgo::Md5));
+        assert_eq!(digest_algo("1"), Some(HashAlgo::Md5));
+        assert_eq!(digest_algo("8"), Some(HashAlgo::Sha256));
+        assert_eq!(digest_algo("10"), None);
+    }
+}
@@ -0,0 +1,54 @@
+use anyhow::{anyhow, Context, Result};
+use std::path::Path;
+use std::process::Command;
+
+/// The suffix of repo files encrypted with age. The suffix is not part of the
+/// path the file is compared against or applied to.
+pub const SUFFIX: &str = ".age";
+
+/// Decrypts a file using the age identity file.
+pub fn decrypt(identity: &str, path: &str) -> Result<Vec<u8>> {
+    let output = Command::new("age")
+        .arg("--decrypt")
+        .arg("--identity")
+        .arg(identity)
+        .arg(path)
+        .output()
+        .context("failed to run age")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "failed to decrypt {}: {}",
+            path,
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    Ok(output.stdout)
+}
+
+/// Encrypts src into dst for the recipients listed in the recipients file.
+pub fn encrypt(recipients: &str, src: &Path, dst: &Path) -> Result<()> {
+    let output = Command::new("age")
+        .arg("--encrypt")
+        .arg("--recipients-file")
+        .arg(recipients)
+        .arg("--output")
+        .arg(dst)
+        .arg(src)
+        .output()
+        .context("failed to run age")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "failed to encrypt {}: {}",
+            src.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    Ok(())
+}
+
+// Checks if the decrypted contents of src differ from dst.
+pub(crate) fn differs(identity: &str, src: &str, dst: &str) -> Result<bool> {
+    let expected = decrypt(identity, src)?;
+    let actual = std::fs::read(dst).with_context(|| format!("failed to read {}", dst))?;
+    Ok(expected != actual)
+}
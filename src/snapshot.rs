@@ -0,0 +1,180 @@
+use crate::Category;
+use anyhow::{anyhow, Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::Path;
+
+/// Snapshot records the full result of a diff, so it can be compared against
+/// a diff taken at a different time or on a different machine.
+#[derive(Clone, Debug, Serialize, Deserialize)]
+pub struct Snapshot {
+    /// The host the snapshot was taken on, which older snapshots lack.
+    #[serde(default)]
+    pub host: String,
+    pub root: String,
+    /// The hash algorithm used for the entry hashes.
+    pub hash: String,
+    /// Seconds since the epoch when the snapshot was taken.
+    pub time: u64,
+    pub entries: Vec<SnapshotEntry>,
+}
+
+/// SnapshotEntry is a diff entry along with the state of the file on disk,
+/// which is empty for deleted files.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SnapshotEntry {
+    pub path: String,
+    pub category: Category,
+    pub hash: Option<String>,
+    pub size: Option<u64>,
+    pub mode: Option<u32>,
+    pub uid: Option<u32>,
+    pub gid: Option<u32>,
+    pub mtime: Option<i64>,
+}
+
+/// Change is a difference between two snapshots.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum Change {
+    Added(SnapshotEntry),
+    Removed(SnapshotEntry),
+    Changed(SnapshotEntry, SnapshotEntry),
+}
+
+impl Snapshot {
+    pub fn load<P: AsRef<Path>>(path: P) -> Result<Self> {
+        let path = path.as_ref();
+        let contents =
+            std::fs::read(path).with_context(|| format!("failed to read {}", path.display()))?;
+        serde_json::from_slice(&contents)
+            .with_context(|| format!("failed to parse {}", path.display()))
+    }
+
+    pub fn save<P: AsRef<Path>>(&self, path: P) -> Result<()> {
+        let path = path.as_ref();
+        let contents = serde_json::to_vec_pretty(self)?;
+        std::fs::write(path, contents)
+            .with_context(|| format!("failed to write {}", path.display()))
+    }
+
+    /// Compares this snapshot against a later one, returning the changes
+    /// sorted by path. Modification times are ignored since the hashes already
+    /// cover content changes.
+    pub fn compare(&self, later: &Snapshot) -> Result<Vec<Change>> {
+        if self.hash != later.hash {
+            return Err(anyhow!(
+                "snapshots use different hashes: {} and {}",
+                self.hash,
+                later.hash
+            ));
+        }
+        let mut paths: BTreeMap<&str, (Option<&SnapshotEntry>, Option<&SnapshotEntry>)> =
+            BTreeMap::new();
+        for e in &self.entries {
+            paths.entry(&e.path).or_default().0 = Some(e);
+        }
+        for e in &later.entries {
+            paths.entry(&e.path).or_default().1 = Some(e);
+        }
+        let mut changes = vec![];
+        for (_, pair) in paths {
+            match pair {
+                (Some(a), None) => changes.push(Change::Removed(a.clone())),
+                (None, Some(b)) => changes.push(Change::Added(b.clone())),
+                (Some(a), Some(b)) => {
+                    let b_same_mtime = SnapshotEntry {
+                        mtime: a.mtime,
+                        ..b.clone()
+                    };
+                    if *a != b_same_mtime {
+                        changes.push(Change::Changed(a.clone(), b.clone()));
+                    }
+                }
+                (None, None) => (),
+            }
+        }
+        Ok(changes)
+    }
+
+    /// Compares this snapshot against one taken on another host, returning
+    /// the paths that differ on only one of them, or on both but with
+    /// different contents or modes, sorted by path. The category is left out
+    /// since a file can differ from its package in the same way on both.
+    /// Paths holding the name of their host are matched with it replaced by
+    /// {host}, which is how they are returned.
+    pub fn compare_hosts(&self, other: &Snapshot) -> Result<Vec<Change>> {
+        if self.hash != other.hash {
+            return Err(anyhow!(
+                "snapshots use different hashes: {} and {}",
+                self.hash,
+                other.hash
+            ));
+        }
+        let normalized = |snapshot: &Snapshot| -> BTreeMap<String, SnapshotEntry> {
+            snapshot
+                .entries
+                .iter()
+                .map(|e| {
+                    let path = normalize_host(&e.path, &snapshot.host);
+                    (path.clone(), SnapshotEntry { path, ..e.clone() })
+                })
+                .collect()
+        };
+        let a = normalized(self);
+        let b = normalized(other);
+        let mut changes = vec![];
+        for (path, e) in &a {
+            match b.get(path) {
+                None => changes.push(Change::Removed(e.clone())),
+                Some(other) if e.hash != other.hash || e.mode != other.mode => {
+                    changes.push(Change::Changed(e.clone(), other.clone()))
+                }
+                Some(_) => (),
+            }
+        }
+        for (path, e) in &b {
+            if !a.contains_key(path) {
+                changes.push(Change::Added(e.clone()));
+            }
+        }
+        changes.sort_by(|x, y| change_path(x).cmp(change_path(y)));
+        Ok(changes)
+    }
+}
+
+fn change_path(change: &Change) -> &str {
+    match change {
+        Change::Added(e) | Change::Removed(e) | Change::Changed(e, _) => &e.path,
+    }
+}
+
+/// Replaces the host name in a path with {host}, trying the full name before
+/// the short one. Only whole words are replaced, so a host named web does not
+/// turn /srv/website into /srv/{host}site.
+pub fn normalize_host(path: &str, host: &str) -> String {
+    let short = host.split('.').next().unwrap_or_default();
+    let word = |c: Option<char>| c.is_some_and(|c| c.is_alphanumeric());
+    let mut out = String::new();
+    let mut i = 0;
+    while i < path.len() {
+        let rest = &path[i..];
+        let name = [host, short].iter().copied().find(|name| {
+            !name.is_empty()
+                && rest.starts_with(*name)
+                && !word(path[..i].chars().next_back())
+                && !word(rest[name.len()..].chars().next())
+        });
+        match name {
+            Some(name) => {
+                out.push_str("{host}");
+                i += name.len();
+            }
+            None => {
+                let c = rest.chars().next().unwrap_or_default();
+                out.push(c);
+                i += c.len_utf8();
+            }
+        }
+    }
+    out
+}
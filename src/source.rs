@@ -0,0 +1,276 @@
+use crate::apk::Apk;
+use crate::dpkg::Dpkg;
+use crate::localdb::LocalDb;
+use crate::mtree::MtreeEntry;
+use crate::query::Pacman;
+use crate::rpm::Rpm;
+use anyhow::{anyhow, Result};
+use log::warn;
+use std::collections::HashSet;
+
+/// Reason is why a package was installed.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum Reason {
+    #[default]
+    Explicit,
+    Depend,
+}
+
+/// Package is an installed package, as read from the package database.
+#[derive(Clone, Debug, Default)]
+pub struct Package {
+    pub name: String,
+    pub version: String,
+    pub reason: Reason,
+    pub groups: Vec<String>,
+    /// The dependencies, possibly with a version constraint like foo>=1.
+    pub depends: Vec<String>,
+    /// The optional dependencies, possibly followed by a : and description.
+    pub optdepends: Vec<String>,
+    /// The names the package can be depended on by besides its own.
+    pub provides: Vec<String>,
+    /// The files and dirs owned by the package relative to the root, with
+    /// dirs ending in a slash.
+    pub files: Vec<String>,
+    /// The backup files relative to the root, along with what is known of
+    /// their contents as installed.
+    pub backup: Vec<(String, BackupHash)>,
+}
+
+/// BackupHash is what the package manager knows of the installed contents of
+/// a backup file.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum BackupHash {
+    /// The hash recorded when the file was installed, in whichever of md5,
+    /// sha1 or sha256 the package manager uses.
+    Recorded(String),
+    /// The package manager reported the file as unmodified, without a hash.
+    Unmodified,
+    /// The package manager reported the file as modified, without a hash.
+    Modified,
+    /// The package manager could not read the file to tell.
+    Unreadable,
+    /// Nothing is known to compare the file against, like for missing files
+    /// or hashes in an algorithm archdiff cannot compute.
+    Unknown,
+}
+
+// Strips the version constraint or description from a dependency. Names can
+// hold a colon, like so:libc.so, but descriptions follow a colon and space.
+fn dep_name(dep: &str) -> &str {
+    let dep = dep.split(": ").next().unwrap_or(dep);
+    let end = dep.find(['<', '>', '=']).unwrap_or(dep.len());
+    dep[..end].trim()
+}
+
+impl Package {
+    /// Whether another package depends on or optionally uses this one, either
+    /// by name or by something it provides.
+    pub fn is_required(&self, pkgs: &[Package]) -> bool {
+        let names: HashSet<&str> = std::iter::once(self.name.as_str())
+            .chain(self.provides.iter().map(|p| dep_name(p)))
+            .collect();
+        pkgs.iter()
+            .filter(|pkg| pkg.name != self.name)
+            .flat_map(|pkg| pkg.depends.iter().chain(&pkg.optdepends))
+            .any(|dep| names.contains(dep_name(dep)))
+    }
+}
+
+/// Backend selects how the package database is read.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub enum Backend {
+    /// Use libalpm, falling back to running pacman if it fails, or parse the
+    /// database when built without libalpm.
+    #[default]
+    Auto,
+    /// Use libalpm, like pacman does.
+    Alpm,
+    /// Parse the files in the database dir directly, which needs no libalpm.
+    Local,
+    /// Run pacman and parse its output, for when libalpm does not match the
+    /// installed pacman.
+    Pacman,
+    /// Read the dpkg database of Debian and derived systems.
+    Dpkg,
+    /// Run rpm, for Fedora, RHEL and other rpm based systems.
+    Rpm,
+    /// Read the apk database of Alpine.
+    Apk,
+}
+
+impl std::str::FromStr for Backend {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "auto" => Ok(Backend::Auto),
+            "alpm" => Ok(Backend::Alpm),
+            "local" => Ok(Backend::Local),
+            "pacman" => Ok(Backend::Pacman),
+            "dpkg" => Ok(Backend::Dpkg),
+            "rpm" => Ok(Backend::Rpm),
+            "apk" => Ok(Backend::Apk),
+            _ => Err(anyhow!("unknown backend {}", s)),
+        }
+    }
+}
+
+/// PackageSource is what the diff needs from a package manager: the
+/// installed packages along with the files and backup files they own, which
+/// owners are found from, the packages its repos have, and the data recorded
+/// to verify the files of each package.
+pub trait PackageSource: Sync {
+    /// Reads the installed packages, sorted by name.
+    fn packages(&self) -> Result<Vec<Package>>;
+
+    /// Lists the names of the packages available from the repos, which is
+    /// used to find foreign packages.
+    fn available(&self) -> Result<HashSet<String>>;
+
+    /// Reads the integrity data recorded for the files of an installed
+    /// package, keyed by their path relative to the root.
+    fn verify_data(&self, pkg: &Package) -> Result<Vec<(String, MtreeEntry)>>;
+}
+
+impl Backend {
+    /// Whether the repos that foreign packages are found from are the sync
+    /// databases in pacman.conf.
+    pub fn uses_sync_dbs(self) -> bool {
+        !matches!(self, Backend::Dpkg | Backend::Rpm | Backend::Apk)
+    }
+
+    /// Opens the package source and reads the installed packages. Auto falls
+    /// back to running pacman when libalpm fails to read the database.
+    pub fn open(
+        self,
+        root: &str,
+        dbpath: &str,
+        sync_dbs: &[String],
+    ) -> Result<(Box<dyn PackageSource>, Vec<Package>)> {
+        let source: Box<dyn PackageSource> = match self {
+            Backend::Auto if cfg!(feature = "alpm") => {
+                return Backend::Alpm.open(root, dbpath, sync_dbs).or_else(|err| {
+                    warn!(
+                        "failed to read the package database, running pacman instead: {:#}",
+                        err
+                    );
+                    Backend::Pacman.open(root, dbpath, sync_dbs)
+                })
+            }
+            Backend::Auto => return Backend::Local.open(root, dbpath, sync_dbs),
+            Backend::Alpm => alpm_source(root, dbpath, sync_dbs)?,
+            Backend::Local => Box::new(LocalDb {
+                dbpath: dbpath.to_string(),
+                sync_dbs: sync_dbs.to_vec(),
+            }),
+            Backend::Pacman => Box::new(Pacman {
+                root: root.to_string(),
+                dbpath: dbpath.to_string(),
+            }),
+            Backend::Dpkg => Box::new(Dpkg::new(root)),
+            Backend::Rpm => Box::new(Rpm::new(root)),
+            Backend::Apk => Box::new(Apk::new(root)),
+        };
+        let pkgs = source.packages()?;
+        Ok((source, pkgs))
+    }
+}
+
+/// Alpm reads the package database with libalpm.
+#[cfg(feature = "alpm")]
+pub struct Alpm {
+    root: String,
+    dbpath: String,
+    sync_dbs: Vec<String>,
+}
+
+#[cfg(feature = "alpm")]
+impl Alpm {
+    // The handle is not Sync, so one is opened for each use.
+    fn handle(&self) -> Result<alpm::Alpm> {
+        let mut alpm = alpm::Alpm::new(self.root.as_bytes(), self.dbpath.as_bytes())?;
+        for db in &self.sync_dbs {
+            alpm.register_syncdb(db.as_str(), alpm::SigLevel::USE_DEFAULT)?;
+        }
+        Ok(alpm)
+    }
+}
+
+#[cfg(feature = "alpm")]
+impl PackageSource for Alpm {
+    fn packages(&self) -> Result<Vec<Package>> {
+        let alpm = self.handle()?;
+        let mut pkgs: Vec<Package> = alpm
+            .localdb()
+            .pkgs()
+            .iter()
+            .map(|pkg| Package {
+                name: pkg.name().to_string(),
+                version: pkg.version().to_string(),
+                reason: match pkg.reason() {
+                    alpm::PackageReason::Explicit => Reason::Explicit,
+                    alpm::PackageReason::Depend => Reason::Depend,
+                },
+                groups: pkg.groups().iter().map(str::to_string).collect(),
+                depends: pkg.depends().iter().map(|d| d.name().to_string()).collect(),
+                optdepends: pkg
+                    .optdepends()
+                    .iter()
+                    .map(|d| d.name().to_string())
+                    .collect(),
+                provides: pkg
+                    .provides()
+                    .iter()
+                    .map(|d| d.name().to_string())
+                    .collect(),
+                files: pkg
+                    .files()
+                    .files()
+                    .iter()
+                    .map(|f| f.name().to_string())
+                    .collect(),
+                backup: pkg
+                    .backup()
+                    .iter()
+                    .map(|b| {
+                        let hash = BackupHash::Recorded(b.hash().to_string());
+                        (b.name().to_string(), hash)
+                    })
+                    .collect(),
+            })
+            .collect();
+        pkgs.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(pkgs)
+    }
+
+    fn available(&self) -> Result<HashSet<String>> {
+        let alpm = self.handle()?;
+        let names = alpm
+            .syncdbs()
+            .iter()
+            .flat_map(|db| db.pkgs().iter().map(|pkg| pkg.name().to_string()))
+            .collect();
+        Ok(names)
+    }
+
+    fn verify_data(&self, pkg: &Package) -> Result<Vec<(String, MtreeEntry)>> {
+        crate::localdb::read_local_mtree(&self.dbpath, pkg)
+    }
+}
+
+#[cfg(feature = "alpm")]
+fn alpm_source(root: &str, dbpath: &str, sync_dbs: &[String]) -> Result<Box<dyn PackageSource>> {
+    Ok(Box::new(Alpm {
+        root: root.to_string(),
+        dbpath: dbpath.to_string(),
+        sync_dbs: sync_dbs.to_vec(),
+    }))
+}
+
+#[cfg(not(feature = "alpm"))]
+fn alpm_source(_: &str, _: &str, _: &[String]) -> Result<Box<dyn PackageSource>> {
+    Err(anyhow!(
+        "archdiff was built without libalpm, use --backend local"
+    ))
+}
@@ -0,0 +1,67 @@
+use anyhow::{Context, Result};
+use std::os::linux::net::SocketAddrExt;
+use std::os::unix::fs::MetadataExt;
+use std::os::unix::net::{SocketAddr, UnixDatagram};
+use std::time::Duration;
+
+/// Sends a state change like READY=1 or STATUS=... to the service manager,
+/// if the process was started by systemd with Type=notify. It does nothing
+/// otherwise.
+pub fn notify(state: &str) -> Result<()> {
+    let path = match std::env::var_os("NOTIFY_SOCKET") {
+        Some(path) => path,
+        None => return Ok(()),
+    };
+    let path = path.to_string_lossy();
+    // a leading @ stands for the NUL of an abstract socket
+    let addr = match path.strip_prefix('@') {
+        Some(name) => SocketAddr::from_abstract_name(name),
+        None => SocketAddr::from_pathname(path.as_ref()),
+    }
+    .with_context(|| format!("invalid NOTIFY_SOCKET {}", path))?;
+    let socket = UnixDatagram::unbound().context("failed to create notify socket")?;
+    socket
+        .send_to_addr(state.as_bytes(), &addr)
+        .with_context(|| format!("failed to notify {}", path))?;
+    Ok(())
+}
+
+/// How often to send WATCHDOG=1, which is half the watchdog timeout systemd
+/// set with WatchdogSec=, or None if the watchdog is not enabled for this
+/// process.
+pub fn watchdog_interval() -> Option<Duration> {
+    if let Ok(pid) = std::env::var("WATCHDOG_PID") {
+        if pid.parse() != Ok(std::process::id()) {
+            return None;
+        }
+    }
+    let usec: u64 = std::env::var("WATCHDOG_USEC").ok()?.parse().ok()?;
+    if usec == 0 {
+        return None;
+    }
+    Some(Duration::from_micros(usec / 2))
+}
+
+/// Whether stderr is connected to the journal, which systemd tells by setting
+/// JOURNAL_STREAM to the device and inode of the stream.
+pub fn logs_to_journal() -> bool {
+    let stream = match std::env::var("JOURNAL_STREAM") {
+        Ok(stream) => stream,
+        Err(_) => return false,
+    };
+    let md = match std::fs::metadata("/proc/self/fd/2") {
+        Ok(md) => md,
+        Err(_) => return false,
+    };
+    stream == format!("{}:{}", md.dev(), md.ino())
+}
+
+/// The syslog priority the journal reads from a <N> prefix on each line.
+pub fn priority(level: log::Level) -> u8 {
+    match level {
+        log::Level::Error => 3,
+        log::Level::Warn => 4,
+        log::Level::Info => 6,
+        log::Level::Debug | log::Level::Trace => 7,
+    }
+}
@@ -0,0 +1,77 @@
+use anyhow::{anyhow, Result};
+use std::collections::HashMap;
+
+/// The fields available to templates.
+pub const FIELDS: &[&str] = &["path", "code", "category", "package"];
+
+enum Part {
+    Text(String),
+    Field(String),
+}
+
+/// Template formats an entry using {field} placeholders, for example
+/// "{path}\t{category}\t{package}". A literal brace is written as {{ or }},
+/// and \t, \n and \\ are unescaped.
+pub struct Template(Vec<Part>);
+
+impl std::str::FromStr for Template {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        let mut parts = vec![];
+        let mut text = String::new();
+        let mut chars = s.chars().peekable();
+        while let Some(c) = chars.next() {
+            match c {
+                '{' if chars.peek() == Some(&'{') => {
+                    chars.next();
+                    text.push('{');
+                }
+                '}' if chars.peek() == Some(&'}') => {
+                    chars.next();
+                    text.push('}');
+                }
+                '{' => {
+                    let name: String = chars.by_ref().take_while(|&c| c != '}').collect();
+                    if !FIELDS.contains(&name.as_str()) {
+                        return Err(anyhow!("unknown template field {{{}}}", name));
+                    }
+                    if !text.is_empty() {
+                        parts.push(Part::Text(std::mem::take(&mut text)));
+                    }
+                    parts.push(Part::Field(name));
+                }
+                '\\' => match chars.next() {
+                    Some('t') => text.push('\t'),
+                    Some('n') => text.push('\n'),
+                    Some('0') => text.push('\0'),
+                    Some(c) => text.push(c),
+                    None => text.push('\\'),
+                },
+                c => text.push(c),
+            }
+        }
+        if !text.is_empty() {
+            parts.push(Part::Text(text));
+        }
+        Ok(Template(parts))
+    }
+}
+
+impl Template {
+    /// Renders the template, with missing fields left empty.
+    pub fn render(&self, fields: &HashMap<&str, String>) -> String {
+        let mut out = String::new();
+        for part in &self.0 {
+            match part {
+                Part::Text(text) => out.push_str(text),
+                Part::Field(name) => {
+                    if let Some(value) = fields.get(name.as_str()) {
+                        out.push_str(value);
+                    }
+                }
+            }
+        }
+        out
+    }
+}
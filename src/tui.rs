@@ -0,0 +1,299 @@
+use crate::Output;
+use anyhow::{anyhow, Result};
+use archdiff::{pacfile_base, App, Category, Entry};
+use std::io::{Read, Write};
+use std::path::Path;
+
+// Term switches the terminal to raw mode on the alternate screen, and
+// restores it when dropped.
+struct Term {
+    saved: libc::termios,
+}
+
+impl Term {
+    fn new() -> Result<Self> {
+        // SAFETY: termios is plain data and filled in by tcgetattr
+        let mut saved: libc::termios = unsafe { std::mem::zeroed() };
+        // SAFETY: saved is a valid termios
+        if unsafe { libc::tcgetattr(libc::STDIN_FILENO, &mut saved) } != 0 {
+            return Err(anyhow!(
+                "failed to get terminal attributes: {}",
+                std::io::Error::last_os_error()
+            ));
+        }
+        let mut raw = saved;
+        // SAFETY: raw is a valid termios
+        unsafe { libc::cfmakeraw(&mut raw) };
+        // SAFETY: raw is a valid termios
+        if unsafe { libc::tcsetattr(libc::STDIN_FILENO, libc::TCSANOW, &raw) } != 0 {
+            return Err(anyhow!(
+                "failed to set terminal attributes: {}",
+                std::io::Error::last_os_error()
+            ));
+        }
+        print!("\x1b[?1049h\x1b[?25l");
+        std::io::stdout().flush()?;
+        Ok(Self { saved })
+    }
+
+    // The number of columns and rows of the terminal.
+    fn size(&self) -> (usize, usize) {
+        // SAFETY: winsize is plain data and filled in by ioctl
+        let mut ws: libc::winsize = unsafe { std::mem::zeroed() };
+        // SAFETY: TIOCGWINSZ writes a winsize into ws
+        if unsafe { libc::ioctl(libc::STDOUT_FILENO, libc::TIOCGWINSZ, &mut ws) } != 0
+            || ws.ws_col == 0
+        {
+            return (80, 24);
+        }
+        (ws.ws_col as usize, ws.ws_row as usize)
+    }
+}
+
+impl Drop for Term {
+    fn drop(&mut self) {
+        print!("\x1b[?25h\x1b[?1049l");
+        let _ = std::io::stdout().flush();
+        // SAFETY: saved is the termios read in new
+        unsafe { libc::tcsetattr(libc::STDIN_FILENO, libc::TCSANOW, &self.saved) };
+    }
+}
+
+enum Key {
+    Up,
+    Down,
+    PageUp,
+    PageDown,
+    Char(char),
+}
+
+// Reads a key press, where escape sequences arrive in a single read.
+fn read_key() -> Result<Key> {
+    let mut buf = [0u8; 8];
+    let n = std::io::stdin().read(&mut buf)?;
+    Ok(match &buf[..n] {
+        b"\x1b[A" => Key::Up,
+        b"\x1b[B" => Key::Down,
+        b"\x1b[5~" => Key::PageUp,
+        b"\x1b[6~" => Key::PageDown,
+        [] => Key::Char('q'),
+        bytes => Key::Char(bytes[0] as char),
+    })
+}
+
+// Runs diff against the original contents and returns its output lines.
+fn diff_lines(original: &[u8], path: &str) -> Result<Vec<String>> {
+    Ok(crate::diff_text(original, path)?
+        .lines()
+        .map(str::to_string)
+        .collect())
+}
+
+// Describes an entry for the preview pane: why it shows up, followed by a
+// content diff or the start of the file.
+fn preview(app: &App, e: &Entry) -> Vec<String> {
+    let path = format!("{}{}", app.root(), e.path);
+    let mut lines = match app.explain(Path::new(&path)) {
+        Ok(lines) => lines,
+        Err(err) => vec![format!("{:#}", err)],
+    };
+    lines.push(String::new());
+    match e.category {
+        Category::Unpackaged => match std::fs::read_link(&path) {
+            Ok(target) => lines.push(format!("symlink to {}", target.display())),
+            Err(_) => match std::fs::read(&path) {
+                Ok(contents) if contents.contains(&0) => lines.push("binary file".to_string()),
+                Ok(contents) => lines.extend(
+                    String::from_utf8_lossy(&contents)
+                        .lines()
+                        .map(str::to_string),
+                ),
+                Err(err) => lines.push(format!("failed to read {}: {}", path, err)),
+            },
+        },
+        Category::Deleted | Category::NoExtract => lines.push("the file is missing".to_string()),
+        Category::Pacnew | Category::Pacsave => {
+            let base = match pacfile_base(&e.path) {
+                Some((_, base)) => format!("{}{}", app.root(), base),
+                None => String::new(),
+            };
+            match std::fs::read(&base) {
+                Ok(contents) => match diff_lines(&contents, &path) {
+                    Ok(diff) => lines.extend(diff),
+                    Err(err) => lines.push(format!("{:#}", err)),
+                },
+                Err(err) => lines.push(format!("failed to read {}: {}", base, err)),
+            }
+        }
+        _ => match app.original(e) {
+            Ok(Some(original)) => match diff_lines(&original, &path) {
+                Ok(diff) => lines.extend(diff),
+                Err(err) => lines.push(format!("{:#}", err)),
+            },
+            Ok(None) => (),
+            Err(err) => lines.push(format!("{:#}", err)),
+        },
+    }
+    lines
+}
+
+// Truncates s to at most width characters.
+fn fit(s: &str, width: usize) -> String {
+    s.chars().take(width).collect()
+}
+
+struct Tui<'a> {
+    app: &'a App,
+    output: &'a Output,
+    entries: Vec<Entry>,
+    // What was done to each entry, if anything.
+    done: Vec<Option<&'static str>>,
+    selected: usize,
+    top: usize,
+    preview: Vec<String>,
+    preview_top: usize,
+    message: String,
+}
+
+impl<'a> Tui<'a> {
+    fn select(&mut self, i: usize) {
+        if self.entries.is_empty() {
+            return;
+        }
+        self.selected = i.min(self.entries.len() - 1);
+        self.preview = preview(self.app, &self.entries[self.selected]);
+        self.preview_top = 0;
+    }
+
+    // Runs the action for a key on the selected entry.
+    fn act(&mut self, key: char) {
+        let e = match self.entries.get(self.selected) {
+            Some(e) => e,
+            None => return,
+        };
+        let path = format!("{}{}", self.app.root(), e.path);
+        let result = match key {
+            'a' => self
+                .app
+                .adopt(Path::new(&path), false)
+                .map(|dst| ("adopted", format!("adopted into {}", dst.display()))),
+            'i' => self
+                .app
+                .ignore_path(&e.path)
+                .map(|file| ("ignored", format!("ignored in {}", file.display()))),
+            'p' => self
+                .app
+                .apply_file(&e.path)
+                .map(|_| ("applied", format!("applied {}", path))),
+            'r' => self
+                .app
+                .restore(e)
+                .map(|_| ("restored", format!("restored {}", path))),
+            _ => return,
+        };
+        match result {
+            Ok((done, message)) => {
+                self.done[self.selected] = Some(done);
+                self.message = message;
+            }
+            Err(err) => self.message = format!("{:#}", err),
+        }
+    }
+
+    fn render(&mut self, cols: usize, rows: usize) -> String {
+        let list_rows = (rows.saturating_sub(3) / 2).max(1);
+        let preview_rows = rows.saturating_sub(list_rows + 3);
+        if self.selected < self.top {
+            self.top = self.selected;
+        } else if self.selected >= self.top + list_rows {
+            self.top = self.selected + 1 - list_rows;
+        }
+        let mut out = String::from("\x1b[H\x1b[2J");
+        let header = format!(
+            "{} differences   a adopt  i ignore  p apply  r restore  J/K scroll  q quit",
+            self.entries.len()
+        );
+        out.push_str(&format!("\x1b[1m{}\x1b[0m\r\n", fit(&header, cols)));
+        let root = self.app.root();
+        for i in self.top..(self.top + list_rows).min(self.entries.len()) {
+            let e = &self.entries[i];
+            let mut line = format!("{} {}{}", e.category.code(), root, e.path);
+            if let Some(done) = self.done[i] {
+                line.push_str(&format!(" ({})", done));
+            }
+            let line = fit(&line, cols);
+            if i == self.selected {
+                out.push_str(&format!("\x1b[7m{}\x1b[0m\r\n", line));
+            } else {
+                out.push_str(&format!("{}\r\n", self.output.paint(e.category, &line)));
+            }
+        }
+        for _ in self.entries.len().saturating_sub(self.top).min(list_rows)..list_rows {
+            out.push_str("\r\n");
+        }
+        out.push_str(&format!("{}\r\n", "-".repeat(cols)));
+        for line in self
+            .preview
+            .iter()
+            .skip(self.preview_top)
+            .take(preview_rows)
+        {
+            out.push_str(&format!("{}\r\n", fit(&line.replace('\t', "    "), cols)));
+        }
+        out.push_str(&format!(
+            "\x1b[{};1H{}",
+            rows,
+            fit(&self.message, cols.saturating_sub(1))
+        ));
+        out
+    }
+}
+
+/// Shows the entries in a full screen list with a preview pane, where single
+/// keys adopt, ignore, apply or restore the selected entry.
+pub fn run(app: &App, output: &Output, entries: Vec<Entry>) -> Result<()> {
+    // SAFETY: isatty has no preconditions
+    if unsafe { libc::isatty(libc::STDIN_FILENO) != 1 || libc::isatty(libc::STDOUT_FILENO) != 1 } {
+        return Err(anyhow!("tui needs a terminal"));
+    }
+    let term = Term::new()?;
+    let mut tui = Tui {
+        app,
+        output,
+        done: vec![None; entries.len()],
+        entries,
+        selected: 0,
+        top: 0,
+        preview: vec![],
+        preview_top: 0,
+        message: String::new(),
+    };
+    tui.select(0);
+    loop {
+        let (cols, rows) = term.size();
+        print!("{}", tui.render(cols, rows));
+        std::io::stdout().flush()?;
+        let page = (rows.saturating_sub(3) / 2).max(1);
+        tui.message.clear();
+        match read_key()? {
+            Key::Up | Key::Char('k') => tui.select(tui.selected.saturating_sub(1)),
+            Key::Down | Key::Char('j') => tui.select(tui.selected + 1),
+            Key::PageUp => tui.select(tui.selected.saturating_sub(page)),
+            Key::PageDown => tui.select(tui.selected + page),
+            Key::Char('K') => tui.preview_top = tui.preview_top.saturating_sub(page),
+            Key::Char('J') => {
+                if tui.preview_top + page < tui.preview.len() {
+                    tui.preview_top += page;
+                }
+            }
+            Key::Char('q') | Key::Char('\x03') => return Ok(()),
+            Key::Char(c) => {
+                tui.act(c);
+                let selected = tui.selected;
+                let preview_top = tui.preview_top;
+                tui.select(selected);
+                tui.preview_top = preview_top;
+            }
+        }
+    }
+}
@@ -0,0 +1,199 @@
+use anyhow::{anyhow, Result};
+use std::collections::{HashMap, HashSet};
+use std::ffi::{CString, OsStr};
+use std::os::unix::ffi::OsStrExt;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+const MASK: u32 = libc::IN_ATTRIB
+    | libc::IN_CLOSE_WRITE
+    | libc::IN_CREATE
+    | libc::IN_DELETE
+    | libc::IN_MOVED_FROM
+    | libc::IN_MOVED_TO
+    | libc::IN_ONLYDIR;
+
+/// Watcher reports changes in a set of directories using inotify.
+/// Directories created inside watched directories are watched as well.
+pub struct Watcher {
+    fd: libc::c_int,
+    dirs: HashMap<libc::c_int, PathBuf>,
+    excluded: HashSet<PathBuf>,
+}
+
+impl Watcher {
+    pub fn new() -> Result<Self> {
+        // SAFETY: inotify_init1 has no memory safety requirements
+        let fd = unsafe { libc::inotify_init1(libc::IN_CLOEXEC) };
+        if fd < 0 {
+            return Err(anyhow!(
+                "failed to initialize inotify: {}",
+                std::io::Error::last_os_error()
+            ));
+        }
+        Ok(Self {
+            fd,
+            dirs: HashMap::new(),
+            excluded: HashSet::new(),
+        })
+    }
+
+    /// Drops the changes to a file, like those archdiff writes itself, which
+    /// would otherwise wake the watcher after every diff.
+    pub fn exclude(&mut self, path: &Path) {
+        self.excluded.insert(path.to_path_buf());
+    }
+
+    /// Watches a single directory for changes to its entries.
+    pub fn add(&mut self, dir: &Path) -> Result<()> {
+        let path = CString::new(dir.as_os_str().as_bytes())?;
+        // SAFETY: path is a valid NUL terminated string
+        let wd = unsafe { libc::inotify_add_watch(self.fd, path.as_ptr(), MASK) };
+        if wd < 0 {
+            return Err(anyhow!(
+                "failed to watch {}: {}",
+                dir.display(),
+                std::io::Error::last_os_error()
+            ));
+        }
+        self.dirs.insert(wd, dir.to_path_buf());
+        Ok(())
+    }
+
+    /// Blocks until something changes, and then until nothing has changed for
+    /// the settle duration. Returns the changed paths.
+    pub fn wait(&mut self, settle: Duration) -> Result<Vec<PathBuf>> {
+        Ok(self.wait_timeout(settle, None)?.unwrap_or_default())
+    }
+
+    /// Like wait, but gives up and returns None if nothing changes within
+    /// the timeout, if one is given.
+    pub fn wait_timeout(
+        &mut self,
+        settle: Duration,
+        timeout: Option<Duration>,
+    ) -> Result<Option<Vec<PathBuf>>> {
+        let timeout = timeout.map_or(-1, |t| t.as_millis() as libc::c_int);
+        loop {
+            if !self.poll(timeout)? {
+                return Ok(None);
+            }
+            let mut changed = vec![];
+            loop {
+                self.read(&mut changed)?;
+                if !self.poll(settle.as_millis() as libc::c_int)? {
+                    break;
+                }
+            }
+            // only excluded files changed, so keep waiting
+            if changed.is_empty() {
+                continue;
+            }
+            changed.sort();
+            changed.dedup();
+            return Ok(Some(changed));
+        }
+    }
+
+    // Waits for events for up to timeout milliseconds, or forever if it is
+    // negative. Returns false on timeout.
+    fn poll(&self, timeout: libc::c_int) -> Result<bool> {
+        let mut pfd = libc::pollfd {
+            fd: self.fd,
+            events: libc::POLLIN,
+            revents: 0,
+        };
+        loop {
+            // SAFETY: pfd is a single valid pollfd
+            let n = unsafe { libc::poll(&mut pfd, 1, timeout) };
+            if n >= 0 {
+                return Ok(n > 0);
+            }
+            let err = std::io::Error::last_os_error();
+            if err.kind() != std::io::ErrorKind::Interrupted {
+                return Err(anyhow!("failed to poll inotify: {}", err));
+            }
+        }
+    }
+
+    fn read(&mut self, changed: &mut Vec<PathBuf>) -> Result<()> {
+        let mut buf = [0u8; 64 * 1024];
+        // SAFETY: buf is valid for writes of its length
+        let n = unsafe { libc::read(self.fd, buf.as_mut_ptr() as *mut libc::c_void, buf.len()) };
+        if n < 0 {
+            return Err(anyhow!(
+                "failed to read inotify events: {}",
+                std::io::Error::last_os_error()
+            ));
+        }
+        let header = std::mem::size_of::<libc::inotify_event>();
+        let mut offset = 0;
+        while offset + header <= n as usize {
+            // SAFETY: the kernel writes whole events, and read_unaligned does
+            // not require buf to be aligned
+            let event: libc::inotify_event =
+                unsafe { std::ptr::read_unaligned(buf.as_ptr().add(offset) as *const _) };
+            let name = &buf[offset + header..offset + header + event.len as usize];
+            let name = &name[..name.iter().position(|&b| b == 0).unwrap_or(name.len())];
+            offset += header + event.len as usize;
+
+            if event.mask & libc::IN_IGNORED != 0 {
+                self.dirs.remove(&event.wd);
+                continue;
+            }
+            let dir = match self.dirs.get(&event.wd) {
+                Some(dir) => dir.clone(),
+                None => continue,
+            };
+            let path = dir.join(OsStr::from_bytes(name));
+            if self.excluded.contains(&path) {
+                continue;
+            }
+            let new_dir = event.mask & libc::IN_ISDIR != 0
+                && event.mask & (libc::IN_CREATE | libc::IN_MOVED_TO) != 0;
+            if new_dir {
+                for de in walkdir::WalkDir::new(&path)
+                    .into_iter()
+                    .filter_map(|de| de.ok())
+                    .filter(|de| de.file_type().is_dir())
+                {
+                    crate::filter_map_error(self.add(de.path()));
+                }
+            }
+            changed.push(path);
+        }
+        Ok(())
+    }
+}
+
+impl Drop for Watcher {
+    fn drop(&mut self) {
+        // SAFETY: fd is owned by the watcher
+        unsafe { libc::close(self.fd) };
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::Watcher;
+    use crate::TempDir;
+    use std::time::Duration;
+
+    #[test]
+    fn exclude() {
+        let dir = TempDir::new().unwrap();
+        let mut watcher = Watcher::new().unwrap();
+        watcher.add(&dir.0).unwrap();
+        watcher.exclude(&dir.0.join("hashes"));
+        std::fs::write(dir.0.join("hashes"), "").unwrap();
+        let settle = Duration::from_millis(10);
+        let timeout = Some(Duration::from_millis(100));
+        assert_eq!(watcher.wait_timeout(settle, timeout).unwrap(), None);
+        std::fs::write(dir.0.join("hashes"), "").unwrap();
+        std::fs::write(dir.0.join("file"), "").unwrap();
+        assert_eq!(
+            watcher.wait_timeout(settle, timeout).unwrap(),
+            Some(vec![dir.0.join("file")])
+        );
+    }
+}
@@ -0,0 +1,45 @@
+use anyhow::{Context, Result};
+use std::ffi::OsString;
+use std::path::Path;
+
+/// The xattr holding file capabilities, as set by setcap.
+pub const CAPABILITY: &str = "security.capability";
+
+/// Reads the extended attributes of a path, without following symlinks,
+/// sorted by name. This includes ACLs and capabilities.
+pub fn read_xattrs<P: AsRef<Path>>(path: P) -> Result<Vec<(OsString, Vec<u8>)>> {
+    let path = path.as_ref();
+    let ctx = || format!("failed to read xattrs of {}", path.display());
+    let mut attrs = vec![];
+    for name in xattr::list(path).with_context(ctx)? {
+        if let Some(value) = xattr::get(path, &name).with_context(ctx)? {
+            attrs.push((name, value));
+        }
+    }
+    attrs.sort();
+    Ok(attrs)
+}
+
+/// Checks if a path has file capabilities.
+pub fn has_capability<P: AsRef<Path>>(path: P) -> Result<bool> {
+    let path = path.as_ref();
+    let value = xattr::get(path, CAPABILITY)
+        .with_context(|| format!("failed to read xattrs of {}", path.display()))?;
+    Ok(value.is_some())
+}
+
+/// Makes the extended attributes of dst match those of src.
+pub fn copy_xattrs<P: AsRef<Path>, Q: AsRef<Path>>(src: P, dst: Q) -> Result<()> {
+    let dst = dst.as_ref();
+    let ctx = || format!("failed to write xattrs of {}", dst.display());
+    let attrs = read_xattrs(src)?;
+    for (name, _) in read_xattrs(dst)? {
+        if !attrs.iter().any(|(n, _)| *n == name) {
+            xattr::remove(dst, &name).with_context(ctx)?;
+        }
+    }
+    for (name, value) in &attrs {
+        xattr::set(dst, name, value).with_context(ctx)?;
+    }
+    Ok(())
+}
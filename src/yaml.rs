@@ -0,0 +1,74 @@
+use serde_json::Value;
+
+/// Formats a JSON value as a YAML document with the same structure. Strings
+/// are always double quoted, which YAML reads with the same escapes as JSON.
+pub fn to_string(value: &Value) -> String {
+    let mut out = String::new();
+    write_value(&mut out, value, 0);
+    out
+}
+
+// Formats values that fit on the line of their key or list item, returning
+// None for non-empty objects and arrays.
+fn scalar(value: &Value) -> Option<String> {
+    match value {
+        Value::Null => Some("null".to_string()),
+        Value::Bool(b) => Some(b.to_string()),
+        Value::Number(n) => Some(n.to_string()),
+        Value::String(s) => Some(quote(s)),
+        Value::Array(items) if items.is_empty() => Some("[]".to_string()),
+        Value::Object(map) if map.is_empty() => Some("{}".to_string()),
+        _ => None,
+    }
+}
+
+fn quote(s: &str) -> String {
+    serde_json::to_string(s).unwrap_or_default()
+}
+
+// Keys are left bare when they cannot be mistaken for anything else.
+fn key(k: &str) -> String {
+    let bare = !k.is_empty()
+        && k.chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '_' || c == '-')
+        && k.starts_with(|c: char| c.is_ascii_alphabetic());
+    if bare {
+        k.to_string()
+    } else {
+        quote(k)
+    }
+}
+
+fn write_value(out: &mut String, value: &Value, indent: usize) {
+    let pad = " ".repeat(indent);
+    match value {
+        Value::Object(map) if !map.is_empty() => {
+            for (k, v) in map {
+                out.push_str(&format!("{}{}:", pad, key(k)));
+                match scalar(v) {
+                    Some(s) => out.push_str(&format!(" {}\n", s)),
+                    None => {
+                        out.push('\n');
+                        write_value(out, v, indent + 2);
+                    }
+                }
+            }
+        }
+        Value::Array(items) if !items.is_empty() => {
+            for item in items {
+                out.push_str(&format!("{}-", pad));
+                match scalar(item) {
+                    Some(s) => out.push_str(&format!(" {}\n", s)),
+                    None => {
+                        // the first line of the nested value goes after the dash
+                        let mut nested = String::new();
+                        write_value(&mut nested, item, indent + 2);
+                        out.push(' ');
+                        out.push_str(&nested[indent + 2..]);
+                    }
+                }
+            }
+        }
+        v => out.push_str(&format!("{}{}\n", pad, scalar(v).unwrap_or_default())),
+    }
+}